@@ -2,13 +2,23 @@ package main
 
 import (
 	"log"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/disk"
 	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/metrics"
+	"github.com/andviro/grayproxy/pkg/route"
 )
 
 type listener interface {
 	Listen(dest chan<- gelf.Chunk) (err error)
+	Close() error
 }
 
 type sender interface {
@@ -21,81 +31,271 @@ type queue interface {
 	Close() error
 }
 
+// input is a running listener
+type input struct {
+	cfg  inputConfig
+	l    listener
+	done chan struct{}
+}
+
 type app struct {
+	configFile  string
 	inputURLs   urlList
 	outputURLs  urlList
+	routes      urlList
 	verbose     bool
 	sendTimeout int
 	dataDir     string
+	metricsAddr string
+	adminAddr   string
+
+	shutdownTimeout   int
+	tcpMaxConnections int
+	tcpIdleTimeout    int
+	setFlags          map[string]bool
 
-	ins        []listener
-	outs       []sender
-	sendErrors []error
-	q          queue
+	msgs     chan gelf.Chunk
+	q        queue
+	dequeued chan struct{}
+	// spill takes messages left in the pipeline when shutdown times out,
+	// if dataDir is configured, otherwise they are counted in lost
+	spill   *disk.Queue
+	aborted chan struct{}
+	lost    int
+
+	// mu serializes configuration changes
+	mu      sync.Mutex
+	stopped bool
+	inputs  map[string]*input
+	outputs map[string]*route.Output
+
+	// routing guards current configuration and output groups used by
+	// dequeue
+	routing sync.RWMutex
+	cfg     *config
+	groups  []*route.Group
 }
 
+// inputBuffer is the number of received messages waiting to be put into the
+// pipeline queue, the queue itself is bounded by queue configuration
+const inputBuffer = 1000
+
 func (app *app) enqueue(msgs <-chan gelf.Chunk) {
+	defer app.q.Close()
 	for msg := range msgs {
 		if err := app.q.Put(msg); err != nil {
-			panic(err)
+			log.Printf("dropping message: %v", err)
 		}
 	}
 }
 
 func (app *app) dequeue() {
+	defer close(app.dequeued)
 	for msg := range app.q.ReadChan() {
-		var sent bool
-		if app.verbose {
-			log.Println(string(msg))
+		if app.isAborted() || !app.route(msg) && app.isAborted() {
+			app.drop(msg)
 		}
-		for i, out := range app.outs {
-			err := out.Send(msg)
-			if err != nil {
-				if app.sendErrors[i] == nil {
-					log.Printf("out %d: %v", i, err)
-					app.sendErrors[i] = err
-				}
-				continue
-			}
-			if app.sendErrors[i] != nil {
-				log.Printf("out %d is now alive", i)
-				app.sendErrors[i] = nil
-			}
-			sent = true
-			break
+	}
+}
+
+// route passes message to all output groups, it returns false if some of
+// them failed
+func (app *app) route(msg []byte) (ok bool) {
+	app.routing.RLock()
+	defer app.routing.RUnlock()
+	if app.cfg.Verbose {
+		log.Println(string(msg))
+	}
+	ok = true
+	for _, g := range app.groups {
+		if err := g.Send(msg); err != nil {
+			log.Printf("%v", err)
+			ok = false
 		}
-		if !sent {
-			if app.dataDir == "" {
-				continue
-			}
-			if err := app.q.Put(msg); err != nil {
-				panic(err)
-			}
+	}
+	return
+}
+
+func (app *app) isAborted() bool {
+	select {
+	case <-app.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop spills message left in the pipeline after shutdown timeout, or
+// counts it as lost
+func (app *app) drop(msg []byte) {
+	if app.spill != nil {
+		if err := app.spill.Put(msg); err == nil {
+			return
 		}
 	}
+	app.lost++
 }
 
-func (app *app) run() (err error) {
-	if err = app.configure(); err != nil {
-		return
+// startInput launches listener that passes received messages to app.msgs
+func (app *app) startInput(cfg inputConfig) (*input, error) {
+	l, err := newListener(cfg)
+	if err != nil {
+		return nil, err
 	}
-	defer app.q.Close()
-	msgs := make(chan gelf.Chunk, len(app.ins)*1000000)
-	defer close(msgs)
+	in := &input{cfg: cfg, l: l, done: make(chan struct{})}
+	go func() {
+		defer close(in.done)
+		dest := make(chan gelf.Chunk)
+		stop, forwarded := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(forwarded)
+			received := metrics.InputMessages.WithLabelValues(cfg.URL)
+			for {
+				select {
+				case msg := <-dest:
+					received.Inc()
+					app.msgs <- msg
+				case <-stop:
+					return
+				}
+			}
+		}()
+		if err := in.l.Listen(dest); err != nil {
+			log.Printf("Input %s exited with error: %+v", cfg.URL, err)
+		}
+		close(stop)
+		<-forwarded
+	}()
+	log.Printf("Added input %s", cfg.URL)
+	return in, nil
+}
+
+// stop closes the listener and waits until its messages are passed on
+func (in *input) stop() {
+	if err := in.l.Close(); err != nil {
+		log.Printf("Closing input %s: %v", in.cfg.URL, err)
+	}
+	<-in.done
+	log.Printf("Removed input %s", in.cfg.URL)
+}
+
+// shutdown stops inputs, drains the pipeline and stops outputs, giving
+// them ShutdownTimeout to deliver queued messages. Messages that could not be
+// delivered in time remain in disk queues, if buffering is configured. If the
+// pipeline is not drained in time, outputs are stopped anyway and the rest of
+// the pipeline goes to the spill queue or is lost.
+func (app *app) shutdown() (err error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.stopped = true
+	deadline := time.Now().Add(time.Duration(app.cfg.ShutdownTimeout) * time.Millisecond)
 	var wg sync.WaitGroup
-	for i := range app.ins {
+	for _, in := range app.inputs {
 		wg.Add(1)
-		go func(i int) {
+		go func(in *input) {
 			defer wg.Done()
-			err := app.ins[i].Listen(msgs)
-			if err != nil {
-				log.Printf("Input %d exited with error: %+v", i, err)
+			in.stop()
+		}(in)
+	}
+	wg.Wait()
+	app.inputs = nil
+	close(app.msgs)
+	drained := true
+	select {
+	case <-app.dequeued:
+	case <-time.After(time.Until(deadline)):
+		log.Println("WARNING: shutdown timeout expired while draining pipeline")
+		drained = false
+		close(app.aborted)
+	}
+	for _, o := range app.outputs {
+		wg.Add(1)
+		go func(o *route.Output) {
+			defer wg.Done()
+			if err := o.Shutdown(deadline); err != nil {
+				log.Printf("%v", err)
 			}
-		}(i)
+		}(o)
 	}
-	go app.enqueue(msgs)
-	go app.dequeue()
-	log.Println("starting grayproxy")
 	wg.Wait()
+	app.outputs = nil
+	// outputs are closed, so the pipeline is drained without blocking
+	<-app.dequeued
+	if app.spill != nil {
+		if err := app.spill.Close(); err != nil {
+			log.Printf("%v", err)
+		}
+	}
+	if app.lost > 0 {
+		return errors.Errorf("shutdown timeout expired, %d messages of the pipeline are lost", app.lost)
+	}
+	if !drained || time.Now().After(deadline) {
+		if app.cfg.DataDir == "" {
+			return errors.New("shutdown timeout expired, undelivered messages are lost")
+		}
+		log.Println("WARNING: shutdown timeout expired, undelivered messages are kept in disk queues")
+	}
+	log.Println("grayproxy stopped")
+	return nil
+}
+
+// start launches the pipeline, inputs and outputs configured by cfg
+func (app *app) start(cfg *config) (err error) {
+	if app.q, app.spill, err = newPipelineQueue(cfg); err != nil {
+		return
+	}
+	app.msgs = make(chan gelf.Chunk, inputBuffer)
+	app.dequeued = make(chan struct{})
+	app.aborted = make(chan struct{})
+	go app.enqueue(app.msgs)
+	go app.dequeue()
+	if err := migrateLegacyQueue(cfg); err != nil {
+		log.Printf("%v", err)
+	}
+	app.apply(cfg)
 	return
 }
+
+func (app *app) run() (err error) {
+	cfg, err := app.configure()
+	if err != nil {
+		return
+	}
+	if err = app.start(cfg); err != nil {
+		return
+	}
+	if cfg.Admin != "" {
+		if err = app.serveAdmin(cfg.Admin); err != nil {
+			return
+		}
+		log.Printf("serving admin API at %s", cfg.Admin)
+	}
+	log.Println("starting grayproxy")
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	return app.handleSignals(sigs)
+}
+
+// handleSignals reloads configuration on SIGHUP and shuts down on other
+// signals
+func (app *app) handleSignals(sigs <-chan os.Signal) error {
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			log.Println("reloading configuration")
+			if err := app.reload(); err != nil {
+				log.Printf("%+v", err)
+			}
+			continue
+		}
+		log.Printf("received %v, shutting down", sig)
+		go func() {
+			for sig := range sigs {
+				if sig != syscall.SIGHUP {
+					log.Fatalf("received %v, exiting immediately", sig)
+				}
+			}
+		}()
+		return app.shutdown()
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grayproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestApp_HandleSignals(t *testing.T) {
+	dir := tempDir(t)
+	fn := filepath.Join(dir, "out.ndjson")
+	config := fmt.Sprintf(testInputs+"outputs:\n  - url: file://%s\n", fn)
+	app := &app{configFile: writeConfig(t, config)}
+	cfg, err := app.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.start(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sigs := make(chan os.Signal, 1)
+	done := make(chan error)
+	go func() { done <- app.handleSignals(sigs) }()
+	for i := 0; i < 100; i++ {
+		app.msgs <- testMessage(i)
+	}
+	sigs <- syscall.SIGHUP
+	for i := 100; i < 200; i++ {
+		app.msgs <- testMessage(i)
+	}
+	sigs <- syscall.SIGTERM
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown timed out")
+	}
+	// messages received before the signal are delivered on shutdown
+	checkMessages(t, readLines(t, fn, 200), 200)
+}
+
+// abortShutdown shuts down the app while its pipeline is blocked, so that
+// the shutdown timeout expires
+func abortShutdown(t *testing.T, app *app, n int) error {
+	app.routing.Lock()
+	for i := 0; i < n; i++ {
+		app.msgs <- testMessage(i)
+	}
+	done := make(chan error)
+	go func() { done <- app.shutdown() }()
+	time.Sleep(100 * time.Millisecond)
+	app.routing.Unlock()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown timed out")
+	}
+	return nil
+}
+
+func TestApp_ShutdownTimeout(t *testing.T) {
+	fn := filepath.Join(tempDir(t), "out.ndjson")
+	app := startTestApp(t, fmt.Sprintf(testInputs+"shutdownTimeout: 10\noutputs:\n  - url: file://%s\n", fn))
+	err := abortShutdown(t, app, 10)
+	if err == nil || !strings.Contains(err.Error(), "10 messages") {
+		t.Errorf("lost messages should be reported: %v", err)
+	}
+	if len(app.outputs) != 0 {
+		t.Errorf("outputs are not closed: %v", app.outputs)
+	}
+}
+
+func TestApp_ShutdownTimeoutSpill(t *testing.T) {
+	dir := tempDir(t)
+	fn := filepath.Join(dir, "out.ndjson")
+	config := fmt.Sprintf(testInputs+"shutdownTimeout: 10\ndataDir: %s\noutputs:\n  - url: file://%s\n", dir, fn)
+	app := startTestApp(t, config)
+	if err := abortShutdown(t, app, 10); err != nil {
+		t.Fatal(err)
+	}
+	// spilled messages are delivered after restart
+	app = startTestApp(t, config)
+	defer app.shutdown()
+	checkMessages(t, readLines(t, fn, 10), 10)
+}
+
+// scrape returns metrics served at addr by name with labels
+func scrape(t *testing.T, addr string) map[string]float64 {
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	res := make(map[string]float64)
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		i := strings.LastIndexByte(line, ' ')
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		if v, err := strconv.ParseFloat(line[i+1:], 64); err == nil {
+			res[line[:i]] = v
+		}
+	}
+	return res
+}
+
+func gelfChunk(id byte, seq, count int, data string) []byte {
+	return append([]byte{0x1e, 0x0f, 0, 0, 0, 0, 0, 0, 0, id, byte(seq), byte(count)}, data...)
+}
+
+func TestApp_Metrics(t *testing.T) {
+	addr := freeAddr(t)
+	if err := metrics.Serve(addr); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := pc.LocalAddr().String()
+	pc.Close()
+	app := startTestApp(t, fmt.Sprintf(`
+inputs:
+  - url: udp://%s
+    assembleTimeout: 50
+outputs:
+  - url: tcp://%s
+    id: unreachable
+`, in, freeAddr(t)))
+	defer app.shutdown()
+	// the input is up once its address is taken
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pc, err := net.ListenPacket("udp", in)
+		if err != nil {
+			break
+		}
+		pc.Close()
+	}
+	chunks := func(result string) string { return `grayproxy_gelf_chunks_total{result="` + result + `"}` }
+	before := scrape(t, addr)
+	conn, err := net.Dial("udp", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, chunk := range [][]byte{
+		gelfChunk(1, 0, 2, `{"short_message":`),
+		gelfChunk(1, 1, 2, `"1"}`),
+		// the second message is never completed and its repeated chunk is
+		// dropped
+		gelfChunk(2, 0, 2, `{"short_message":`),
+		gelfChunk(2, 0, 2, `{"short_message":`),
+	} {
+		if _, err := conn.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]float64{
+		`grayproxy_input_messages_total{input="udp://` + in + `"}`: 1,
+		chunks("assembled"): 2,
+		chunks("dropped"):   1,
+		chunks("expired"):   1,
+		`grayproxy_output_failures_total{output="unreachable"}`: 1,
+	}
+	var got map[string]float64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		got = scrape(t, addr)
+		ok := true
+		for name, v := range expected {
+			ok = ok && got[name]-before[name] == v
+		}
+		if ok {
+			return
+		}
+	}
+	for name, v := range expected {
+		if got[name]-before[name] != v {
+			t.Errorf("%s = %v, expected %v", name, got[name]-before[name], v)
+		}
+	}
+}
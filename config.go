@@ -1,20 +1,31 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
 	"flag"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"reflect"
+	"strconv"
 	"strings"
 
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"github.com/andviro/grayproxy/pkg/console"
 	"github.com/andviro/grayproxy/pkg/disk"
-	"github.com/andviro/grayproxy/pkg/dummy"
-	"github.com/andviro/grayproxy/pkg/http"
+	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/kafka"
+	"github.com/andviro/grayproxy/pkg/limit"
 	"github.com/andviro/grayproxy/pkg/loki"
-	"github.com/andviro/grayproxy/pkg/tcp"
+	"github.com/andviro/grayproxy/pkg/memory"
+	"github.com/andviro/grayproxy/pkg/route"
 	"github.com/andviro/grayproxy/pkg/tls"
-	"github.com/andviro/grayproxy/pkg/udp"
-	"github.com/andviro/grayproxy/pkg/ws"
-	"github.com/pkg/errors"
 )
 
 const (
@@ -22,7 +33,16 @@ const (
 	assembleTimeout     = 1000
 	stopTimeout         = 2000
 	decompressSizeLimit = 1048576
-	diskFileSize        = 104857600
+	defaultGroup        = "default"
+	defaultInput        = "udp://:12201"
+	minUDPChunkSize     = 12 // GELF chunk header
+	maxUDPChunkSize     = 65507
+	defaultBatchSize    = 1000
+	defaultBatchWait    = 1000
+	defaultKafkaPort    = "9092"
+	// spillDir is the subdirectory of dataDir holding messages spilled from
+	// the pipeline queue
+	spillDir = ".spill"
 )
 
 type urlList []string
@@ -36,91 +56,973 @@ func (ul *urlList) String() string {
 	return strings.Join(*ul, ",")
 }
 
-func (app *app) newListener(addr string) listener {
-	switch {
-	case strings.HasPrefix(addr, "udp://"):
-		return &udp.Listener{
-			Address:             strings.TrimPrefix(addr, "udp://"),
+// config describes the whole proxy setup. It is loaded from the file passed
+// with -config flag, while command-line flags override and extend it.
+type config struct {
+	DataDir     string `yaml:"dataDir"`
+	Metrics     string `yaml:"metrics"`
+	Admin       string `yaml:"admin"`
+	Verbose     bool   `yaml:"verbose"`
+	SendTimeout int    `yaml:"sendTimeout"`
+	// ShutdownTimeout limits the time spent delivering queued messages on
+	// exit
+	ShutdownTimeout int    `yaml:"shutdownTimeout"`
+	Limits          limits `yaml:"limits"`
+	// Queue bounds memory queues between inputs and outputs
+	Queue queueConfig `yaml:"queue"`
+	// DiskEncryption encrypts messages stored in disk queues
+	DiskEncryption diskEncryptionConfig `yaml:"diskEncryption"`
+
+	Inputs  []inputConfig  `yaml:"inputs"`
+	Outputs []outputConfig `yaml:"outputs"`
+	Routes  []routeConfig  `yaml:"routes"`
+
+	// diskKeys are loaded from DiskEncryption
+	diskKeys *disk.Keys
+}
+
+// limits hold defaults for the corresponding options of inputs. Zero value
+// of the option means the default, negative value disables the limit.
+type limits struct {
+	MaxChunkSize        int `yaml:"maxChunkSize"`
+	AssembleTimeout     int `yaml:"assembleTimeout"`
+	DecompressSizeLimit int `yaml:"decompressSizeLimit"`
+	// DiskMaxSize limits the total size of each disk queue, DiskSegmentSize
+	// is the size of its segment files and DiskMaxAge is the time, ms, after
+	// which undelivered messages are dropped. Zero DiskMaxAge keeps messages
+	// until they are delivered.
+	DiskMaxSize     int `yaml:"diskMaxSize"`
+	DiskSegmentSize int `yaml:"diskSegmentSize"`
+	DiskMaxAge      int `yaml:"diskMaxAge"`
+	// DiskFileSize is the deprecated name of DiskMaxSize
+	DiskFileSize      int `yaml:"diskFileSize"`
+	StopTimeout       int `yaml:"stopTimeout"`
+	TCPMaxConnections int `yaml:"tcpMaxConnections"`
+	TCPIdleTimeout    int `yaml:"tcpIdleTimeout"`
+}
+
+// queueConfig limits the pipeline queue and memory queues of outputs, zero
+// value of the limit means the default, negative value disables it
+type queueConfig struct {
+	MaxMessages int `yaml:"maxMessages"`
+	MaxBytes    int `yaml:"maxBytes"`
+	// Overflow is block (default), dropNewest, dropOldest or spill. Spill
+	// requires dataDir and applies to the pipeline queue, outputs buffer on
+	// disk anyway.
+	Overflow string `yaml:"overflow"`
+}
+
+// diskEncryptionConfig lists AES keys of disk queues. Keys are kept after
+// rotation until messages encrypted with them are delivered.
+type diskEncryptionConfig struct {
+	// Key is the id of the key encrypting new messages, empty value stores
+	// them in clear text
+	Key  string          `yaml:"key"`
+	Keys []diskKeyConfig `yaml:"keys"`
+}
+
+// diskKeyConfig reads base64-encoded 16, 24 or 32 byte key from File or
+// environment variable Env
+type diskKeyConfig struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+type inputConfig struct {
+	URL                 string `yaml:"url"`
+	MaxChunkSize        int    `yaml:"maxChunkSize"`
+	MaxMessageSize      int    `yaml:"maxMessageSize"`
+	AssembleTimeout     int    `yaml:"assembleTimeout"`
+	DecompressSizeLimit int    `yaml:"decompressSizeLimit"`
+	StopTimeout         int    `yaml:"stopTimeout"`
+	MaxConnections      int    `yaml:"maxConnections"`
+	IdleTimeout         int    `yaml:"idleTimeout"`
+	// EnqueueTimeout is the time HTTP inputs wait for the pipeline to
+	// accept messages before rejecting them, ms
+	EnqueueTimeout int `yaml:"enqueueTimeout"`
+	// TLS holds server certificate of TLS inputs
+	TLS tlsInputConfig `yaml:"tls"`
+	// Auth enables authentication of http, https, tcp and tls inputs
+	Auth authInputConfig `yaml:"auth"`
+	// Allow and Deny list client networks in CIDR notation or single
+	// addresses, Deny takes precedence
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// RateLimit limits message rate of each client address
+	RateLimit rateLimitConfig `yaml:"rateLimit"`
+}
+
+type rateLimitConfig struct {
+	// Rate is messages per second, zero disables the limit
+	Rate float64 `yaml:"rate"`
+	// Burst defaults to Rate
+	Burst int `yaml:"burst"`
+	// Action is drop (default), delay or tag
+	Action string `yaml:"action"`
+}
+
+type authInputConfig struct {
+	// Tokens map bearer tokens of HTTP requests and tokens sent first on
+	// TCP connections to client identities
+	Tokens map[string]string `yaml:"tokens"`
+	// Users map user names of HTTP basic authentication to passwords
+	Users map[string]string `yaml:"users"`
+	// HMACKeys map key ids of HTTP request signatures to secrets
+	HMACKeys map[string]string `yaml:"hmacKeys"`
+	// ClientCert identifies clients by verified TLS certificates
+	ClientCert bool `yaml:"clientCert"`
+}
+
+func (a authInputConfig) enabled() bool {
+	return len(a.Tokens) > 0 || len(a.Users) > 0 || len(a.HMACKeys) > 0 || a.ClientCert
+}
+
+type tlsInputConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA enables verification of client certificates
+	ClientCA   string `yaml:"clientCA"`
+	MinVersion string `yaml:"minVersion"`
+}
+
+type outputConfig struct {
+	ID          string          `yaml:"id"`
+	URL         string          `yaml:"url"`
+	Group       string          `yaml:"group"`
+	Weight      int             `yaml:"weight"`
+	SendTimeout int             `yaml:"sendTimeout"`
+	TLS         tlsOutputConfig `yaml:"tls"`
+	// ChunkSize is used by udp outputs, Compression by udp and kafka
+	// outputs
+	ChunkSize   int    `yaml:"chunkSize"`
+	Compression string `yaml:"compression"`
+	// BatchSize and BatchWait limit batches of outputs that send several
+	// messages at once
+	BatchSize     int                       `yaml:"batchSize"`
+	BatchWait     int                       `yaml:"batchWait"`
+	Loki          lokiOutputConfig          `yaml:"loki"`
+	Elasticsearch elasticsearchOutputConfig `yaml:"elasticsearch"`
+	Kafka         kafkaOutputConfig         `yaml:"kafka"`
+	File          fileOutputConfig          `yaml:"file"`
+	Console       consoleOutputConfig       `yaml:"console"`
+}
+
+type lokiOutputConfig struct {
+	TenantID    string `yaml:"tenantID"`
+	BearerToken string `yaml:"bearerToken"`
+	// Encoding is protobuf or json
+	Encoding string `yaml:"encoding"`
+	// Labels lists fields that become stream labels, all fields are used
+	// by default
+	Labels       []string          `yaml:"labels"`
+	DropLabels   []string          `yaml:"dropLabels"`
+	RenameLabels map[string]string `yaml:"renameLabels"`
+	StaticLabels map[string]string `yaml:"staticLabels"`
+	// LineFormat is json or logfmt to keep fields that are not labels in
+	// the log line
+	LineFormat string `yaml:"lineFormat"`
+}
+
+type elasticsearchOutputConfig struct {
+	// Index is the index name, parts in braces are Go time layouts, e.g.
+	// logs-{2006.01.02}
+	Index  string `yaml:"index"`
+	APIKey string `yaml:"apiKey"`
+}
+
+type kafkaOutputConfig struct {
+	// Key is the message field used as partition key
+	Key string `yaml:"key"`
+	// Acks is all, leader or none
+	Acks     string `yaml:"acks"`
+	ClientID string `yaml:"clientID"`
+}
+
+type fileOutputConfig struct {
+	// MaxSize in bytes and RotateInterval in ms trigger rotation
+	MaxSize        int64 `yaml:"maxSize"`
+	RotateInterval int   `yaml:"rotateInterval"`
+	Compress       bool  `yaml:"compress"`
+	// MaxFiles limits the number of rotated files kept
+	MaxFiles     int `yaml:"maxFiles"`
+	SyncInterval int `yaml:"syncInterval"`
+}
+
+type consoleOutputConfig struct {
+	// Format is raw, pretty, logfmt or human
+	Format string `yaml:"format"`
+	// Color is auto, always or never
+	Color string `yaml:"color"`
+}
+
+// tlsOutputConfig holds TLS settings of tls and https outputs
+type tlsOutputConfig struct {
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+type routeConfig struct {
+	Group    string `yaml:"group"`
+	Strategy string `yaml:"strategy"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		SendTimeout:     1000,
+		ShutdownTimeout: 10000,
+		Limits: limits{
 			MaxChunkSize:        maxChunkSize,
-			MaxMessageSize:      -1,
-			DecompressSizeLimit: decompressSizeLimit,
 			AssembleTimeout:     assembleTimeout,
+			DecompressSizeLimit: decompressSizeLimit,
+			StopTimeout:         stopTimeout,
+			TCPMaxConnections:   1024,
+			TCPIdleTimeout:      300000,
+		},
+	}
+}
+
+// configErrors collects all problems found in configuration
+type configErrors []string
+
+func (ce *configErrors) add(format string, args ...interface{}) {
+	*ce = append(*ce, fmt.Sprintf(format, args...))
+}
+
+func (ce configErrors) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(ce, "\n\t")
+}
+
+func (ce configErrors) err() error {
+	if len(ce) == 0 {
+		return nil
+	}
+	return ce
+}
+
+// splitScheme returns lowercase URL scheme and the rest of address
+func splitScheme(addr string) (scheme, rest string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return strings.ToLower(addr[:i]), addr[i+3:]
+	}
+	return "", addr
+}
+
+// parseOutput separates output address from routing parameters passed in the
+// URL fragment, e.g. http://graylog/gelf#id=graylog1&group=graylog&weight=2
+func parseOutput(val string) (res outputConfig, err error) {
+	res.URL = val
+	i := strings.IndexByte(val, '#')
+	if i < 0 {
+		return
+	}
+	res.URL = val[:i]
+	params, err := url.ParseQuery(val[i+1:])
+	if err != nil {
+		return res, errors.Wrapf(err, "parsing routing parameters of %q", res.URL)
+	}
+	res.ID, res.Group = params.Get("id"), params.Get("group")
+	if w := params.Get("weight"); w != "" {
+		if res.Weight, err = strconv.Atoi(w); err != nil {
+			return res, errors.Errorf("invalid weight %q of %q", w, res.URL)
 		}
-	case strings.HasPrefix(addr, "http://"):
-		l := new(http.Listener)
-		l.Address = strings.TrimPrefix(addr, "http://")
-		l.StopTimeout = stopTimeout
-		return l
 	}
-	return &tcp.Listener{Address: strings.TrimPrefix(addr, "tcp://")}
+	return res, nil
+}
+
+// parseInput separates input address from TLS and authentication parameters
+// passed in the URL query, e.g.
+// tls://:12201?tlsCert=server.crt&tlsKey=server.key&tlsClientCA=ca.crt or
+// http://:8080?authTokens=s3cr3t:app1,t0ken:app2&deny=10.0.0.0/8&rateLimit=100
+func parseInput(val string) (res inputConfig, err error) {
+	res.URL = val
+	i := strings.IndexByte(val, '?')
+	if i < 0 {
+		return
+	}
+	res.URL = val[:i]
+	params, err := url.ParseQuery(val[i+1:])
+	if err != nil {
+		return res, errors.Wrapf(err, "parsing parameters of %q", res.URL)
+	}
+	for k := range params {
+		switch k {
+		case "tlsCert":
+			res.TLS.Cert = params.Get(k)
+		case "tlsKey":
+			res.TLS.Key = params.Get(k)
+		case "tlsClientCA":
+			res.TLS.ClientCA = params.Get(k)
+		case "tlsMinVersion":
+			res.TLS.MinVersion = params.Get(k)
+		case "authTokens":
+			res.Auth.Tokens, err = parsePairs(params.Get(k))
+		case "authUsers":
+			res.Auth.Users, err = parsePairs(params.Get(k))
+		case "authHMACKeys":
+			res.Auth.HMACKeys, err = parsePairs(params.Get(k))
+		case "authClientCert":
+			res.Auth.ClientCert, err = strconv.ParseBool(params.Get(k))
+		case "allow":
+			res.Allow = strings.Split(params.Get(k), ",")
+		case "deny":
+			res.Deny = strings.Split(params.Get(k), ",")
+		case "rateLimit":
+			res.RateLimit.Rate, err = strconv.ParseFloat(params.Get(k), 64)
+		case "rateBurst":
+			res.RateLimit.Burst, err = strconv.Atoi(params.Get(k))
+		case "rateAction":
+			res.RateLimit.Action = params.Get(k)
+		default:
+			return res, errors.Errorf("unknown parameter %q of %q", k, res.URL)
+		}
+		if err != nil {
+			return res, errors.Wrapf(err, "parameter %q of %q", k, res.URL)
+		}
+	}
+	return res, nil
+}
+
+// outputParams are the output URL query parameters that set output options,
+// e.g. https://graylog/gelf?tlsCA=ca.crt&tlsServerName=graylog.internal
+var outputParams = map[string]func(*outputConfig, string) error{
+	"tlsCA":         func(c *outputConfig, v string) error { c.TLS.CA = v; return nil },
+	"tlsCert":       func(c *outputConfig, v string) error { c.TLS.Cert = v; return nil },
+	"tlsKey":        func(c *outputConfig, v string) error { c.TLS.Key = v; return nil },
+	"tlsServerName": func(c *outputConfig, v string) error { c.TLS.ServerName = v; return nil },
+	"tlsInsecureSkipVerify": func(c *outputConfig, v string) (err error) {
+		c.TLS.InsecureSkipVerify, err = strconv.ParseBool(v)
+		return
+	},
+}
+
+// udpOutputParams are additional parameters of udp outputs, e.g.
+// udp://graylog:12201?compression=gzip&chunkSize=8154
+var udpOutputParams = map[string]func(*outputConfig, string) error{
+	"compression": func(c *outputConfig, v string) error { c.Compression = v; return nil },
+	"chunkSize": func(c *outputConfig, v string) (err error) {
+		c.ChunkSize, err = strconv.Atoi(v)
+		return
+	},
 }
 
-func (app *app) configure() error {
+// lokiOutputParams are additional parameters of loki outputs, e.g.
+// http://loki:3100/loki/api/v1/push?tenantID=team1&batchSize=500
+var lokiOutputParams = map[string]func(*outputConfig, string) error{
+	"tenantID":    func(c *outputConfig, v string) error { c.Loki.TenantID = v; return nil },
+	"bearerToken": func(c *outputConfig, v string) error { c.Loki.BearerToken = v; return nil },
+	"encoding":    func(c *outputConfig, v string) error { c.Loki.Encoding = v; return nil },
+	"labels":      func(c *outputConfig, v string) error { c.Loki.Labels = strings.Split(v, ","); return nil },
+	"dropLabels":  func(c *outputConfig, v string) error { c.Loki.DropLabels = strings.Split(v, ","); return nil },
+	"lineFormat":  func(c *outputConfig, v string) error { c.Loki.LineFormat = v; return nil },
+	"renameLabels": func(c *outputConfig, v string) (err error) {
+		c.Loki.RenameLabels, err = parsePairs(v)
+		return
+	},
+	"staticLabels": func(c *outputConfig, v string) (err error) {
+		c.Loki.StaticLabels, err = parsePairs(v)
+		return
+	},
+}
+
+// elasticsearchOutputParams are additional parameters of elasticsearch
+// outputs, e.g. elasticsearch://es:9200?index=logs-{2006.01.02}&apiKey=secret
+var elasticsearchOutputParams = map[string]func(*outputConfig, string) error{
+	"index":  func(c *outputConfig, v string) error { c.Elasticsearch.Index = v; return nil },
+	"apiKey": func(c *outputConfig, v string) error { c.Elasticsearch.APIKey = v; return nil },
+}
+
+// kafkaOutputParams are additional parameters of kafka outputs, e.g.
+// kafka://broker1:9092,broker2:9092/logs?key=host&acks=leader
+var kafkaOutputParams = map[string]func(*outputConfig, string) error{
+	"key":         func(c *outputConfig, v string) error { c.Kafka.Key = v; return nil },
+	"acks":        func(c *outputConfig, v string) error { c.Kafka.Acks = v; return nil },
+	"clientID":    func(c *outputConfig, v string) error { c.Kafka.ClientID = v; return nil },
+	"compression": udpOutputParams["compression"],
+}
+
+// fileOutputParams are additional parameters of file outputs, e.g.
+// file:///var/log/gelf/app-%Y%m%d.ndjson?maxSize=1000000&compress=true
+var fileOutputParams = map[string]func(*outputConfig, string) error{
+	"maxSize": func(c *outputConfig, v string) (err error) {
+		c.File.MaxSize, err = strconv.ParseInt(v, 10, 64)
+		return
+	},
+	"rotateInterval": func(c *outputConfig, v string) (err error) {
+		c.File.RotateInterval, err = strconv.Atoi(v)
+		return
+	},
+	"compress": func(c *outputConfig, v string) (err error) {
+		c.File.Compress, err = strconv.ParseBool(v)
+		return
+	},
+	"maxFiles": func(c *outputConfig, v string) (err error) {
+		c.File.MaxFiles, err = strconv.Atoi(v)
+		return
+	},
+	"syncInterval": func(c *outputConfig, v string) (err error) {
+		c.File.SyncInterval, err = strconv.Atoi(v)
+		return
+	},
+}
+
+// consoleOutputParams are additional parameters of stdout and stderr
+// outputs, e.g. stdout://?format=human&color=always
+var consoleOutputParams = map[string]func(*outputConfig, string) error{
+	"format": func(c *outputConfig, v string) error { c.Console.Format = v; return nil },
+	"color":  func(c *outputConfig, v string) error { c.Console.Color = v; return nil },
+}
+
+// batchOutputParams are parameters of outputs that send messages in batches
+var batchOutputParams = map[string]func(*outputConfig, string) error{
+	"batchSize": func(c *outputConfig, v string) (err error) {
+		c.BatchSize, err = strconv.Atoi(v)
+		return
+	},
+	"batchWait": func(c *outputConfig, v string) (err error) {
+		c.BatchWait, err = strconv.Atoi(v)
+		return
+	},
+}
+
+// parsePairs parses comma-separated list of pairs in form key:value
+func parsePairs(v string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		i := strings.IndexByte(pair, ':')
+		if i <= 0 {
+			return nil, errors.Errorf("invalid pair %q", pair)
+		}
+		res[pair[:i]] = pair[i+1:]
+	}
+	return res, nil
+}
+
+// outputID derives id of output from its URL, so that it does not depend
+// on the position of the output
+func outputID(u string) string {
+	sum := sha1.Sum([]byte(u))
+	return hex.EncodeToString(sum[:4])
+}
+
+// isLoki returns true for URLs of Loki push API
+func isLoki(u string) bool {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	return strings.HasSuffix(u, "/loki/api/v1/push") || isLegacyLoki(u)
+}
+
+// isLegacyLoki returns true for URLs of legacy Loki push API
+func isLegacyLoki(u string) bool {
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+	return strings.HasSuffix(u, "/api/prom/push")
+}
+
+// isKafka returns true for URLs of kafka outputs
+func isKafka(u string) bool {
+	scheme, _ := splitScheme(u)
+	return scheme == "kafka" || scheme == "kafka+tls"
+}
+
+// isBatchOutput returns true for outputs sending messages in batches
+func isBatchOutput(u string) bool {
+	return isLoki(u) || isElasticsearch(u) || isKafka(u)
+}
+
+// isElasticsearch returns true for URLs of elasticsearch outputs
+func isElasticsearch(u string) bool {
+	scheme, _ := splitScheme(u)
+	return scheme == "elasticsearch" || scheme == "elasticsearch+https"
+}
+
+// extractParams moves known options from output URL query to the output
+// settings, the rest of the query is kept in URL
+func (out *outputConfig) extractParams() error {
+	i := strings.IndexByte(out.URL, '?')
+	if i < 0 {
+		return nil
+	}
+	params, err := url.ParseQuery(out.URL[i+1:])
+	if err != nil {
+		return errors.Wrapf(err, "parsing query of %q", out.URL)
+	}
+	scheme, _ := splitScheme(out.URL)
+	found := false
+	for k := range params {
+		set, ok := outputParams[k]
+		if !ok && scheme == "udp" {
+			set, ok = udpOutputParams[k]
+		}
+		if !ok && isLoki(out.URL) {
+			set, ok = lokiOutputParams[k]
+		}
+		if !ok && isElasticsearch(out.URL) {
+			set, ok = elasticsearchOutputParams[k]
+		}
+		if !ok && isKafka(out.URL) {
+			set, ok = kafkaOutputParams[k]
+		}
+		if !ok && (scheme == "stdout" || scheme == "stderr") {
+			set, ok = consoleOutputParams[k]
+		}
+		if !ok && scheme == "file" {
+			set, ok = fileOutputParams[k]
+		}
+		if !ok && isBatchOutput(out.URL) {
+			set, ok = batchOutputParams[k]
+		}
+		if !ok {
+			continue
+		}
+		if err := set(out, params.Get(k)); err != nil {
+			return errors.Errorf("invalid %s of %q", k, out.URL)
+		}
+		params.Del(k)
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	out.URL = out.URL[:i]
+	if len(params) > 0 {
+		out.URL += "?" + params.Encode()
+	}
+	return nil
+}
+
+// parseRoute parses route in form [group=]strategy
+func parseRoute(val string) routeConfig {
+	if i := strings.IndexByte(val, '='); i >= 0 {
+		return routeConfig{Group: val[:i], Strategy: val[i+1:]}
+	}
+	return routeConfig{Strategy: val}
+}
+
+func (app *app) parseFlags(args []string) error {
 	fs := flag.NewFlagSet("grayproxy", flag.ExitOnError)
+	fs.StringVar(&app.configFile, "config", "", "YAML or JSON configuration file, command-line flags override and extend its settings")
 	fs.Var(&app.inputURLs, "in", "input address in form schema://address:port (may be specified multiple times). Default: udp://:12201")
 	fs.Var(&app.outputURLs, "out", "output address in form schema://address:port (may be specified multiple times)")
+	fs.Var(&app.routes, "route", "distribution strategy for output group in form [group=]strategy, where strategy is one of failover, broadcast, roundrobin or weighted (may be specified multiple times). Default: failover")
 	fs.BoolVar(&app.verbose, "v", false, "echo received logs on console")
 	fs.IntVar(&app.sendTimeout, "sendTimeout", 1000, "maximum TCP or HTTP output timeout (ms)")
+	fs.IntVar(&app.shutdownTimeout, "shutdownTimeout", 10000, "time to deliver queued messages on SIGTERM or SIGINT (ms)")
+	fs.IntVar(&app.tcpMaxConnections, "tcpMaxConnections", 1024, "maximum number of simultaneous connections per TCP input (0 means unlimited)")
+	fs.IntVar(&app.tcpIdleTimeout, "tcpIdleTimeout", 300000, "close TCP input connections idle for this long (ms, 0 disables)")
 	fs.StringVar(&app.dataDir, "dataDir", "", "buffer directory (defaults to no buffering)")
-	if err := fs.Parse(os.Args[1:]); err != nil {
+	fs.StringVar(&app.metricsAddr, "metrics", "", "address to expose Prometheus metrics on (defaults to no metrics)")
+	fs.StringVar(&app.adminAddr, "admin", "", "address to serve admin API on (defaults to no admin API)")
+	if err := fs.Parse(args); err != nil {
 		return errors.Wrap(err, "parsing command-line")
 	}
-	if len(app.inputURLs) == 0 {
-		app.inputURLs = urlList{"udp://:12201"}
+	app.setFlags = make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		app.setFlags[f.Name] = true
+	})
+	return nil
+}
+
+// loadConfig reads configuration file, applies command-line flags and
+// defaults, and validates the result
+func (app *app) loadConfig() (*config, error) {
+	cfg := defaultConfig()
+	if app.configFile != "" {
+		data, err := ioutil.ReadFile(app.configFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading configuration file")
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", app.configFile)
+		}
+	}
+	var errs configErrors
+	for name := range app.setFlags {
+		switch name {
+		case "v":
+			cfg.Verbose = app.verbose
+		case "sendTimeout":
+			cfg.SendTimeout = app.sendTimeout
+		case "shutdownTimeout":
+			cfg.ShutdownTimeout = app.shutdownTimeout
+		case "tcpMaxConnections":
+			cfg.Limits.TCPMaxConnections = app.tcpMaxConnections
+			if cfg.Limits.TCPMaxConnections == 0 {
+				cfg.Limits.TCPMaxConnections = -1
+			}
+		case "tcpIdleTimeout":
+			cfg.Limits.TCPIdleTimeout = app.tcpIdleTimeout
+			if cfg.Limits.TCPIdleTimeout == 0 {
+				cfg.Limits.TCPIdleTimeout = -1
+			}
+		case "dataDir":
+			cfg.DataDir = app.dataDir
+		case "metrics":
+			cfg.Metrics = app.metricsAddr
+		case "admin":
+			cfg.Admin = app.adminAddr
+		}
+	}
+	for _, v := range app.inputURLs {
+		in, err := parseInput(v)
+		if err != nil {
+			errs.add("%v", err)
+			continue
+		}
+		cfg.Inputs = append(cfg.Inputs, in)
 	}
-	app.ins = make([]listener, len(app.inputURLs))
-	for i, v := range app.inputURLs {
-		app.ins[i] = app.newListener(v)
-		log.Printf("Added input %d at %s", i, v)
+	for _, v := range app.outputURLs {
+		out, err := parseOutput(v)
+		if err != nil {
+			errs.add("%v", err)
+			continue
+		}
+		cfg.Outputs = append(cfg.Outputs, out)
 	}
-	if len(app.outputURLs) == 0 {
-		log.Print("WARNING: no outputs configured")
+	for i := range cfg.Outputs {
+		if err := cfg.Outputs[i].extractParams(); err != nil {
+			errs.add("outputs[%d]: %v", i, err)
+		}
 	}
-	app.outs = make([]sender, 0, len(app.outputURLs))
-	app.sendErrors = make([]error, len(app.outputURLs))
-	for i, v := range app.outputURLs {
-		log.Printf("adding output %d: %s", i, v)
-		switch {
-		case strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://"):
-			if strings.HasSuffix(v, "/api/prom/push") {
-				ls, err := loki.New(v)
-				if err != nil {
-					log.Println("could not create loki output: ", err.Error())
-					continue
-				}
-				app.outs = append(app.outs, ls)
-				break
+	for _, v := range app.routes {
+		cfg.Routes = append(cfg.Routes, parseRoute(v))
+	}
+	cfg.setDefaults()
+	if errs = append(errs, cfg.validate()...); len(errs) == 0 {
+		errs = cfg.loadKeys()
+	}
+	return cfg, errs.err()
+}
+
+// loadKeys reads keys of disk queues from files and environment
+func (cfg *config) loadKeys() (errs configErrors) {
+	if len(cfg.DiskEncryption.Keys) == 0 {
+		return nil
+	}
+	keys := make(map[string][]byte)
+	for i, k := range cfg.DiskEncryption.Keys {
+		var value string
+		if k.File != "" {
+			data, err := ioutil.ReadFile(k.File)
+			if err != nil {
+				errs.add("diskEncryption.keys[%d]: %v", i, err)
+				continue
 			}
-			app.outs = append(app.outs, &http.Sender{Address: v, SendTimeout: app.sendTimeout})
-		case strings.HasPrefix(v, "ws://"):
-			wss := &ws.Sender{Address: v}
-			if err := wss.Start(); err != nil {
-				log.Println("Invalid websocket URL: ", err.Error())
-				break
+			value = string(data)
+		} else if value = os.Getenv(k.Env); value == "" {
+			errs.add("diskEncryption.keys[%d]: environment variable %s is not set", i, k.Env)
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			errs.add("diskEncryption.keys[%d]: key must be base64-encoded: %v", i, err)
+			continue
+		}
+		keys[k.ID] = key
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	var err error
+	if cfg.diskKeys, err = disk.NewKeys(cfg.DiskEncryption.Key, keys); err != nil {
+		errs.add("diskEncryption: %v", err)
+	}
+	return errs
+}
+
+// pick returns value if it is set, def otherwise
+func pick(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+func (cfg *config) setDefaults() {
+	cfg.Limits.DiskMaxSize = pick(cfg.Limits.DiskMaxSize, cfg.Limits.DiskFileSize)
+	if len(cfg.Inputs) == 0 {
+		cfg.Inputs = []inputConfig{{URL: defaultInput}}
+	}
+	for i := range cfg.Inputs {
+		in := &cfg.Inputs[i]
+		in.MaxChunkSize = pick(in.MaxChunkSize, cfg.Limits.MaxChunkSize)
+		in.AssembleTimeout = pick(in.AssembleTimeout, cfg.Limits.AssembleTimeout)
+		in.DecompressSizeLimit = pick(in.DecompressSizeLimit, cfg.Limits.DecompressSizeLimit)
+		in.StopTimeout = pick(in.StopTimeout, cfg.Limits.StopTimeout)
+		in.MaxConnections = pick(in.MaxConnections, cfg.Limits.TCPMaxConnections)
+		in.IdleTimeout = pick(in.IdleTimeout, cfg.Limits.TCPIdleTimeout)
+	}
+	ids := make(map[string]bool)
+	for _, out := range cfg.Outputs {
+		ids[out.ID] = true
+	}
+	for i := range cfg.Outputs {
+		out := &cfg.Outputs[i]
+		// ids of outputs with disk queues name their directories, so they
+		// must not change when outputs are reordered
+		if out.ID == "" && cfg.DataDir == "" {
+			out.ID = strconv.Itoa(i)
+		} else if out.ID == "" {
+			out.ID = outputID(out.URL)
+			for n := 1; ids[out.ID]; n++ {
+				out.ID = fmt.Sprintf("%s-%d", outputID(out.URL), n)
 			}
-			app.outs = append(app.outs, wss)
-		case strings.HasPrefix(v, "udp://"):
-			app.outs = append(app.outs, &udp.Sender{Address: strings.TrimPrefix(v, "udp://"), SendTimeout: app.sendTimeout})
-		case strings.HasPrefix(v, "tls://"):
-			app.outs = append(app.outs, &tls.Sender{Address: strings.TrimPrefix(v, "tls://"), SendTimeout: app.sendTimeout})
-		default:
-			app.outs = append(app.outs, &tcp.Sender{Address: strings.TrimPrefix(v, "tcp://"), SendTimeout: app.sendTimeout})
+			ids[out.ID] = true
+		}
+		if out.Group == "" {
+			out.Group = defaultGroup
 		}
+		out.Weight = pick(out.Weight, 1)
+		out.SendTimeout = pick(out.SendTimeout, cfg.SendTimeout)
 	}
-	if app.dataDir == "" {
-		app.q = dummy.New()
-		log.Println("Buffering is not configured, unsent messages will be lost")
-		return nil
+	for i := range cfg.Routes {
+		if cfg.Routes[i].Group == "" {
+			cfg.Routes[i].Group = defaultGroup
+		}
 	}
+}
 
-	stat, err := os.Stat(app.dataDir)
-	if err != nil {
-		return errors.Wrap(err, "checking buffer directory")
+var (
+	inputSchemes = map[string]bool{
+		"": true, "udp": true, "tcp": true, "tls": true, "http": true, "https": true,
+		"syslog+udp": true, "syslog+tcp": true, "syslog+tls": true,
+	}
+	tlsInputSchemes  = map[string]bool{"tls": true, "https": true, "syslog+tls": true}
+	authInputSchemes = map[string]bool{"": true, "tcp": true, "tls": true, "http": true, "https": true}
+	tlsOutputSchemes = map[string]bool{"tls": true, "https": true, "elasticsearch+https": true, "kafka+tls": true}
+	outputSchemes    = map[string]bool{
+		"": true, "udp": true, "tcp": true, "tls": true, "http": true, "https": true, "ws": true,
+		"elasticsearch": true, "elasticsearch+https": true, "kafka": true, "kafka+tls": true, "file": true,
+		"stdout": true, "stderr": true,
+	}
+)
+
+// validate returns all problems found in configuration
+func (cfg *config) validate() (errs configErrors) {
+	if cfg.DataDir != "" {
+		if stat, err := os.Stat(cfg.DataDir); err != nil {
+			errs.add("dataDir: %v", err)
+		} else if !stat.IsDir() {
+			errs.add("dataDir: %q is not a directory", cfg.DataDir)
+		}
+	}
+	if cfg.SendTimeout <= 0 {
+		errs.add("sendTimeout: must be positive")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs.add("shutdownTimeout: must not be negative")
+	}
+	if cfg.Limits.DiskSegmentSize < 0 {
+		errs.add("limits.diskSegmentSize: must not be negative")
+	}
+	keyIDs := make(map[string]bool)
+	for i, k := range cfg.DiskEncryption.Keys {
+		if k.ID == "" || len(k.ID) > 255 {
+			errs.add("diskEncryption.keys[%d]: id must be 1 to 255 characters long", i)
+		} else if keyIDs[k.ID] {
+			errs.add("diskEncryption.keys[%d]: duplicate id %q", i, k.ID)
+		}
+		keyIDs[k.ID] = true
+		if (k.File == "") == (k.Env == "") {
+			errs.add("diskEncryption.keys[%d]: either file or env is required", i)
+		}
 	}
-	if !stat.IsDir() {
-		return errors.Errorf("%q is not a directory", app.dataDir)
+	if key := cfg.DiskEncryption.Key; key != "" && !keyIDs[key] {
+		errs.add("diskEncryption.key: %q is not listed in keys", key)
+	}
+	switch cfg.Queue.Overflow {
+	case "", memory.OverflowBlock, memory.OverflowDropNewest, memory.OverflowDropOldest:
+	case memory.OverflowSpill:
+		if cfg.DataDir == "" {
+			errs.add("queue.overflow: %q requires dataDir", cfg.Queue.Overflow)
+		}
+	default:
+		errs.add("queue.overflow: unknown policy %q", cfg.Queue.Overflow)
+	}
+	inputs := make(map[string]bool)
+	for i, in := range cfg.Inputs {
+		if inputs[in.URL] {
+			errs.add("inputs[%d]: duplicate input %q", i, in.URL)
+		}
+		inputs[in.URL] = true
+		scheme, addr := splitScheme(in.URL)
+		if !inputSchemes[scheme] {
+			errs.add("inputs[%d]: unsupported scheme %q", i, scheme)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			errs.add("inputs[%d]: invalid address %q: %v", i, addr, err)
+		}
+		if in.MaxChunkSize <= 0 {
+			errs.add("inputs[%d]: maxChunkSize must be positive", i)
+		}
+		if tlsInputSchemes[scheme] && (in.TLS.Cert == "" || in.TLS.Key == "") {
+			errs.add("inputs[%d]: tls.cert and tls.key are required", i)
+		}
+		if _, err := tls.ParseVersion(in.TLS.MinVersion); err != nil {
+			errs.add("inputs[%d]: tls.minVersion: %v", i, err)
+		}
+		if in.Auth.enabled() && !authInputSchemes[scheme] {
+			errs.add("inputs[%d]: authentication is not supported by %q scheme", i, scheme)
+		}
+		if (len(in.Auth.Users) > 0 || len(in.Auth.HMACKeys) > 0) && !strings.HasPrefix(scheme, "http") {
+			errs.add("inputs[%d]: auth.users and auth.hmacKeys are supported only by http inputs", i)
+		}
+		if in.Auth.ClientCert && in.TLS.ClientCA == "" {
+			errs.add("inputs[%d]: auth.clientCert requires tls.clientCA", i)
+		}
+		if _, err := limit.ParseNetworks(in.Allow); err != nil {
+			errs.add("inputs[%d]: allow: %v", i, err)
+		}
+		if _, err := limit.ParseNetworks(in.Deny); err != nil {
+			errs.add("inputs[%d]: deny: %v", i, err)
+		}
+		if in.RateLimit.Rate < 0 || in.RateLimit.Burst < 0 {
+			errs.add("inputs[%d]: rateLimit.rate and rateLimit.burst must not be negative", i)
+		}
+		switch in.RateLimit.Action {
+		case "", limit.ActionDrop, limit.ActionTag:
+		case limit.ActionDelay:
+			// delaying a datagram would stall the whole input
+			if scheme == "udp" || scheme == "syslog+udp" {
+				errs.add("inputs[%d]: rateLimit.action %q is not supported by %q scheme", i, in.RateLimit.Action, scheme)
+			}
+		default:
+			errs.add("inputs[%d]: unknown rateLimit.action %q", i, in.RateLimit.Action)
+		}
+	}
+	ids := make(map[string]bool)
+	groups := make(map[string]bool)
+	for i, out := range cfg.Outputs {
+		scheme, _ := splitScheme(out.URL)
+		if out.URL == "" {
+			errs.add("outputs[%d]: url is required", i)
+		} else if !outputSchemes[scheme] {
+			errs.add("outputs[%d]: unsupported scheme %q", i, scheme)
+		} else if scheme == "file" {
+			// path may contain strftime conversions that are not valid
+			// URL escapes
+			if _, path := splitScheme(out.URL); path == "" {
+				errs.add("outputs[%d]: file path is required", i)
+			}
+		} else if _, err := url.Parse(out.URL); err != nil {
+			errs.add("outputs[%d]: %v", i, err)
+		}
+		if out.TLS != (tlsOutputConfig{}) && !tlsOutputSchemes[scheme] {
+			errs.add("outputs[%d]: TLS options are not supported by %q scheme", i, scheme)
+		}
+		if out.ChunkSize != 0 && scheme != "udp" {
+			errs.add("outputs[%d]: chunkSize is supported only by udp outputs", i)
+		}
+		switch {
+		case out.Compression == "":
+		case scheme == "udp":
+			switch out.Compression {
+			case gelf.CompressNone, gelf.CompressGzip, gelf.CompressZlib:
+			default:
+				errs.add("outputs[%d]: unknown compression %q", i, out.Compression)
+			}
+		case isKafka(out.URL):
+			switch out.Compression {
+			case kafka.CompressNone, kafka.CompressGzip:
+			default:
+				errs.add("outputs[%d]: unknown compression %q", i, out.Compression)
+			}
+		default:
+			errs.add("outputs[%d]: compression is supported only by udp and kafka outputs", i)
+		}
+		if out.ChunkSize < 0 || out.ChunkSize > maxUDPChunkSize || (out.ChunkSize > 0 && out.ChunkSize <= minUDPChunkSize) {
+			errs.add("outputs[%d]: chunkSize must be between %d and %d", i, minUDPChunkSize+1, maxUDPChunkSize)
+		}
+		if !isLoki(out.URL) && !reflect.DeepEqual(out.Loki, lokiOutputConfig{}) {
+			errs.add("outputs[%d]: loki options are supported only by loki outputs", i)
+		}
+		if !isElasticsearch(out.URL) && out.Elasticsearch != (elasticsearchOutputConfig{}) {
+			errs.add("outputs[%d]: elasticsearch options are supported only by elasticsearch outputs", i)
+		}
+		if !isKafka(out.URL) && out.Kafka != (kafkaOutputConfig{}) {
+			errs.add("outputs[%d]: kafka options are supported only by kafka outputs", i)
+		}
+		switch out.Kafka.Acks {
+		case "", kafka.AcksAll, kafka.AcksLeader, kafka.AcksNone:
+		default:
+			errs.add("outputs[%d]: unknown kafka acks %q", i, out.Kafka.Acks)
+		}
+		if u, err := url.Parse(out.URL); err == nil && isKafka(out.URL) && strings.Trim(u.Path, "/") == "" {
+			errs.add("outputs[%d]: kafka topic is required", i)
+		}
+		if scheme != "file" && out.File != (fileOutputConfig{}) {
+			errs.add("outputs[%d]: file options are supported only by file outputs", i)
+		}
+		if scheme != "stdout" && scheme != "stderr" && out.Console != (consoleOutputConfig{}) {
+			errs.add("outputs[%d]: console options are supported only by stdout and stderr outputs", i)
+		}
+		switch out.Console.Format {
+		case "", console.FormatRaw, console.FormatPretty, console.FormatLogfmt, console.FormatHuman:
+		default:
+			errs.add("outputs[%d]: unknown console format %q", i, out.Console.Format)
+		}
+		switch out.Console.Color {
+		case "", console.ColorAuto, console.ColorAlways, console.ColorNever:
+		default:
+			errs.add("outputs[%d]: unknown console color mode %q", i, out.Console.Color)
+		}
+		if out.File.MaxFiles < 0 {
+			errs.add("outputs[%d]: file.maxFiles must not be negative", i)
+		}
+		if !isBatchOutput(out.URL) && (out.BatchSize != 0 || out.BatchWait != 0) {
+			errs.add("outputs[%d]: batch options are supported only by loki, elasticsearch and kafka outputs", i)
+		}
+		switch out.Loki.Encoding {
+		case "", loki.EncodingProtobuf, loki.EncodingJSON:
+		default:
+			errs.add("outputs[%d]: unknown loki encoding %q", i, out.Loki.Encoding)
+		}
+		if out.Loki.Encoding == loki.EncodingJSON && isLegacyLoki(out.URL) {
+			errs.add("outputs[%d]: json encoding is not supported by legacy loki push API", i)
+		}
+		switch out.Loki.LineFormat {
+		case "", loki.LineFormatJSON, loki.LineFormatLogfmt:
+		default:
+			errs.add("outputs[%d]: unknown loki line format %q", i, out.Loki.LineFormat)
+		}
+		if out.BatchSize < 0 || out.BatchWait < 0 {
+			errs.add("outputs[%d]: batchSize and batchWait must not be negative", i)
+		}
+		if (out.TLS.Cert == "") != (out.TLS.Key == "") {
+			errs.add("outputs[%d]: both tls.cert and tls.key are required", i)
+		}
+		if strings.ContainsAny(out.ID, `/\`) || out.ID == "." || out.ID == ".." || out.ID == spillDir {
+			errs.add("outputs[%d]: invalid id %q", i, out.ID)
+		}
+		if ids[out.ID] {
+			errs.add("outputs[%d]: duplicate id %q", i, out.ID)
+		}
+		ids[out.ID] = true
+		if out.Weight < 0 {
+			errs.add("outputs[%d]: weight must be positive", i)
+		}
+		if out.SendTimeout < 0 {
+			errs.add("outputs[%d]: sendTimeout must be positive", i)
+		}
+		groups[out.Group] = true
+	}
+	routes := make(map[string]bool)
+	for i, r := range cfg.Routes {
+		if _, err := route.ParseStrategy(r.Strategy); err != nil {
+			errs.add("routes[%d]: %v", i, err)
+		}
+		if routes[r.Group] {
+			errs.add("routes[%d]: duplicate route for group %q", i, r.Group)
+		}
+		routes[r.Group] = true
+		if !groups[r.Group] {
+			errs.add("routes[%d]: group %q has no outputs", i, r.Group)
+		}
 	}
-	q, err := disk.New(app.dataDir, diskFileSize)
-	app.q = q
-	return err
+	return
 }
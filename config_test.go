@@ -0,0 +1,256 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	dir, err := ioutil.TempDir("", "grayproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	fn := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// loadTestConfig loads configuration file data, if it is not empty, with
+// command line args
+func loadTestConfig(t *testing.T, data string, args ...string) (*config, error) {
+	if data != "" {
+		args = append([]string{"-config", writeConfig(t, data)}, args...)
+	}
+	app := new(app)
+	if err := app.parseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return app.loadConfig()
+}
+
+func TestLoadConfig(t *testing.T) {
+	cfg, err := loadTestConfig(t, `
+sendTimeout: 500
+limits:
+  tcpMaxConnections: 10
+  diskFileSize: 1000000
+inputs:
+  - url: tcp://:12201
+    idleTimeout: 1000
+outputs:
+  - url: http://graylog/gelf
+    group: graylog
+routes:
+  - group: graylog
+    strategy: roundrobin
+`, "-sendTimeout", "700", "-out", "udp://loki:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Limits.DiskMaxSize != 1000000 {
+		t.Errorf("diskFileSize should set diskMaxSize: %+v", cfg.Limits)
+	}
+	if in := cfg.Inputs[0]; in.MaxConnections != 10 || in.IdleTimeout != 1000 || in.MaxChunkSize != maxChunkSize {
+		t.Errorf("unexpected input %+v", in)
+	}
+	// flags override file settings and add outputs after configured ones
+	if len(cfg.Outputs) != 2 || cfg.Outputs[0].URL != "http://graylog/gelf" || cfg.Outputs[1].URL != "udp://loki:1234" {
+		t.Fatalf("unexpected outputs %+v", cfg.Outputs)
+	}
+	for _, out := range cfg.Outputs {
+		if out.SendTimeout != 700 {
+			t.Errorf("unexpected output %+v", out)
+		}
+	}
+	if cfg.Outputs[0].ID != "0" || cfg.Outputs[1].ID != "1" {
+		t.Errorf("outputs without dataDir should be numbered: %+v", cfg.Outputs)
+	}
+	if out := cfg.Outputs[0]; out.Group != "graylog" || out.Weight != 1 {
+		t.Errorf("unexpected output %+v", out)
+	}
+	if out := cfg.Outputs[1]; out.Group != defaultGroup || out.Weight != 1 {
+		t.Errorf("unexpected output %+v", out)
+	}
+	if !reflect.DeepEqual(cfg.Routes, []routeConfig{{Group: "graylog", Strategy: "roundrobin"}}) {
+		t.Errorf("unexpected routes %+v", cfg.Routes)
+	}
+}
+
+func TestLoadConfig_Inputs(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected inputConfig
+	}{
+		{"syslog+tls://:6514?tlsCert=a.crt&tlsKey=a.key", inputConfig{URL: "syslog+tls://:6514",
+			TLS: tlsInputConfig{Cert: "a.crt", Key: "a.key"}}},
+		{"http://:8080?authTokens=s3cr3t:app1,t0ken:app2&authUsers=alice:pass", inputConfig{URL: "http://:8080",
+			Auth: authInputConfig{
+				Tokens: map[string]string{"s3cr3t": "app1", "t0ken": "app2"},
+				Users:  map[string]string{"alice": "pass"},
+			}}},
+		{"http://:8080?deny=10.0.0.0/8,10.1.1.1", inputConfig{URL: "http://:8080",
+			Deny: []string{"10.0.0.0/8", "10.1.1.1"}}},
+		{"http://:8080?rateLimit=2.5&rateAction=tag", inputConfig{URL: "http://:8080",
+			RateLimit: rateLimitConfig{Rate: 2.5, Action: "tag"}}},
+	} {
+		in, err := parseInput(tc.url)
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		if !reflect.DeepEqual(in, tc.expected) {
+			t.Errorf("%s: unexpected input %+v", tc.url, in)
+		}
+	}
+}
+
+func TestLoadConfig_Outputs(t *testing.T) {
+	for _, tc := range []struct {
+		url      string
+		expected outputConfig
+	}{
+		{"tcp://graylog:12201#group=graylog&weight=3", outputConfig{ID: "0", URL: "tcp://graylog:12201",
+			Group: "graylog", Weight: 3, SendTimeout: 700}},
+		{"tcp://graylog:12201#id=graylog", outputConfig{ID: "graylog", URL: "tcp://graylog:12201",
+			Group: defaultGroup, Weight: 1, SendTimeout: 700}},
+		{"https://graylog/gelf?tlsCA=ca.crt&key=value&tlsInsecureSkipVerify=true#group=graylog", outputConfig{ID: "0",
+			URL: "https://graylog/gelf?key=value", Group: "graylog", Weight: 1, SendTimeout: 700,
+			TLS: tlsOutputConfig{CA: "ca.crt", InsecureSkipVerify: true}}},
+		{"udp://loki:1234?compression=gzip&chunkSize=8154#id=loki&weight=3", outputConfig{ID: "loki", URL: "udp://loki:1234",
+			Group: defaultGroup, Weight: 3, SendTimeout: 700, ChunkSize: 8154, Compression: "gzip"}},
+		{"http://loki/loki/api/v1/push?labels=host,level&staticLabels=env:prod&lineFormat=logfmt&batchSize=10", outputConfig{ID: "0",
+			URL: "http://loki/loki/api/v1/push", Group: defaultGroup, Weight: 1, SendTimeout: 700, BatchSize: 10,
+			Loki: lokiOutputConfig{Labels: []string{"host", "level"}, StaticLabels: map[string]string{"env": "prod"}, LineFormat: "logfmt"}}},
+		{"elasticsearch+https://user:pass@es:9200?index=logs-{2006.01.02}&batchWait=500", outputConfig{ID: "0",
+			URL: "elasticsearch+https://user:pass@es:9200", Group: defaultGroup, Weight: 1, SendTimeout: 700, BatchWait: 500,
+			Elasticsearch: elasticsearchOutputConfig{Index: "logs-{2006.01.02}"}}},
+		{"kafka://b1,b2:9093/logs?key=host&compression=gzip&batchSize=100", outputConfig{ID: "0",
+			URL: "kafka://b1,b2:9093/logs", Group: defaultGroup, Weight: 1, SendTimeout: 700, BatchSize: 100,
+			Compression: "gzip", Kafka: kafkaOutputConfig{Key: "host"}}},
+		{"file:///var/log/app-%Y%m%d.ndjson?maxSize=1000&compress=true", outputConfig{ID: "0",
+			URL: "file:///var/log/app-%Y%m%d.ndjson", Group: defaultGroup, Weight: 1, SendTimeout: 700,
+			File: fileOutputConfig{MaxSize: 1000, Compress: true}}},
+		{"stderr://?format=human&color=never", outputConfig{ID: "0", URL: "stderr://", Group: defaultGroup, Weight: 1, SendTimeout: 700,
+			Console: consoleOutputConfig{Format: "human", Color: "never"}}},
+	} {
+		cfg, err := loadTestConfig(t, "", "-sendTimeout", "700", "-out", tc.url)
+		if err != nil {
+			t.Errorf("%s: %v", tc.url, err)
+			continue
+		}
+		if !reflect.DeepEqual(cfg.Outputs, []outputConfig{tc.expected}) {
+			t.Errorf("%s: unexpected output %+v", tc.url, cfg.Outputs)
+		}
+	}
+}
+
+func TestLoadConfig_OutputIDs(t *testing.T) {
+	var ids [][]string
+	for _, data := range []string{
+		"outputs:\n  - url: tcp://a:1\n  - url: tcp://b:1\n  - url: tcp://a:1\n    group: a\n",
+		"outputs:\n  - url: tcp://b:1\n  - url: tcp://a:1\n  - url: tcp://a:1\n    group: a\n",
+	} {
+		cfg, err := loadTestConfig(t, "dataDir: "+os.TempDir()+"\n"+data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make([]string, 0, len(cfg.Outputs))
+		for _, out := range cfg.Outputs {
+			res = append(res, out.ID)
+		}
+		ids = append(ids, res)
+	}
+	// ids of outputs with disk queues follow outputs when they are reordered
+	if ids[0][0] != ids[1][1] || ids[0][1] != ids[1][0] || ids[0][2] != ids[0][0]+"-1" || ids[1][2] != ids[0][2] {
+		t.Errorf("unexpected ids %v", ids)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	for _, tc := range []struct {
+		config   string
+		expected string
+	}{
+		{"sendTimeout: -1", "sendTimeout: must be positive"},
+		{"inputs:\n  - url: ftp://:21", `inputs[0]: unsupported scheme "ftp"`},
+		{"outputs:\n  - url: ftp://a:21", `outputs[0]: unsupported scheme "ftp"`},
+		{"outputs:\n  - url: tcp://a:1\n    id: a\n  - url: tcp://b:1\n    id: a", `outputs[1]: duplicate id "a"`},
+		{"outputs:\n  - url: tcp://a:1\n    id: .spill", `outputs[0]: invalid id ".spill"`},
+		{"outputs:\n  - url: tcp://a:1\nroutes:\n  - strategy: random", `routes[0]: unknown strategy "random"`},
+		{"outputs:\n  - url: http://loki/api/prom/push\n    loki:\n      encoding: json",
+			"outputs[0]: json encoding is not supported by legacy loki push API"},
+		{"inputs:\n  - url: udp://:12201\n    auth:\n      tokens:\n        s3cr3t: app",
+			`inputs[0]: authentication is not supported by "udp" scheme`},
+		{"inputs:\n  - url: udp://:12201\n    rateLimit:\n      action: delay",
+			`inputs[0]: rateLimit.action "delay" is not supported by "udp" scheme`},
+		{"queue:\n  overflow: spill", `queue.overflow: "spill" requires dataDir`},
+		{"limits:\n  diskSegmentSize: -1", "limits.diskSegmentSize: must not be negative"},
+		{"diskEncryption:\n  keys:\n    - id: k1", "diskEncryption.keys[0]: either file or env is required"},
+		{"diskEncryption:\n  key: k2", `diskEncryption.key: "k2" is not listed in keys`},
+	} {
+		_, err := loadTestConfig(t, tc.config)
+		errs, ok := err.(configErrors)
+		if !ok {
+			t.Errorf("%s: unexpected error %v", tc.expected, err)
+			continue
+		}
+		if len(errs) != 1 || errs[0] != tc.expected {
+			t.Errorf("%s: unexpected errors %q", tc.expected, []string(errs))
+		}
+	}
+}
+
+func TestLoadConfig_AllErrors(t *testing.T) {
+	_, err := loadTestConfig(t, `
+inputs:
+  - url: ftp://:21
+outputs:
+  - url: ftp://a:21
+`)
+	if errs, ok := err.(configErrors); !ok || len(errs) != 2 {
+		t.Errorf("all errors should be reported: %v", err)
+	}
+}
+
+func TestLoadConfig_Encryption(t *testing.T) {
+	fn := writeConfig(t, `
+diskEncryption:
+  key: k2
+  keys:
+    - id: k1
+      file: k1.key
+    - id: k2
+      env: GRAYPROXY_TEST_KEY
+`)
+	keyFile := filepath.Join(filepath.Dir(fn), "k1.key")
+	if err := ioutil.WriteFile(keyFile, []byte("MDEyMzQ1Njc4OWFiY2RlZg==\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, []byte(strings.Replace(string(data), "k1.key", keyFile, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	app := &app{configFile: fn}
+	if _, err := app.loadConfig(); err == nil || !strings.Contains(err.Error(), "GRAYPROXY_TEST_KEY is not set") {
+		t.Errorf("missing key should be reported: %v", err)
+	}
+	os.Setenv("GRAYPROXY_TEST_KEY", "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	defer os.Unsetenv("GRAYPROXY_TEST_KEY")
+	cfg, err := app.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.diskKeys == nil || diskOptions(cfg, "", "").Keys != cfg.diskKeys {
+		t.Error("keys should be loaded")
+	}
+}
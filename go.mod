@@ -1,35 +1,32 @@
 module github.com/andviro/grayproxy
 
+go 1.27.1
+
 require (
 	github.com/andviro/goldie v0.0.0-20180822203610-4d8717fa0de8
 	github.com/armon/go-proxyproto v0.0.0-20180202201750-5b7edb60ff5f
-	github.com/blang/semver v3.5.1+incompatible // indirect
-	github.com/buger/jsonparser v0.0.0-20181115193947-bf1c66bbce23
-	github.com/cespare/xxhash v1.1.0 // indirect
 	github.com/cloudflare/buffer v0.0.0-20170426174217-95edf007eb08
-	github.com/codahale/hdrhistogram v0.0.0-20161010025455-3a0bb77429bd // indirect
-	github.com/cortexproject/cortex v0.0.0-20190302090739-f18cc59bf27c // indirect
-	github.com/go-mixins/http v0.0.0-20170830133637-681696dd50e0
-	github.com/gogo/googleapis v1.1.0 // indirect
-	github.com/gogo/status v1.0.3 // indirect
-	github.com/golang/snappy v0.0.1 // indirect
-	github.com/gorilla/mux v1.7.0 // indirect
+	github.com/golang/snappy v0.0.1
 	github.com/gorilla/websocket v1.4.0
 	github.com/grafana/loki v0.0.0-20190225162846-5207751cbdad
-	github.com/grpc-ecosystem/go-grpc-middleware v1.0.0 // indirect
 	github.com/jeremywohl/flatten v0.0.0-20180923035001-588fe0d4c603
-	github.com/opentracing-contrib/go-grpc v0.0.0-20180928155321-4b5a12d3ff02 // indirect
-	github.com/opentracing-contrib/go-stdlib v0.0.0-20190205184154-464eb271c715 // indirect
-	github.com/opentracing/opentracing-go v1.0.2 // indirect
 	github.com/pkg/errors v0.8.0
-	github.com/prometheus/common v0.2.0
-	github.com/prometheus/prometheus v2.5.0+incompatible // indirect
-	github.com/sercand/kuberesolver v2.1.0+incompatible // indirect
-	github.com/uber-go/atomic v1.3.2 // indirect
-	github.com/uber/jaeger-client-go v2.15.1-0.20190228190846-ecf2d03a9e80+incompatible // indirect
-	github.com/uber/jaeger-lib v2.0.0+incompatible // indirect
-	github.com/weaveworks/common v0.0.0-20190110153500-81a1a4d158e6 // indirect
-	github.com/weaveworks/promrus v1.2.0 // indirect
-	go.uber.org/atomic v1.3.2 // indirect
+	github.com/prometheus/client_golang v0.9.1
+	gopkg.in/yaml.v2 v2.2.1
+)
+
+require (
+	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
+	github.com/cortexproject/cortex v0.0.0-20190302090739-f18cc59bf27c // indirect
+	github.com/gogo/protobuf v1.1.1 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910 // indirect
+	github.com/prometheus/common v0.2.0 // indirect
+	github.com/prometheus/procfs v0.0.0-20181005140218-185b4288413d // indirect
+	golang.org/x/net v0.0.0-20181114220301-adae6a3d119a // indirect
+	golang.org/x/sys v0.0.0-20181116152217-5ac8a444bdc5 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8 // indirect
 	google.golang.org/grpc v1.19.0 // indirect
 )
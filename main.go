@@ -1,12 +1,22 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 )
 
 var version string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "queue" {
+		if err := runQueue(os.Args[2:], os.Stdout); err != nil && err != flag.ErrHelp {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
 	app := new(app)
-	log.Fatalf("%+v", app.run())
+	if err := app.run(); err != nil {
+		log.Fatalf("%+v", err)
+	}
 }
@@ -0,0 +1,183 @@
+// Package auth authenticates clients of inputs and tags their messages with
+// client identity
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+// Field is the message field holding identity of authenticated client
+const Field = "_source_token"
+
+// Headers of signed HTTP requests. The signature is hex encoded HMAC-SHA256
+// of the timestamp (Unix seconds), a dot and the request body as sent.
+const (
+	KeyIDHeader     = "X-Grayproxy-Key-Id"
+	TimestampHeader = "X-Grayproxy-Timestamp"
+	SignatureHeader = "X-Grayproxy-Signature"
+)
+
+// MaxSkew limits the difference between signature timestamp and local time
+var MaxSkew = 5 * time.Minute
+
+// now is overridden in tests
+var now = time.Now
+
+// ErrUnauthorized is returned for clients without valid credentials
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator verifies credentials of input clients
+type Authenticator struct {
+	// Input names the input in logs and metrics
+	Input string
+	// Tokens maps bearer tokens of HTTP requests and tokens sent first on
+	// TCP connections to client identities
+	Tokens map[string]string
+	// Users maps user names of HTTP basic authentication to passwords,
+	// the user name is the identity
+	Users map[string]string
+	// HMACKeys maps key ids of HTTP request signatures to secrets, the key
+	// id is the identity
+	HMACKeys map[string]string
+	// ClientCert accepts clients with verified TLS certificates, the
+	// certificate common name is the identity
+	ClientCert bool
+}
+
+// reject logs and counts failed authentication attempt
+func (a *Authenticator) reject(from, reason string) error {
+	log.Printf("%s: rejected client %s: %s", a.Input, from, reason)
+	metrics.InputAuthFailures.WithLabelValues(a.Input).Inc()
+	return ErrUnauthorized
+}
+
+// Token returns identity of client with the token
+func (a *Authenticator) Token(token string) (string, bool) {
+	identity, found := "", false
+	// all tokens are compared to avoid leaking timing information
+	for t, id := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			identity, found = id, true
+		}
+	}
+	return identity, found
+}
+
+// Cert returns identity of client with verified certificate
+func (a *Authenticator) Cert(state *tls.ConnectionState) (string, bool) {
+	if !a.ClientCert || state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+	cert := state.VerifiedChains[0][0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, true
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], true
+	}
+	return "", false
+}
+
+// Conn authenticates stream connection. The first message is read with
+// first if client certificate is not accepted and should be the token.
+func (a *Authenticator) Conn(from string, state *tls.ConnectionState, first func() ([]byte, bool)) (string, error) {
+	if identity, ok := a.Cert(state); ok {
+		return identity, nil
+	}
+	if len(a.Tokens) == 0 {
+		return "", a.reject(from, "no client certificate")
+	}
+	token, ok := first()
+	if !ok {
+		return "", a.reject(from, "no token")
+	}
+	if identity, ok := a.Token(strings.TrimSpace(string(token))); ok {
+		return identity, nil
+	}
+	return "", a.reject(from, "invalid token")
+}
+
+// HTTP authenticates HTTP request with the raw body
+func (a *Authenticator) HTTP(r *http.Request, body []byte) (string, error) {
+	if identity, ok := a.Cert(r.TLS); ok {
+		return identity, nil
+	}
+	if keyID := r.Header.Get(KeyIDHeader); keyID != "" {
+		if err := a.verify(keyID, r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader), body); err != nil {
+			return "", a.reject(r.RemoteAddr, err.Error())
+		}
+		return keyID, nil
+	}
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", a.reject(r.RemoteAddr, "no credentials")
+	}
+	if i := strings.IndexByte(authorization, ' '); i > 0 && strings.EqualFold(authorization[:i], "Bearer") {
+		if identity, ok := a.Token(strings.TrimSpace(authorization[i+1:])); ok {
+			return identity, nil
+		}
+		return "", a.reject(r.RemoteAddr, "invalid bearer token")
+	}
+	if user, pass, ok := r.BasicAuth(); ok {
+		expected, found := a.Users[user]
+		if found && subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1 {
+			return user, nil
+		}
+		return "", a.reject(r.RemoteAddr, "invalid password of user "+strconv.Quote(user))
+	}
+	return "", a.reject(r.RemoteAddr, "unsupported authorization scheme")
+}
+
+// verify checks request signature
+func (a *Authenticator) verify(keyID, timestamp, signature string, body []byte) error {
+	secret, ok := a.HMACKeys[keyID]
+	if !ok {
+		return errors.Errorf("unknown key %q", keyID)
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid signature timestamp")
+	}
+	if skew := now().Sub(time.Unix(ts, 0)); math.Abs(float64(skew)) > float64(MaxSkew) {
+		return errors.Errorf("signature timestamp is off by %v", skew.Round(time.Second))
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(got, Sign(secret, timestamp, body)) {
+		return errors.Errorf("invalid signature of key %q", keyID)
+	}
+	return nil
+}
+
+// Sign returns signature of request body
+func Sign(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Tag sets identity field of the message, replacing the one sent by client
+func Tag(msg []byte, identity string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, errors.Wrap(err, "message is not a JSON object")
+	}
+	fields[Field], _ = json.Marshal(identity)
+	return json.Marshal(fields)
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticator_Signature(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1000, 0) }
+	a := &Authenticator{Input: "test", HMACKeys: map[string]string{"key1": "secret"}}
+	body := []byte(`{"a":1}`)
+	for _, tc := range []struct {
+		key, ts, secret string
+		ok              bool
+	}{
+		{"key1", "1000", "secret", true},
+		{"key1", "1200", "secret", true},
+		{"key1", "1400", "secret", false},
+		{"key1", "1000", "wrong", false},
+		{"key2", "1000", "secret", false},
+		{"key1", "now", "secret", false},
+	} {
+		r := httptest.NewRequest("POST", "/gelf", strings.NewReader(string(body)))
+		r.Header.Set(KeyIDHeader, tc.key)
+		r.Header.Set(TimestampHeader, tc.ts)
+		r.Header.Set(SignatureHeader, hex.EncodeToString(Sign(tc.secret, tc.ts, body)))
+		identity, err := a.HTTP(r, body)
+		if (err == nil) != tc.ok || tc.ok && identity != tc.key {
+			t.Errorf("%+v: unexpected result %q, %v", tc, identity, err)
+		}
+	}
+}
+
+func TestAuthenticator_Conn(t *testing.T) {
+	state := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client"}}}}}
+	token := func() ([]byte, bool) { return []byte("s3cr3t\n"), true }
+	for _, tc := range []struct {
+		a        *Authenticator
+		state    *tls.ConnectionState
+		identity string
+	}{
+		{&Authenticator{ClientCert: true}, state, "client"},
+		{&Authenticator{ClientCert: true}, nil, ""},
+		{&Authenticator{Tokens: map[string]string{"s3cr3t": "app"}}, state, "app"},
+		{&Authenticator{Tokens: map[string]string{"other": "app"}}, nil, ""},
+	} {
+		identity, err := tc.a.Conn("127.0.0.1:1", tc.state, token)
+		if identity != tc.identity || (err == nil) != (tc.identity != "") {
+			t.Errorf("%+v: unexpected result %q, %v", tc.a, identity, err)
+		}
+	}
+}
+
+func TestTag(t *testing.T) {
+	msg, err := Tag([]byte(`{"b":{"c": 1},"_source_token":"forged","a":"x"}`), "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"_source_token":"app","a":"x","b":{"c":1}}`; string(msg) != expected {
+		t.Errorf("unexpected message %s", msg)
+	}
+	if _, err := Tag([]byte(`[1]`), "app"); err == nil {
+		t.Error("error expected for non-object message")
+	}
+}
@@ -0,0 +1,221 @@
+// Package console prints GELF messages to standard output or error in
+// machine or human readable formats
+package console
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Formats of printed messages
+const (
+	// FormatRaw prints messages as received
+	FormatRaw = "raw"
+	// FormatPretty prints indented multi-line JSON
+	FormatPretty = "pretty"
+	// FormatLogfmt prints key=value pairs
+	FormatLogfmt = "logfmt"
+	// FormatHuman prints timestamp, level, host and short message
+	FormatHuman = "human"
+)
+
+// Color modes of human format
+const (
+	// ColorAuto colors output if it is a terminal
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorBlue   = "\x1b[34m"
+	colorCyan   = "\x1b[36m"
+)
+
+// syslog severities used as GELF levels
+var levels = []struct{ name, color string }{
+	{"EMERG", colorRed},
+	{"ALERT", colorRed},
+	{"CRIT", colorRed},
+	{"ERROR", colorRed},
+	{"WARN", colorYellow},
+	{"NOTICE", colorCyan},
+	{"INFO", colorGreen},
+	{"DEBUG", colorBlue},
+}
+
+// Sender writes each message as a line, or several lines in pretty format,
+// to Writer. Messages that are not valid JSON are printed as is.
+type Sender struct {
+	// Writer defaults to os.Stdout
+	Writer io.Writer
+	// Format is FormatRaw (default), FormatPretty, FormatLogfmt or
+	// FormatHuman
+	Format string
+	// Color is ColorAuto (default), ColorAlways or ColorNever
+	Color string
+
+	mu    sync.Mutex
+	once  sync.Once
+	color bool
+}
+
+func (s *Sender) writer() io.Writer {
+	if s.Writer == nil {
+		return os.Stdout
+	}
+	return s.Writer
+}
+
+// useColor returns true if human format should be colored
+func (s *Sender) useColor() bool {
+	s.once.Do(func() {
+		switch s.Color {
+		case ColorAlways:
+			s.color = true
+		case "", ColorAuto:
+			if f, ok := s.writer().(*os.File); ok {
+				stat, err := f.Stat()
+				s.color = err == nil && stat.Mode()&os.ModeCharDevice != 0
+			}
+		}
+	})
+	return s.color
+}
+
+// Send prints message
+func (s *Sender) Send(data []byte) error {
+	line, err := s.format(data)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.writer().Write(line)
+	return errors.Wrap(err, "printing message")
+}
+
+func (s *Sender) format(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	raw := append(append([]byte(nil), data...), '\n')
+	switch s.Format {
+	case "", FormatRaw:
+		return raw, nil
+	case FormatPretty:
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, data, "", "  "); err != nil {
+			return raw, nil
+		}
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	case FormatLogfmt, FormatHuman:
+	default:
+		return nil, errors.Errorf("unknown format %q", s.Format)
+	}
+	var msg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		return raw, nil
+	}
+	if s.Format == FormatLogfmt {
+		return logfmt(msg), nil
+	}
+	return s.human(msg), nil
+}
+
+// timestamp returns message time, or current time if it is not set
+func timestamp(msg map[string]interface{}) time.Time {
+	if n, ok := msg["timestamp"].(json.Number); ok {
+		if sec, err := n.Float64(); err == nil && sec > 0 {
+			return time.Unix(0, int64(math.Round(sec*1000))*int64(time.Millisecond))
+		}
+	}
+	return time.Now()
+}
+
+// logfmt prints timestamp, level, host and short message followed by other
+// fields in alphabetical order. Leading underscores are removed from field
+// names.
+func logfmt(msg map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "timestamp=%s", timestamp(msg).UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	for _, k := range []string{"level", "host", "short_message"} {
+		if v, ok := msg[k]; ok {
+			fmt.Fprintf(&buf, " %s=%s", k, logfmtValue(stringValue(v)))
+		}
+	}
+	names := make([]string, 0, len(msg))
+	for k := range msg {
+		switch k {
+		case "timestamp", "level", "host", "short_message":
+		default:
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(&buf, " %s=%s", strings.TrimPrefix(k, "_"), logfmtValue(stringValue(msg[k])))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// human prints "timestamp level host short_message" with level colored
+// according to severity
+func (s *Sender) human(msg map[string]interface{}) []byte {
+	level, color := "-", ""
+	if n, ok := msg["level"].(json.Number); ok {
+		if l, err := strconv.Atoi(n.String()); err == nil && l >= 0 && l < len(levels) {
+			level, color = levels[l].name, levels[l].color
+		} else {
+			level = n.String()
+		}
+	}
+	ts := timestamp(msg).Local().Format("2006-01-02 15:04:05.000")
+	host := stringValue(msg["host"])
+	text := stringValue(msg["short_message"])
+	if !s.useColor() {
+		return []byte(fmt.Sprintf("%s %-6s %s %s\n", ts, level, host, text))
+	}
+	return []byte(fmt.Sprintf("%s%s%s %s%-6s%s %s%s%s %s\n",
+		colorDim, ts, colorReset, color, level, colorReset, colorCyan, host, colorReset, text))
+}
+
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,42 @@
+package console_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/console"
+)
+
+const testMessage = `{"version":"1.1","host":"example.org","short_message":"A short message","timestamp":1385053862.3072,"level":3,"_user_id":9001,"_env":"prod env"}`
+
+func TestSender_Formats(t *testing.T) {
+	ts := time.Unix(1385053862, 307000000).Local().Format("2006-01-02 15:04:05.000")
+	for _, tc := range []struct {
+		s        *console.Sender
+		msg      string
+		expected string
+	}{
+		{&console.Sender{}, testMessage + "\n", testMessage + "\n"},
+		{&console.Sender{Format: console.FormatPretty}, `{"host":"a","level":1}`, "{\n  \"host\": \"a\",\n  \"level\": 1\n}\n"},
+		{&console.Sender{Format: console.FormatPretty}, `not json`, "not json\n"},
+		{
+			&console.Sender{Format: console.FormatLogfmt}, testMessage,
+			`timestamp=2013-11-21T17:11:02.307Z level=3 host=example.org short_message="A short message" env="prod env" user_id=9001 version=1.1` + "\n",
+		},
+		{&console.Sender{Format: console.FormatHuman}, testMessage, ts + " ERROR  example.org A short message\n"},
+		{
+			&console.Sender{Format: console.FormatHuman, Color: console.ColorAlways}, testMessage,
+			"\x1b[2m" + ts + "\x1b[0m \x1b[31mERROR \x1b[0m \x1b[36mexample.org\x1b[0m A short message\n",
+		},
+	} {
+		var buf bytes.Buffer
+		tc.s.Writer = &buf
+		if err := tc.s.Send([]byte(tc.msg)); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.s.Format, tc.expected, buf.String())
+		}
+	}
+}
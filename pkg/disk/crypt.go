@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// maxKeyID limits the length of key IDs stored with each record
+const maxKeyID = 255
+
+// ErrNoKey is returned for records encrypted with a key that is not
+// configured
+var ErrNoKey = errors.New("encryption key is not configured")
+
+// Keys hold AES keys for encryption of records with AES-GCM. Each encrypted
+// record starts with the ID of its key, so records encrypted with previous
+// keys are read as long as those keys are kept.
+type Keys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeys returns keys that encrypt new records with the key current, or
+// leave them unencrypted if current is empty. Keys must be 16, 24 or 32
+// bytes long.
+func NewKeys(current string, keys map[string][]byte) (*Keys, error) {
+	k := &Keys{current: current, aeads: make(map[string]cipher.AEAD)}
+	for id, key := range keys {
+		if id == "" || len(id) > maxKeyID {
+			return nil, errors.Errorf("key ID must be 1 to %d bytes long", maxKeyID)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %q", id)
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, errors.Wrapf(err, "key %q", id)
+		}
+	}
+	if _, ok := k.aeads[current]; current != "" && !ok {
+		return nil, errors.Wrapf(ErrNoKey, "key %q", current)
+	}
+	return k, nil
+}
+
+// enabled reports whether new records are encrypted
+func (k *Keys) enabled() bool {
+	return k != nil && k.current != ""
+}
+
+// overhead returns the number of bytes encryption adds to each new record
+func (k *Keys) overhead() int {
+	if !k.enabled() {
+		return 0
+	}
+	aead := k.aeads[k.current]
+	return 1 + len(k.current) + aead.NonceSize() + aead.Overhead()
+}
+
+// additionalData binds encrypted data to the timestamp of the record
+func additionalData(r Record) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(r.Time.UnixNano()))
+	return buf
+}
+
+// seal returns data of the record encrypted with the current key: key ID
+// length, key ID, random nonce and ciphertext
+func (k *Keys) seal(r Record) ([]byte, error) {
+	aead := k.aeads[k.current]
+	n := 1 + len(k.current)
+	buf := make([]byte, n+aead.NonceSize(), k.overhead()+len(r.Data))
+	buf[0] = byte(len(k.current))
+	copy(buf[1:], k.current)
+	nonce := buf[n:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	return aead.Seal(buf, nonce, r.Data, additionalData(r)), nil
+}
+
+// keyID returns the ID of the key encrypted data starts with
+func keyID(data []byte) (string, error) {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "", errCorrupt
+	}
+	return string(data[1 : 1+data[0]]), nil
+}
+
+// open returns the record with its data decrypted
+func (k *Keys) open(r Record) (Record, error) {
+	id, err := keyID(r.Data)
+	if err != nil {
+		return Record{}, err
+	}
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.aeads[id]
+	}
+	if aead == nil {
+		return Record{}, errors.Wrapf(ErrNoKey, "message is encrypted with key %q", id)
+	}
+	data := r.Data[1+len(id):]
+	if len(data) < aead.NonceSize() {
+		return Record{}, errCorrupt
+	}
+	nonce := data[:aead.NonceSize()]
+	res, err := aead.Open(nil, nonce, data[len(nonce):], additionalData(r))
+	if err != nil {
+		return Record{}, errors.Wrapf(err, "decrypting message with key %q", id)
+	}
+	return Record{Data: res, Time: r.Time}, nil
+}
@@ -0,0 +1,226 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tmpExt marks segments being rewritten by Purge
+const tmpExt = ".tmp"
+
+// Stats describes messages held by the queue
+type Stats struct {
+	Messages int64
+	// Bytes is the total size of segment files
+	Bytes    int64
+	Segments int
+	// Oldest and Newest are the times the first and the last messages were
+	// put, they are zero if the queue is empty
+	Oldest, Newest time.Time
+}
+
+// Scan calls fn for unacknowledged messages of the queue in opts.Dir in
+// order, until it returns false. Encrypted messages are decrypted with
+// opts.Keys. Queue files are only read, so the queue may be scanned while it
+// is used by another process.
+func Scan(opts Options, fn func(Record) bool) error {
+	_, err := scan(opts.Dir, opts.Keys, fn)
+	return err
+}
+
+// Stat returns statistics of the queue in dir, like Scan it does not modify
+// the queue. Encrypted messages are counted without decrypting them.
+func Stat(dir string) (Stats, error) {
+	return scan(dir, nil, nil)
+}
+
+// scan collects statistics of the queue in dir and passes its messages to
+// fn, if it is not nil
+func scan(dir string, keys *Keys, fn func(Record) bool) (st Stats, err error) {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		return st, err
+	}
+	var ackSeq uint64
+	acked := segmentHeaderSize
+	if f, err := os.Open(filepath.Join(dir, cursorFile)); err == nil {
+		if seq, offset, ok, _ := readCursor(f); ok {
+			ackSeq, acked = seq, offset
+		}
+		f.Close()
+	}
+	for _, seq := range seqs {
+		if seq < ackSeq {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, segmentName(seq)))
+		if os.IsNotExist(err) {
+			// removed by the process using the queue
+			continue
+		} else if err != nil {
+			return st, errors.Wrap(err, "opening segment")
+		}
+		from := segmentHeaderSize
+		if seq == ackSeq {
+			from = acked
+		}
+		more := true
+		var keyErr error
+		s := &segment{seq: seq, f: f}
+		_, err = s.scan(func(offset int64, r Record) bool {
+			if offset < from {
+				return true
+			}
+			st.Messages++
+			if st.Oldest.IsZero() {
+				st.Oldest = r.Time
+			}
+			st.Newest = r.Time
+			if fn == nil {
+				return true
+			}
+			if s.encrypted {
+				if r, keyErr = keys.open(r); keyErr != nil {
+					return false
+				}
+			}
+			more = fn(r)
+			return more
+		})
+		if keyErr != nil {
+			err = errors.Wrapf(keyErr, "segment %s", segmentName(seq))
+		}
+		if stat, e := f.Stat(); e == nil {
+			st.Bytes += stat.Size()
+		}
+		f.Close()
+		// the rest of corrupted segment is dropped on start, incomplete
+		// record may be being written
+		if err != nil && err != errCorrupt {
+			return st, err
+		}
+		st.Segments++
+		if !more {
+			break
+		}
+	}
+	return st, nil
+}
+
+// Purge removes unacknowledged messages of the queue in opts.Dir for which fn
+// returns true and returns their number. Segments holding such messages are
+// rewritten, so the queue must not be used by another process. Messages are
+// decrypted for fn with opts.Keys and kept encrypted with their own keys.
+func Purge(opts Options, fn func(Record) bool) (n int64, err error) {
+	q, err := open(Options{Dir: opts.Dir, MaxSize: -1, Keys: opts.Keys})
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if e := q.closeFiles(); err == nil {
+			err = errors.Wrap(e, "closing queue")
+		}
+	}()
+	for i := range q.segs {
+		removed, err := q.rewrite(i, fn)
+		if n += removed; err != nil {
+			return n, err
+		}
+	}
+	// empty segments are removed, except the last one
+	var segs, obsolete []*segment
+	for i, s := range q.segs {
+		if s.size == segmentHeaderSize && i < len(q.segs)-1 {
+			obsolete = append(obsolete, s)
+		} else {
+			segs = append(segs, s)
+		}
+	}
+	if len(obsolete) == 0 {
+		return n, nil
+	}
+	if segs[0] != q.segs[0] {
+		q.acked = segmentHeaderSize
+	}
+	q.segs = segs
+	if err := q.writeCursor(); err != nil {
+		return n, err
+	}
+	for _, s := range obsolete {
+		if err := q.removeFile(s); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// rewrite replaces i-th segment with a copy holding its unacknowledged
+// records for which fn returns false, if there are any others
+func (q *Queue) rewrite(i int, fn func(Record) bool) (removed int64, err error) {
+	s := q.segs[i]
+	from := segmentHeaderSize
+	if i == 0 {
+		from = q.acked
+	}
+	fn0 := s.f.Name()
+	tmp, err := createSegmentFile(fn0+tmpExt, s.seq, s.encrypted)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		tmp.f.Close()
+		if removed == 0 || err != nil {
+			os.Remove(tmp.f.Name())
+		}
+	}()
+	var werr error
+	_, err = s.scan(func(offset int64, r Record) bool {
+		if offset < from {
+			return true
+		}
+		msg := r
+		if s.encrypted {
+			if msg, werr = q.opts.Keys.open(r); werr != nil {
+				return false
+			}
+		}
+		if fn(msg) {
+			removed++
+			return true
+		}
+		_, werr = tmp.append(r)
+		return werr == nil
+	})
+	if err == nil {
+		err = werr
+	}
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+	if i == 0 && q.acked != segmentHeaderSize {
+		// crash before the segment is replaced makes acknowledged messages
+		// delivered again, but loses nothing
+		q.acked = segmentHeaderSize
+		if err := q.writeCursor(); err != nil {
+			return 0, err
+		}
+	}
+	if err := tmp.f.Sync(); err != nil {
+		return 0, errors.Wrap(err, "writing segment")
+	}
+	if err := os.Rename(tmp.f.Name(), fn0); err != nil {
+		return 0, errors.Wrap(err, "replacing segment")
+	}
+	f, err := os.OpenFile(fn0, os.O_RDWR, 0644)
+	if err != nil {
+		return removed, errors.Wrap(err, "opening segment")
+	}
+	s.f.Close()
+	q.size += tmp.size - s.size
+	q.count -= removed
+	s.f, s.size, s.count, s.newest = f, tmp.size, tmp.count, tmp.newest
+	return removed, nil
+}
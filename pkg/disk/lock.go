@@ -0,0 +1,26 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// lock takes exclusive lock of the queue directory, it is released when the
+// returned file is closed or the process exits
+func lock(dir string) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening queue lock")
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.Wrap(ErrLocked, dir)
+		}
+		return nil, errors.Wrap(err, "locking queue")
+	}
+	return f, nil
+}
@@ -0,0 +1,95 @@
+package disk
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	ring "github.com/cloudflare/buffer"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ringFile is the ring buffer used by the first versions
+	ringFile = "queue"
+	// logFile and logAckFile hold the single log queue and its ack offset
+	logFile    = "queue.log"
+	logAckFile = "queue.ack"
+)
+
+// migrate moves messages left by previous versions to segments and removes
+// their files. They are timestamped with the time of migration.
+func (q *Queue) migrate() error {
+	n, err := q.migrateRing(filepath.Join(q.opts.Dir, ringFile))
+	if err != nil {
+		return err
+	}
+	m, err := q.migrateLog(filepath.Join(q.opts.Dir, logFile), filepath.Join(q.opts.Dir, logAckFile))
+	if err != nil {
+		return err
+	}
+	if n+m > 0 {
+		log.Printf("queue %s: moved %d messages of previous version", q.opts.Name, n+m)
+	}
+	return nil
+}
+
+func (q *Queue) migrateRing(fn string) (n int, err error) {
+	stat, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "reading legacy queue")
+	}
+	buf, err := ring.New(fn, int(stat.Size()))
+	if err != nil {
+		return 0, errors.Wrap(err, "opening legacy queue")
+	}
+	for {
+		data, err := buf.Pop()
+		if err != nil || data == nil {
+			break
+		}
+		if err := q.write(Record{Data: data, Time: now()}); err != nil {
+			return n, errors.Wrap(err, "moving legacy queue")
+		}
+		n++
+	}
+	return n, errors.Wrap(os.Remove(fn), "removing legacy queue")
+}
+
+func (q *Queue) migrateLog(fn, ackFn string) (n int, err error) {
+	data, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "reading legacy queue")
+	}
+	var offset uint64
+	if ack, err := ioutil.ReadFile(ackFn); err == nil && len(ack) == 8 {
+		offset = binary.BigEndian.Uint64(ack)
+	}
+	if offset > uint64(len(data)) {
+		offset = 0
+	}
+	for data = data[offset:]; len(data) >= 4; n++ {
+		size := uint64(binary.BigEndian.Uint32(data))
+		if size > uint64(len(data)-4) {
+			// incomplete record
+			break
+		}
+		if err := q.write(Record{Data: data[4 : 4+size], Time: now()}); err != nil {
+			return n, errors.Wrap(err, "moving legacy queue")
+		}
+		data = data[4+size:]
+	}
+	if err := os.Remove(fn); err != nil {
+		return n, errors.Wrap(err, "removing legacy queue")
+	}
+	if err := os.Remove(ackFn); err != nil && !os.IsNotExist(err) {
+		return n, errors.Wrap(err, "removing legacy queue")
+	}
+	return n, nil
+}
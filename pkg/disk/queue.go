@@ -1,71 +1,633 @@
 package disk
 
 import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
-	ring "github.com/cloudflare/buffer"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+const (
+	// DefaultMaxSize is used if Options.MaxSize is zero
+	DefaultMaxSize = 1 << 30
+	// DefaultSegmentSize is used if Options.SegmentSize is zero
+	DefaultSegmentSize = 64 << 20
+	// cursorFile holds the position of the first unacknowledged record
+	cursorFile = "cursor"
+	// lockFile is locked by the process using the queue
+	lockFile   = "lock"
+	cursorSize = 20
+	// expireInterval limits how often Put looks for expired segments
+	expireInterval = time.Second
+)
+
+var (
+	// ErrFull is returned by Put if the message does not fit into the queue
+	ErrFull = errors.New("queue is full")
+	// ErrLocked is returned if the queue is used by another process
+	ErrLocked = errors.New("queue is used by another process")
 )
 
-// Queue implements on-disk buffering queue
+// now is replaced in tests
+var now = time.Now
+
+// Options of the queue
+type Options struct {
+	// Dir holds files of the queue
+	Dir string
+	// Name labels metrics of the queue, defaults to Dir
+	Name string
+	// MaxSize limits the total size of segment files, messages that do not
+	// fit are rejected. Zero means DefaultMaxSize, negative value disables
+	// the limit.
+	MaxSize int
+	// SegmentSize is the size of segment file after which the next one is
+	// started. Zero means DefaultSegmentSize, but no more than a quarter of
+	// MaxSize, so that expired segments can be removed.
+	SegmentSize int
+	// MaxAge drops messages older than it instead of delivering them, zero
+	// or negative value keeps messages until they are delivered
+	MaxAge time.Duration
+	// Keys encrypt new messages and decrypt queued ones, messages are stored
+	// in clear text if nil
+	Keys *Keys
+}
+
+// mark is the end of a record passed to the read channel. Expired records
+// skipped after it are acknowledged along with it.
+type mark struct {
+	seq     uint64
+	end     int64
+	records int64
+}
+
+// Queue implements on-disk buffering queue as a write-ahead log split into
+// segment files. Each record carries CRC-32C checksum and the time it was
+// put. Messages are removed only after they are acknowledged, the position
+// of the first unacknowledged message is kept in the cursor file. Messages
+// read and not acknowledged before crash or Close are read again after
+// restart. Segments are deleted when all their messages are acknowledged or
+// have expired. With Options.Keys messages are encrypted, and the queue is
+// not opened if keys of queued messages are missing.
 type Queue struct {
-	buf  *ring.Buffer
-	r    chan []byte
-	stop chan struct{}
-	wg   sync.WaitGroup
+	opts Options
+
+	mu     sync.Mutex
+	segs   []*segment
+	cursor *os.File
+	lock   *os.File
+	// acked is the offset of the first unacknowledged record in the first
+	// segment, readSeq and readOff point to the next record passed to the
+	// read channel
+	acked   int64
+	readSeq uint64
+	readOff int64
+	pending []mark
+	// count is the number of unacknowledged records and size is the total
+	// size of segments
+	count, size int64
+	// lastSeq is the sequence number of the last segment created, the last
+	// segment may be removed if it has expired
+	lastSeq uint64
+	// oldest is the time of the first unacknowledged record
+	oldest    time.Time
+	expiredAt time.Time
+
+	// wake is signaled by Put, rewind passes Nack to the reader
+	wake     chan struct{}
+	rewind   chan struct{}
+	r        chan []byte
+	stop     chan struct{}
+	wg       sync.WaitGroup
+	bytes    prometheus.Gauge
+	depth    prometheus.Gauge
+	segments prometheus.Gauge
+}
+
+func (q *Queue) updateMetrics() {
+	q.depth.Set(float64(q.count))
+	q.bytes.Set(float64(q.size))
+	q.segments.Set(float64(len(q.segs)))
+	if q.count > 0 {
+		metrics.QueueOldest.WithLabelValues(q.opts.Name).Set(float64(q.oldest.UnixNano()) / 1e9)
+	} else {
+		metrics.QueueOldest.DeleteLabelValues(q.opts.Name)
+	}
 }
 
-func New(dataDir string, fileSize int) (*Queue, error) {
-	buf, err := ring.New(filepath.Join(dataDir, "queue"), fileSize)
+func (q *Queue) dropped(policy string, n int64) {
+	metrics.QueueDropped.WithLabelValues(q.opts.Name, policy).Add(float64(n))
+}
+
+// New opens or creates the queue in opts.Dir and starts reading it
+func New(opts Options) (*Queue, error) {
+	q, err := open(opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "new buffer")
+		return nil, err
 	}
-	q := &Queue{buf: buf, r: make(chan []byte)}
+	if q.count > 0 {
+		log.Printf("queue %s: %d messages, %d bytes in %d segments", q.opts.Name, q.count, q.size, len(q.segs))
+	}
+	q.bytes = metrics.QueueBytes.WithLabelValues(q.opts.Name)
+	q.depth = metrics.QueueDepth.WithLabelValues(q.opts.Name)
+	q.segments = metrics.QueueSegments.WithLabelValues(q.opts.Name)
+	q.updateMetrics()
 	q.wg.Add(1)
-	go func() {
-		defer close(q.r)
-		defer q.wg.Done()
-		delay := 10 * time.Millisecond
-		for {
-			data, err := q.buf.Pop()
-			if err != nil {
-				return
+	go q.run()
+	return q, nil
+}
+
+// open locks the queue directory and recovers the queue without starting
+// the reader
+func open(opts Options) (_ *Queue, err error) {
+	if opts.Name == "" {
+		opts.Name = opts.Dir
+	}
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.SegmentSize == 0 {
+		opts.SegmentSize = DefaultSegmentSize
+		if opts.MaxSize > 0 && opts.SegmentSize > opts.MaxSize/4 {
+			opts.SegmentSize = opts.MaxSize / 4
+		}
+	}
+	q := &Queue{
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		rewind: make(chan struct{}),
+		r:      make(chan []byte),
+		stop:   make(chan struct{}),
+	}
+	if q.lock, err = lock(opts.Dir); err != nil {
+		return nil, err
+	}
+	if q.cursor, err = os.OpenFile(filepath.Join(opts.Dir, cursorFile), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		q.lock.Close()
+		return nil, errors.Wrap(err, "opening queue cursor")
+	}
+	if err = q.recover(); err == nil {
+		err = q.migrate()
+	}
+	if err != nil {
+		q.closeFiles()
+		return nil, err
+	}
+	return q, nil
+}
+
+// errBadCursor is returned by readCursor if the cursor file is damaged
+var errBadCursor = errors.New("invalid cursor")
+
+// readCursor returns the position stored in the cursor file, ok is false if
+// there is none
+func readCursor(f io.ReaderAt) (seq uint64, offset int64, ok bool, err error) {
+	buf := make([]byte, cursorSize)
+	if _, err := f.ReadAt(buf, 0); err == io.EOF {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, errors.Wrap(err, "reading queue cursor")
+	}
+	if crc32.Checksum(buf[:16], crcTable) != binary.BigEndian.Uint32(buf[16:]) {
+		return 0, 0, false, errBadCursor
+	}
+	return binary.BigEndian.Uint64(buf), int64(binary.BigEndian.Uint64(buf[8:])), true, nil
+}
+
+// writeCursor stores the position of the first unacknowledged record
+func (q *Queue) writeCursor() error {
+	buf := make([]byte, cursorSize)
+	binary.BigEndian.PutUint64(buf, q.segs[0].seq)
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.acked))
+	binary.BigEndian.PutUint32(buf[16:], crc32.Checksum(buf[:16], crcTable))
+	_, err := q.cursor.WriteAt(buf, 0)
+	return errors.Wrap(err, "writing queue cursor")
+}
+
+// recover opens segments and counts unacknowledged records. Segments
+// acknowledged before crash are removed. Records after the first invalid
+// one, usually left incomplete by crash during write, are truncated.
+func (q *Queue) recover() error {
+	seqs, err := listSegments(q.opts.Dir)
+	if err != nil {
+		return err
+	}
+	// segments left by interrupted Purge
+	tmps, _ := filepath.Glob(filepath.Join(q.opts.Dir, "*"+segmentExt+tmpExt))
+	for _, fn := range tmps {
+		os.Remove(fn)
+	}
+	ackSeq, acked, ok, err := readCursor(q.cursor)
+	if err == errBadCursor {
+		log.Printf("queue %s: %v, messages may be delivered again", q.opts.Name, err)
+	} else if err != nil {
+		return err
+	}
+	if !ok && len(seqs) > 0 {
+		ackSeq, acked = seqs[0], segmentHeaderSize
+	}
+	// keyErr reports the first key that is missing or does not decrypt
+	// messages, each key is checked once
+	var keyErr error
+	checked := make(map[string]bool)
+	for i, seq := range seqs {
+		fn := filepath.Join(q.opts.Dir, segmentName(seq))
+		if seq < ackSeq {
+			if err := os.Remove(fn); err != nil {
+				return errors.Wrap(err, "removing acknowledged segment")
+			}
+			continue
+		}
+		f, err := os.OpenFile(fn, os.O_RDWR, 0644)
+		if err != nil {
+			return errors.Wrap(err, "opening segment")
+		}
+		s := &segment{seq: seq, f: f}
+		q.segs = append(q.segs, s)
+		head := seq == ackSeq
+		aligned := !head || acked == segmentHeaderSize
+		var skipped int64
+		end, err := s.scan(func(offset int64, r Record) bool {
+			if head && offset < acked {
+				skipped++
+			} else if head && offset == acked {
+				aligned = true
+			}
+			if q.oldest.IsZero() && (!head || offset >= acked) {
+				q.oldest = r.Time
 			}
-			if data == nil {
-				time.Sleep(delay)
-				select {
-				case <-q.stop:
-					return
-				default:
-					continue
+			if id, err := keyID(r.Data); s.encrypted && err == nil && !checked[id] && (!head || offset >= acked) {
+				checked[id] = true
+				if _, err := q.opts.Keys.open(r); err != nil && keyErr == nil {
+					keyErr = errors.Wrapf(err, "segment %s", segmentName(seq))
 				}
 			}
-			select {
-			case <-q.stop:
-				return
-			case q.r <- data:
-				break
+			s.count++
+			s.newest = r.Time
+			return true
+		})
+		if err == errCorrupt && i < len(seqs)-1 {
+			log.Printf("queue %s: segment %s is corrupted at %d, dropping the rest of it", q.opts.Name, segmentName(seq), end)
+		} else if err != nil && err != errCorrupt {
+			return err
+		}
+		if end < segmentHeaderSize {
+			// crash while creating the segment
+			if err := s.writeHeader(q.opts.Keys.enabled()); err != nil {
+				return err
 			}
+			end = segmentHeaderSize
 		}
-	}()
-	return q, nil
+		if err := s.truncate(end); err != nil {
+			return err
+		}
+		if head && acked == end {
+			aligned = true
+		}
+		if head && !aligned {
+			// the cursor does not point to a record boundary, probably
+			// because the segment was truncated before the cursor was
+			// updated, so all its records are delivered again
+			acked, skipped, q.oldest = segmentHeaderSize, 0, time.Time{}
+			if s.count > 0 {
+				q.oldest, _ = s.time(acked)
+			}
+		}
+		q.count += s.count - skipped
+		q.size += s.size
+	}
+	if keyErr != nil {
+		return keyErr
+	}
+	if len(q.segs) == 0 {
+		seq := ackSeq
+		if seq == 0 {
+			seq = 1
+		}
+		s, err := createSegment(q.opts.Dir, seq, q.opts.Keys.enabled())
+		if err != nil {
+			return err
+		}
+		q.segs = append(q.segs, s)
+		q.size += s.size
+	}
+	q.lastSeq = q.segs[len(q.segs)-1].seq
+	if q.segs[0].seq != ackSeq {
+		acked = segmentHeaderSize
+	}
+	q.acked = acked
+	q.readSeq, q.readOff = q.segs[0].seq, acked
+	return nil
+}
+
+// write appends record to the last segment starting the next one if the
+// last is full or was written with encryption turned on or off, q.mu is held
+func (q *Queue) write(r Record) error {
+	encrypted := q.opts.Keys.enabled()
+	if encrypted {
+		data, err := q.opts.Keys.seal(r)
+		if err != nil {
+			return err
+		}
+		r.Data = data
+	}
+	last := q.segs[len(q.segs)-1]
+	n := int64(recordHeaderSize + len(r.Data))
+	if last.size > segmentHeaderSize && (last.size+n > int64(q.opts.SegmentSize) || last.encrypted != encrypted) {
+		s, err := createSegment(q.opts.Dir, q.lastSeq+1, encrypted)
+		if err != nil {
+			return err
+		}
+		q.lastSeq = s.seq
+		q.segs = append(q.segs, s)
+		q.size += s.size
+		last = s
+	} else if last.encrypted != encrypted {
+		if err := last.writeHeader(encrypted); err != nil {
+			return err
+		}
+	}
+	n, err := last.append(r)
+	if err != nil {
+		return err
+	}
+	q.size += n
+	if q.count++; q.count == 1 {
+		q.oldest = r.Time
+	}
+	return nil
 }
 
+// append writes message to the queue if it fits, q.mu is held
+func (q *Queue) append(data []byte) error {
+	ts := now()
+	if q.opts.MaxAge > 0 && ts.Sub(q.expiredAt) >= expireInterval {
+		q.expire(ts)
+	}
+	n := int64(recordHeaderSize + len(data) + q.opts.Keys.overhead())
+	if q.opts.MaxSize > 0 && q.size+n > int64(q.opts.MaxSize) {
+		q.dropped("maxSize", 1)
+		return ErrFull
+	}
+	return q.write(Record{Data: data, Time: ts})
+}
+
+// expire removes segments with all records older than MaxAge. Segments
+// being read are kept, their expired records are skipped by the reader.
+func (q *Queue) expire(ts time.Time) {
+	q.expiredAt = ts
+	cutoff := ts.Add(-q.opts.MaxAge)
+	for i := 0; i < len(q.segs); {
+		s := q.segs[i]
+		if s.seq <= q.readSeq {
+			i++
+			continue
+		}
+		if !s.newest.Before(cutoff) {
+			return
+		}
+		if err := q.remove(i); err != nil {
+			log.Printf("queue %s: %v", q.opts.Name, err)
+			return
+		}
+		q.count -= s.count
+		q.dropped("maxAge", s.count)
+	}
+}
+
+// remove excludes i-th segment from the queue and deletes it
+func (q *Queue) remove(i int) error {
+	s := q.segs[i]
+	q.segs = append(q.segs[:i], q.segs[i+1:]...)
+	return q.removeFile(s)
+}
+
+// Put appends message to the queue
 func (q *Queue) Put(data []byte) error {
-	if err := q.buf.Insert(data); err != nil {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.append(data); err != nil {
 		return errors.Wrap(err, "put message to buffer")
 	}
+	q.updateMetrics()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
+// next returns the next record to pass to the read channel. It is marked as
+// pending beforehand, so that it may be acknowledged as soon as it is
+// received. Expired records are skipped.
+func (q *Queue) next() (data []byte, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		i := 0
+		for i < len(q.segs)-1 && q.segs[i].seq < q.readSeq {
+			i++
+		}
+		s := q.segs[i]
+		if s.seq != q.readSeq {
+			q.readSeq, q.readOff = s.seq, segmentHeaderSize
+		}
+		if q.readOff >= s.size {
+			if i == len(q.segs)-1 {
+				return nil, false, nil
+			}
+			q.readSeq, q.readOff = q.segs[i+1].seq, segmentHeaderSize
+			continue
+		}
+		r, end, err := s.read(q.readOff)
+		if err == nil && s.encrypted {
+			r, err = q.opts.Keys.open(r)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		q.readOff = end
+		if q.opts.MaxAge > 0 && now().Sub(r.Time) > q.opts.MaxAge {
+			q.dropped("maxAge", 1)
+			if n := len(q.pending); n > 0 {
+				q.pending[n-1] = mark{seq: s.seq, end: end, records: q.pending[n-1].records + 1}
+			} else if err := q.advance(mark{seq: s.seq, end: end, records: 1}); err != nil {
+				log.Printf("queue %s: %v", q.opts.Name, err)
+			}
+			q.updateMetrics()
+			continue
+		}
+		q.pending = append(q.pending, mark{seq: s.seq, end: end, records: 1})
+		return r.Data, true, nil
+	}
+}
+
+// advance acknowledges records up to m, removing segments that are no
+// longer needed. The cursor is written before segments are removed, and the
+// last segment is truncated before the cursor is reset, so that crash in
+// between loses nothing. q.mu is held.
+func (q *Queue) advance(m mark) error {
+	q.count -= m.records
+	i := 0
+	for i < len(q.segs)-1 && q.segs[i].seq < m.seq {
+		i++
+	}
+	acked := m.end
+	for i < len(q.segs)-1 && acked >= q.segs[i].size {
+		i, acked = i+1, segmentHeaderSize
+	}
+	head := q.segs[i]
+	if q.count == 0 && acked == head.size && head.size > segmentHeaderSize {
+		q.size -= head.size - segmentHeaderSize
+		if err := head.truncate(segmentHeaderSize); err != nil {
+			return err
+		}
+		head.count = 0
+		acked = segmentHeaderSize
+		if q.readSeq == head.seq {
+			q.readOff = acked
+		}
+	}
+	obsolete := q.segs[:i]
+	q.segs, q.acked = q.segs[i:], acked
+	err := q.writeCursor()
+	for len(obsolete) > 0 {
+		if e := q.removeFile(obsolete[0]); err == nil {
+			err = e
+		}
+		obsolete = obsolete[1:]
+	}
+	if q.count > 0 {
+		if ts, e := head.time(acked); e == nil {
+			q.oldest = ts
+		}
+	}
+	return err
+}
+
+// removeFile closes and deletes segment that is already excluded from the
+// queue
+func (q *Queue) removeFile(s *segment) error {
+	s.f.Close()
+	q.size -= s.size
+	return errors.Wrap(os.Remove(s.f.Name()), "removing segment")
+}
+
+func (q *Queue) run() {
+	defer close(q.r)
+	defer q.wg.Done()
+	for {
+		data, ok, err := q.next()
+		if err != nil {
+			log.Printf("queue %s: %v", q.opts.Name, err)
+			select {
+			case <-time.After(time.Second):
+			case <-q.rewind:
+				q.reset()
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+		if !ok {
+			select {
+			case <-q.wake:
+			case <-q.rewind:
+				q.reset()
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+		select {
+		case q.r <- data:
+		case <-q.rewind:
+			// the record is read again after reset
+			q.reset()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// ReadChan returns channel of queued messages, each message should be
+// acknowledged with Ack or returned with Nack
 func (q *Queue) ReadChan() <-chan []byte {
 	return q.r
 }
 
+// Ack removes n oldest messages that were read from the queue
+func (q *Queue) Ack(n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n > len(q.pending) {
+		n = len(q.pending)
+	}
+	if n == 0 {
+		return nil
+	}
+	m := q.pending[n-1]
+	for _, p := range q.pending[:n-1] {
+		m.records += p.records
+	}
+	q.pending = q.pending[n:]
+	defer q.updateMetrics()
+	return q.advance(m)
+}
+
+// Nack returns messages that were read and not acknowledged to the queue, so
+// that they are read again. Messages received before Nack must not be
+// acknowledged after it.
+func (q *Queue) Nack() error {
+	select {
+	case q.rewind <- struct{}{}:
+	case <-q.stop:
+		// unacknowledged messages are read after restart
+	}
+	return nil
+}
+
+// reset moves reading position to the first unacknowledged message
+func (q *Queue) reset() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.readSeq, q.readOff = q.segs[0].seq, q.acked
+	q.pending = nil
+}
+
+func (q *Queue) closeFiles() error {
+	err := q.cursor.Close()
+	for _, s := range q.segs {
+		if e := s.f.Close(); err == nil {
+			err = e
+		}
+	}
+	// the lock is released last
+	if e := q.lock.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Close stops reading the queue and closes its files. Messages that were not
+// acknowledged are kept.
 func (q *Queue) Close() error {
 	close(q.stop)
 	q.wg.Wait()
-	return nil
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	metrics.QueueDepth.DeleteLabelValues(q.opts.Name)
+	metrics.QueueBytes.DeleteLabelValues(q.opts.Name)
+	metrics.QueueSegments.DeleteLabelValues(q.opts.Name)
+	metrics.QueueOldest.DeleteLabelValues(q.opts.Name)
+	return errors.Wrap(q.closeFiles(), "closing queue")
 }
@@ -0,0 +1,411 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ring "github.com/cloudflare/buffer"
+	"github.com/pkg/errors"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "grayproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func read(t *testing.T, q *Queue) string {
+	select {
+	case msg := <-q.ReadChan():
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatal("timed out reading queue")
+	}
+	return ""
+}
+
+func put(t *testing.T, q *Queue, msgs ...string) {
+	for _, msg := range msgs {
+		if err := q.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func segments(t *testing.T, dir string) []uint64 {
+	seqs, err := listSegments(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestQueue_AckNack(t *testing.T) {
+	dir := tempDir(t)
+	q, err := New(Options{Dir: dir, MaxSize: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := q.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg := read(t, q); msg != "1" {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	read(t, q)
+	q.Ack(1)
+	q.Nack()
+	if msg := read(t, q); msg != "2" {
+		t.Fatalf("message was not returned by Nack: %s", msg)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if q, err = New(Options{Dir: dir, MaxSize: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"2", "3"} {
+		if msg := read(t, q); msg != expected {
+			t.Fatalf("unacknowledged message %s was lost: %s", expected, msg)
+		}
+	}
+	q.Ack(2)
+	if stat, err := os.Stat(filepath.Join(dir, segmentName(1))); err != nil || stat.Size() != segmentHeaderSize {
+		t.Errorf("segment should be truncated when everything is acknowledged: %v %v", stat.Size(), err)
+	}
+	if err := q.Put(make([]byte, 1000)); err == nil {
+		t.Error("message exceeding file size should be rejected")
+	}
+	q.Close()
+}
+
+func TestQueue_Legacy(t *testing.T) {
+	dir := tempDir(t)
+	buf, err := ring.New(filepath.Join(dir, ringFile), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Insert([]byte("ring"))
+	// the second record of the log is acknowledged, the last is incomplete
+	data := []byte{0, 0, 0, 3, 'o', 'l', 'd', 0, 0, 0, 3, 'l', 'o', 'g', 0, 0, 0, 9, 'x'}
+	if err := ioutil.WriteFile(filepath.Join(dir, logFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, logAckFile), []byte{0, 0, 0, 0, 0, 0, 0, 7}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	q, err := New(Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, expected := range []string{"ring", "log"} {
+		if msg := read(t, q); msg != expected {
+			t.Errorf("expected %s, got %s", expected, msg)
+		}
+	}
+	for _, fn := range []string{ringFile, logFile, logAckFile} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); !os.IsNotExist(err) {
+			t.Errorf("legacy queue file %s was not removed: %v", fn, err)
+		}
+	}
+}
+
+func TestQueue_Segments(t *testing.T) {
+	dir := tempDir(t)
+	// each segment holds two 10-byte messages
+	opts := Options{Dir: dir, MaxSize: 190, SegmentSize: 60}
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		put(t, q, fmt.Sprintf("message %02d", i))
+	}
+	if seqs := segments(t, dir); len(seqs) != 3 {
+		t.Fatalf("expected 3 segments, got %v", seqs)
+	}
+	if err := q.Put([]byte("message 06")); errors.Cause(err) != ErrFull {
+		t.Errorf("message exceeding max size should be rejected: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		read(t, q)
+	}
+	q.Ack(3)
+	if seqs := segments(t, dir); !reflect.DeepEqual(seqs, []uint64{2, 3}) {
+		t.Errorf("acknowledged segment should be removed: %v", seqs)
+	}
+	q.Close()
+
+	if q, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.count != 3 {
+		t.Errorf("expected 3 messages after restart, got %d", q.count)
+	}
+	put(t, q, "message 06")
+	for i := 3; i < 7; i++ {
+		if msg := read(t, q); msg != fmt.Sprintf("message %02d", i) {
+			t.Fatalf("unexpected message %d: %s", i, msg)
+		}
+	}
+}
+
+func TestQueue_MaxAge(t *testing.T) {
+	var elapsed int64
+	start := time.Unix(1e9, 0)
+	now = func() time.Time { return start.Add(time.Duration(atomic.LoadInt64(&elapsed))) }
+	defer func() { now = time.Now }()
+	dir := tempDir(t)
+	q, err := New(Options{Dir: dir, SegmentSize: 60, MaxAge: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	put(t, q, "message 00", "message 01", "message 02", "message 03", "message 04", "message 05")
+	// the first message is passed to the read channel before it expires,
+	// the first segment is being read and the next two are removed
+	time.Sleep(10 * time.Millisecond)
+	atomic.StoreInt64(&elapsed, int64(time.Hour))
+	put(t, q, "message 06")
+	if seqs := segments(t, dir); !reflect.DeepEqual(seqs, []uint64{1, 4}) {
+		t.Errorf("expired segments should be removed: %v", seqs)
+	}
+	read(t, q)
+	q.Ack(1)
+	if msg := read(t, q); msg != "message 06" {
+		t.Errorf("expired message should be skipped: %s", msg)
+	}
+	q.Ack(1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count != 0 || len(q.segs) != 1 {
+		t.Errorf("queue should be empty: %d messages, %d segments", q.count, len(q.segs))
+	}
+}
+
+func TestQueue_Corrupt(t *testing.T) {
+	dir := tempDir(t)
+	opts := Options{Dir: dir, SegmentSize: 60}
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, "message 00", "message 01", "message 02")
+	q.Close()
+	// damage data of the second message
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte("X"), segmentHeaderSize+2*recordHeaderSize+10)
+	f.Close()
+	if q, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for _, expected := range []string{"message 00", "message 02"} {
+		if msg := read(t, q); msg != expected {
+			t.Errorf("expected %s, got %s", expected, msg)
+		}
+	}
+}
+
+func TestQueue_Purge(t *testing.T) {
+	dir := tempDir(t)
+	opts := Options{Dir: dir, SegmentSize: 60}
+	q, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, "message 00", "message 01", "message 02", "message 03", "message 04", "message 05")
+	read(t, q)
+	q.Ack(1)
+	if _, err := Purge(Options{Dir: dir}, func(Record) bool { return true }); errors.Cause(err) != ErrLocked {
+		t.Errorf("queue in use should not be purged: %v", err)
+	}
+	q.Close()
+
+	st, err := Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Messages != 5 || st.Segments != 3 || st.Oldest.IsZero() || st.Newest.Before(st.Oldest) {
+		t.Errorf("unexpected stats %+v", st)
+	}
+	var msgs []string
+	err = Scan(Options{Dir: dir}, func(r Record) bool {
+		msgs = append(msgs, string(r.Data))
+		return len(msgs) < 2
+	})
+	if err != nil || !reflect.DeepEqual(msgs, []string{"message 01", "message 02"}) {
+		t.Errorf("unexpected messages %v: %v", msgs, err)
+	}
+	// the second segment becomes empty and is removed
+	n, err := Purge(Options{Dir: dir}, func(r Record) bool {
+		return string(r.Data) != "message 01" && string(r.Data) != "message 05"
+	})
+	if err != nil || n != 3 {
+		t.Fatalf("expected 3 messages to be removed, got %d: %v", n, err)
+	}
+	if seqs := segments(t, dir); !reflect.DeepEqual(seqs, []uint64{1, 3}) {
+		t.Errorf("empty segment should be removed: %v", seqs)
+	}
+	if q, err = New(opts); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	put(t, q, "message 06")
+	for _, expected := range []string{"message 01", "message 05", "message 06"} {
+		if msg := read(t, q); msg != expected {
+			t.Errorf("expected %s, got %s", expected, msg)
+		}
+	}
+}
+
+const crashDirEnv = "GRAYPROXY_CRASH_DIR"
+
+// TestQueue_CrashHelper runs in the process killed by TestQueue_Crash
+func TestQueue_CrashHelper(t *testing.T) {
+	dir := os.Getenv(crashDirEnv)
+	if dir == "" {
+		t.Skip("started by TestQueue_Crash")
+	}
+	q, err := New(Options{Dir: dir, SegmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := q.Put([]byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 50 messages are delivered and 10 are in flight
+	for i := 0; i < 60; i++ {
+		read(t, q)
+		if i < 50 {
+			q.Ack(1)
+		}
+	}
+	// crash in the middle of writing a record
+	last := q.segs[len(q.segs)-1]
+	last.f.WriteAt([]byte{0, 0, 1}, last.size)
+	fmt.Println("ready")
+	time.Sleep(time.Minute)
+}
+
+func TestQueue_Crash(t *testing.T) {
+	dir := tempDir(t)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestQueue_CrashHelper$")
+	cmd.Env = append(os.Environ(), crashDirEnv+"="+dir)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(out).ReadString('\n'); err != nil || line != "ready\n" {
+		cmd.Process.Kill()
+		t.Fatalf("helper failed: %q %v", line, err)
+	}
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+
+	q, err := New(Options{Dir: dir, SegmentSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if err := q.Put([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 100; i++ {
+		if msg := read(t, q); msg != strconv.Itoa(i) {
+			t.Fatalf("expected message %d, got %s", i, msg)
+		}
+	}
+	if msg := read(t, q); msg != "new" {
+		t.Errorf("incomplete record was not truncated: %q", msg)
+	}
+}
+
+func TestQueue_Encryption(t *testing.T) {
+	dir := tempDir(t)
+	k1, k2 := []byte("0123456789abcdef"), []byte("fedcba9876543210fedcba9876543210")
+	keys := func(current string, ids map[string][]byte) *Keys {
+		k, err := NewKeys(current, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	q, err := New(Options{Dir: dir, Keys: keys("k1", map[string][]byte{"k1": k1})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, "secret 1", "secret 2")
+	if msg := read(t, q); msg != "secret 1" {
+		t.Errorf("unexpected message %s", msg)
+	}
+	q.Ack(1)
+	q.Close()
+	data, err := ioutil.ReadFile(filepath.Join(dir, segmentName(1)))
+	if err != nil || bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("messages should be encrypted: %q %v", data, err)
+	}
+
+	if _, err := New(Options{Dir: dir}); errors.Cause(err) != ErrNoKey {
+		t.Errorf("queue should not be opened without the key: %v", err)
+	}
+	if _, err := New(Options{Dir: dir, Keys: keys("k1", map[string][]byte{"k1": k2})}); err == nil {
+		t.Error("queue should not be opened with a wrong key")
+	}
+
+	// the new key encrypts new messages, the previous one decrypts queued
+	rotated := keys("k2", map[string][]byte{"k1": k1, "k2": k2})
+	if q, err = New(Options{Dir: dir, Keys: rotated}); err != nil {
+		t.Fatal(err)
+	}
+	put(t, q, "secret 3")
+	q.Close()
+	if err := Scan(Options{Dir: dir, Keys: keys("k2", map[string][]byte{"k2": k2})}, func(Record) bool { return true }); errors.Cause(err) != ErrNoKey {
+		t.Errorf("scan should fail without the previous key: %v", err)
+	}
+	if n, err := Purge(Options{Dir: dir, Keys: rotated}, func(r Record) bool { return string(r.Data) == "secret 2" }); err != nil || n != 1 {
+		t.Fatalf("expected 1 message to be removed, got %d: %v", n, err)
+	}
+
+	// turning encryption off starts a segment in clear text
+	if q, err = New(Options{Dir: dir, Keys: keys("", map[string][]byte{"k2": k2})}); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	put(t, q, "message 4")
+	for _, expected := range []string{"secret 3", "message 4"} {
+		if msg := read(t, q); msg != expected {
+			t.Errorf("expected %s, got %s", expected, msg)
+		}
+	}
+	if seqs := segments(t, dir); !reflect.DeepEqual(seqs, []uint64{1, 2}) {
+		t.Errorf("unencrypted messages should be put to a new segment: %v", seqs)
+	}
+}
@@ -0,0 +1,245 @@
+package disk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	segmentExt = ".seg"
+	// segmentMagic starts each segment file, its last byte is the format
+	// version. Data of records in encrypted segments is sealed by Keys.
+	segmentMagic      = "GPQ\x01"
+	encryptedMagic    = "GPQ\x02"
+	segmentHeaderSize = int64(len(segmentMagic))
+	// recordHeaderSize is the size of data length, checksum and timestamp
+	// preceding data of each record
+	recordHeaderSize = 16
+	// maxRecordSize protects from allocating memory for garbage length
+	maxRecordSize = 1 << 30
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// errCorrupt is returned for records with invalid length or checksum,
+	// including incomplete ones
+	errCorrupt = errors.New("corrupted record")
+)
+
+// Record is a message stored in the queue along with the time it was put
+type Record struct {
+	Data []byte
+	Time time.Time
+}
+
+// encode returns record with its header: big-endian data length, CRC-32C of
+// the rest, timestamp in nanoseconds and data
+func (r Record) encode() []byte {
+	buf := make([]byte, recordHeaderSize+len(r.Data))
+	binary.BigEndian.PutUint32(buf, uint32(len(r.Data)))
+	binary.BigEndian.PutUint64(buf[8:], uint64(r.Time.UnixNano()))
+	copy(buf[recordHeaderSize:], r.Data)
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(buf[8:], crcTable))
+	return buf
+}
+
+// decodeRecord parses encoded record and verifies its checksum
+func decodeRecord(buf []byte) (Record, error) {
+	if crc32.Checksum(buf[8:], crcTable) != binary.BigEndian.Uint32(buf[4:]) {
+		return Record{}, errCorrupt
+	}
+	ts := int64(binary.BigEndian.Uint64(buf[8:]))
+	return Record{Data: buf[recordHeaderSize:], Time: time.Unix(0, ts)}, nil
+}
+
+// recordLength returns the size of encoded record from its header
+func recordLength(header []byte) (int64, error) {
+	n := binary.BigEndian.Uint32(header)
+	if n > maxRecordSize {
+		return 0, errCorrupt
+	}
+	return recordHeaderSize + int64(n), nil
+}
+
+// segment is a file holding records of the queue. Records are appended only
+// to the last segment, the others are removed when all their records are
+// acknowledged or expired.
+type segment struct {
+	seq uint64
+	f   *os.File
+	// encrypted is true for segments with encrypted records
+	encrypted bool
+	// size is the end of the last record
+	size  int64
+	count int64
+	// newest is the time of the last record
+	newest time.Time
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentExt)
+}
+
+// listSegments returns sequence numbers of segment files in dir in ascending
+// order
+func listSegments(dir string) ([]uint64, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing segments")
+	}
+	var res []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, seq)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+// createSegment creates empty segment file in dir
+func createSegment(dir string, seq uint64, encrypted bool) (*segment, error) {
+	return createSegmentFile(filepath.Join(dir, segmentName(seq)), seq, encrypted)
+}
+
+func createSegmentFile(fn string, seq uint64, encrypted bool) (*segment, error) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating segment")
+	}
+	s := &segment{seq: seq, f: f}
+	if err := s.writeHeader(encrypted); err != nil {
+		f.Close()
+		os.Remove(fn)
+		return nil, errors.Wrap(err, "creating segment")
+	}
+	return s, nil
+}
+
+// writeHeader sets the format of empty segment
+func (s *segment) writeHeader(encrypted bool) error {
+	magic := segmentMagic
+	if encrypted {
+		magic = encryptedMagic
+	}
+	if _, err := s.f.WriteAt([]byte(magic), 0); err != nil {
+		return errors.Wrapf(err, "writing segment %s", segmentName(s.seq))
+	}
+	s.encrypted, s.size = encrypted, segmentHeaderSize
+	return nil
+}
+
+// scan reads records of the segment file from the beginning, calling each
+// for them with their offsets until it returns false. It returns the end of
+// the last valid record and errCorrupt if there is anything after it. Data
+// of encrypted records is passed as stored.
+func (s *segment) scan(each func(offset int64, r Record) bool) (int64, error) {
+	r := bufio.NewReaderSize(io.NewSectionReader(s.f, 0, 1<<62), 1<<16)
+	magic := make([]byte, segmentHeaderSize)
+	if n, err := io.ReadFull(r, magic); err == io.EOF {
+		return 0, nil
+	} else if err == io.ErrUnexpectedEOF {
+		return 0, errCorrupt
+	} else if err != nil {
+		return 0, errors.Wrap(err, "reading segment")
+	} else if string(magic[:n]) == encryptedMagic {
+		s.encrypted = true
+	} else if string(magic[:n]) != segmentMagic {
+		return 0, errors.Errorf("segment %s has unsupported format", segmentName(s.seq))
+	}
+	offset := segmentHeaderSize
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return offset, nil
+		} else if err == io.ErrUnexpectedEOF {
+			return offset, errCorrupt
+		} else if err != nil {
+			return offset, errors.Wrap(err, "reading segment")
+		}
+		n, err := recordLength(header)
+		if err != nil {
+			return offset, err
+		}
+		buf := make([]byte, n)
+		copy(buf, header)
+		if _, err := io.ReadFull(r, buf[recordHeaderSize:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, errCorrupt
+		} else if err != nil {
+			return offset, errors.Wrap(err, "reading segment")
+		}
+		rec, err := decodeRecord(buf)
+		if err != nil {
+			return offset, err
+		}
+		if offset += n; !each(offset-n, rec) {
+			return offset, nil
+		}
+	}
+}
+
+// read returns the record at offset and the offset of the next one
+func (s *segment) read(offset int64) (Record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := s.f.ReadAt(header, offset); err != nil {
+		return Record{}, 0, errors.Wrapf(err, "reading segment %s", segmentName(s.seq))
+	}
+	n, err := recordLength(header)
+	if err != nil || offset+n > s.size {
+		return Record{}, 0, errors.Wrapf(errCorrupt, "reading segment %s", segmentName(s.seq))
+	}
+	buf := make([]byte, n)
+	copy(buf, header)
+	if _, err := s.f.ReadAt(buf[recordHeaderSize:], offset+recordHeaderSize); err != nil {
+		return Record{}, 0, errors.Wrapf(err, "reading segment %s", segmentName(s.seq))
+	}
+	rec, err := decodeRecord(buf)
+	if err != nil {
+		return Record{}, 0, errors.Wrapf(err, "reading segment %s", segmentName(s.seq))
+	}
+	return rec, offset + n, nil
+}
+
+// time returns the timestamp of the record at offset
+func (s *segment) time(offset int64) (time.Time, error) {
+	buf := make([]byte, 8)
+	if _, err := s.f.ReadAt(buf, offset+8); err != nil {
+		return time.Time{}, errors.Wrapf(err, "reading segment %s", segmentName(s.seq))
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(buf))), nil
+}
+
+// append writes encoded record to the end of the segment. Partially written
+// record is overwritten by the next one.
+func (s *segment) append(r Record) (int64, error) {
+	buf := r.encode()
+	if _, err := s.f.WriteAt(buf, s.size); err != nil {
+		return 0, errors.Wrapf(err, "writing segment %s", segmentName(s.seq))
+	}
+	s.size += int64(len(buf))
+	s.count++
+	s.newest = r.Time
+	return int64(len(buf)), nil
+}
+
+// truncate removes records after offset
+func (s *segment) truncate(offset int64) error {
+	if err := s.f.Truncate(offset); err != nil {
+		return errors.Wrapf(err, "truncating segment %s", segmentName(s.seq))
+	}
+	s.size = offset
+	return nil
+}
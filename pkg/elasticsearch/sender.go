@@ -0,0 +1,221 @@
+// Package elasticsearch indexes GELF messages in Elasticsearch or OpenSearch
+// with the bulk API
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultIndex is used if Sender.Index is empty
+const DefaultIndex = "grayproxy-{2006.01.02}"
+
+// Sender sends messages to the _bulk endpoint
+type Sender struct {
+	// URL is the base URL of the cluster, e.g. http://localhost:9200
+	URL         string
+	SendTimeout int
+	// Index is the index name, parts in braces are replaced by message
+	// time in UTC formatted with Go time layout, e.g. logs-{2006.01.02}
+	Index string
+	// Username and Password enable basic authentication, APIKey is used
+	// instead of them if set
+	Username, Password string
+	APIKey             string
+	TLSConfig          *tls.Config
+
+	client *http.Client
+}
+
+// PartialError is returned if some messages of the batch were not indexed,
+// resending them may succeed
+type PartialError struct {
+	failed []int
+	reason string
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d message(s) not indexed: %s", len(e.failed), e.reason)
+}
+
+// Failed returns positions of messages that should be resent
+func (e *PartialError) Failed() []int {
+	return e.failed
+}
+
+// permanentError is returned if none of messages can be indexed
+type permanentError struct {
+	error
+}
+
+func (permanentError) Permanent() bool {
+	return true
+}
+
+var indexDate = regexp.MustCompile(`\{[^}]*\}`)
+
+func (s *Sender) index(ts time.Time) string {
+	index := s.Index
+	if index == "" {
+		index = DefaultIndex
+	}
+	return indexDate.ReplaceAllStringFunc(index, func(layout string) string {
+		return ts.UTC().Format(layout[1 : len(layout)-1])
+	})
+}
+
+// document converts GELF message to document indexed at its timestamp.
+// Leading underscores are removed from field names.
+func document(data []byte) (doc map[string]interface{}, ts time.Time, err error) {
+	var msg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&msg); err != nil {
+		return nil, ts, errors.Wrap(err, "decoding GELF")
+	}
+	ts = time.Now()
+	doc = make(map[string]interface{}, len(msg))
+	for k, v := range msg {
+		if k == "timestamp" {
+			if n, ok := v.(json.Number); ok {
+				if sec, err := n.Float64(); err == nil && sec > 0 {
+					ts = time.Unix(0, int64(sec*float64(time.Second)))
+				}
+			}
+			continue
+		}
+		doc[strings.TrimPrefix(k, "_")] = v
+	}
+	doc["@timestamp"] = ts.UTC().Format("2006-01-02T15:04:05.000Z07:00")
+	return doc, ts, nil
+}
+
+// Send indexes a single message
+func (s *Sender) Send(data []byte) error {
+	return s.SendBatch([][]byte{data})
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+// SendBatch indexes messages with a single bulk request. Messages rejected
+// with 429 or 5xx status are reported in PartialError, other rejected and
+// invalid messages are dropped.
+func (s *Sender) SendBatch(batch [][]byte) error {
+	var body bytes.Buffer
+	var items []int // positions of messages in batch
+	enc := json.NewEncoder(&body)
+	for i, data := range batch {
+		doc, ts, err := document(data)
+		if err != nil {
+			log.Printf("elasticsearch: skipping message: %v", err)
+			continue
+		}
+		action := map[string]interface{}{"index": map[string]string{"_index": s.index(ts)}}
+		if err := enc.Encode(action); err != nil {
+			return errors.Wrap(err, "encoding bulk request")
+		}
+		if err := enc.Encode(doc); err != nil {
+			return errors.Wrap(err, "encoding bulk request")
+		}
+		items = append(items, i)
+	}
+	if len(items) == 0 {
+		return permanentError{errors.New("no valid messages in batch")}
+	}
+	resp, err := s.bulk(body.Bytes())
+	if err != nil || !resp.Errors {
+		return err
+	}
+	if len(resp.Items) != len(items) {
+		return errors.Errorf("bulk response has %d items, %d expected", len(resp.Items), len(items))
+	}
+	var failed []int
+	var reason string
+	dropped := 0
+	for i, item := range resp.Items {
+		for _, res := range item {
+			if res.Status < 300 {
+				continue
+			}
+			if res.Status == http.StatusTooManyRequests || res.Status >= 500 {
+				failed = append(failed, items[i])
+				reason = string(res.Error)
+				continue
+			}
+			log.Printf("elasticsearch: message rejected: %d %s", res.Status, res.Error)
+			dropped++
+		}
+	}
+	if len(failed) > 0 {
+		return &PartialError{failed: failed, reason: reason}
+	}
+	if dropped == len(items) {
+		return permanentError{errors.New("all messages rejected")}
+	}
+	return nil
+}
+
+func (s *Sender) httpClient() *http.Client {
+	if s.client == nil {
+		s.client = &http.Client{Timeout: time.Duration(s.SendTimeout) * time.Millisecond}
+		if s.TLSConfig != nil {
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.TLSClientConfig = s.TLSConfig
+			s.client.Transport = tr
+		}
+	}
+	return s.client
+}
+
+func (s *Sender) bulk(body []byte) (*bulkResponse, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(s.URL, "/")+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+s.APIKey)
+	} else if s.Username != "" || s.Password != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "sending bulk request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.Errorf("elasticsearch: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	res := new(bulkResponse)
+	if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return nil, errors.Wrap(err, "decoding bulk response")
+	}
+	return res, nil
+}
+
+// Close closes idle connections of the sender, if it has its own transport
+func (s *Sender) Close() error {
+	if s.client != nil && s.client.Transport != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
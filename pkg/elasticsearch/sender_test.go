@@ -0,0 +1,109 @@
+package elasticsearch_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/andviro/grayproxy/pkg/elasticsearch"
+)
+
+// newTestServer records bulk requests and responds with item statuses
+func newTestServer(t *testing.T, statuses ...int) (*httptest.Server, *[]*http.Request, *[][]string) {
+	var requests []*http.Request
+	var lines [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r)
+		var req []string
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		for sc.Scan() {
+			req = append(req, sc.Text())
+		}
+		lines = append(lines, req)
+		res := map[string]interface{}{"errors": false}
+		var items []interface{}
+		for i := 0; i < len(req)/2; i++ {
+			status := http.StatusCreated
+			if i < len(statuses) {
+				status = statuses[i]
+			}
+			if status >= 300 {
+				res["errors"] = true
+			}
+			items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": status}})
+		}
+		res["items"] = items
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			t.Error(err)
+		}
+	}))
+	return ts, &requests, &lines
+}
+
+func TestSender_SendBatch(t *testing.T) {
+	ts, requests, lines := newTestServer(t)
+	defer ts.Close()
+	s := &elasticsearch.Sender{URL: ts.URL + "/", Index: "logs-{2006.01}-{02}", APIKey: "key"}
+	err := s.SendBatch([][]byte{
+		[]byte(`{"host":"a","short_message":"1","timestamp":1385053862.3072,"_user_id":9001}`),
+		[]byte(`not a message`),
+		[]byte(`{"host":"b","short_message":"2","timestamp":1385140262}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := (*requests)[0]
+	if r.URL.Path != "/_bulk" || r.Header.Get("Authorization") != "ApiKey key" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("unexpected request %s %v", r.URL, r.Header)
+	}
+	expected := []string{
+		`{"index":{"_index":"logs-2013.11-21"}}`,
+		`{"@timestamp":"2013-11-21T17:11:02.307Z","host":"a","short_message":"1","user_id":9001}`,
+		`{"index":{"_index":"logs-2013.11-22"}}`,
+		`{"@timestamp":"2013-11-22T17:11:02.000Z","host":"b","short_message":"2"}`,
+	}
+	if !reflect.DeepEqual((*lines)[0], expected) {
+		t.Errorf("unexpected request body %q", (*lines)[0])
+	}
+}
+
+func TestSender_Errors(t *testing.T) {
+	ts, requests, _ := newTestServer(t, http.StatusCreated, http.StatusTooManyRequests, http.StatusBadRequest, http.StatusServiceUnavailable)
+	defer ts.Close()
+	s := &elasticsearch.Sender{URL: ts.URL, Username: "user", Password: "secret"}
+	batch := [][]byte{
+		[]byte(`{"short_message":"1"}`),
+		[]byte(`{"short_message":"2"}`),
+		[]byte(`invalid`),
+		[]byte(`{"short_message":"3"}`),
+		[]byte(`{"short_message":"4"}`),
+	}
+	err := s.SendBatch(batch)
+	pe, ok := err.(*elasticsearch.PartialError)
+	if !ok {
+		t.Fatalf("partial error expected: %v", err)
+	}
+	if failed := pe.Failed(); !reflect.DeepEqual(failed, []int{1, 4}) {
+		t.Errorf("unexpected failed messages %v", failed)
+	}
+	if user, pass, _ := (*requests)[0].BasicAuth(); user != "user" || pass != "secret" {
+		t.Errorf("unexpected credentials %s:%s", user, pass)
+	}
+	err = s.Send([]byte(`{"short_message":"1"}`))
+	if err != nil {
+		t.Error(err)
+	}
+	ts2, _, _ := newTestServer(t, http.StatusBadRequest)
+	defer ts2.Close()
+	s = &elasticsearch.Sender{URL: ts2.URL}
+	err = s.Send([]byte(`{"short_message":"1"}`))
+	if pe, ok := err.(interface{ Permanent() bool }); !ok || !pe.Permanent() {
+		t.Errorf("permanent error expected: %v", err)
+	}
+}
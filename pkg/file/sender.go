@@ -0,0 +1,317 @@
+// Package file writes GELF messages to local files, one JSON document per
+// line, with rotation, compression and retention of rotated files
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultMaxSize is used if Sender.MaxSize is zero
+	DefaultMaxSize = 100 << 20
+	// DefaultSyncInterval is used if Sender.SyncInterval is zero
+	DefaultSyncInterval = 1000
+)
+
+// now is overridden in tests
+var now = time.Now
+
+// Sender appends messages to the file named by Path pattern. When the name
+// produced by the pattern changes, the file is closed and the new one is
+// opened. The file is also rotated when it exceeds MaxSize or is older than
+// RotateInterval, then it is renamed to name.1, name.2 and so on.
+type Sender struct {
+	// Path may contain strftime conversions of local time, e.g.
+	// /var/log/gelf/app-%Y%m%d.ndjson
+	Path string
+	// MaxSize is the size of file in bytes that triggers rotation, zero
+	// means default, negative value disables rotation by size
+	MaxSize int64
+	// RotateInterval is the age of file in milliseconds that triggers
+	// rotation, zero disables rotation by time
+	RotateInterval int
+	// Compress enables gzip compression of closed files
+	Compress bool
+	// MaxFiles limits the number of closed files kept, oldest ones are
+	// removed. Zero keeps all files.
+	MaxFiles int
+	// SyncInterval is the period of fsync in milliseconds, zero means
+	// default, negative value leaves flushing to the operating system
+	SyncInterval int
+
+	mu     sync.Mutex
+	f      *os.File
+	name   string
+	size   int64
+	opened time.Time
+	dirty  bool
+	stop   chan struct{}
+	wg     sync.WaitGroup
+	// cleanMu serializes compression and retention
+	cleanMu sync.Mutex
+}
+
+// permanentError is returned for messages that are not JSON documents
+type permanentError struct {
+	error
+}
+
+func (permanentError) Permanent() bool {
+	return true
+}
+
+// Send appends message to the current file as a single line
+func (s *Sender) Send(data []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, bytes.TrimSpace(data)); err != nil {
+		return permanentError{errors.Wrap(err, "invalid message")}
+	}
+	line.WriteByte('\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.rotate(int64(line.Len())); err != nil {
+		return err
+	}
+	n, err := s.f.Write(line.Bytes())
+	s.size += int64(n)
+	s.dirty = true
+	if err != nil {
+		return errors.Wrapf(err, "writing to %s", s.name)
+	}
+	if s.SyncInterval < 0 {
+		return nil
+	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+		s.wg.Add(1)
+		go s.syncLoop(s.stop)
+	}
+	return nil
+}
+
+func (s *Sender) maxSize() int64 {
+	if s.MaxSize == 0 {
+		return DefaultMaxSize
+	}
+	return s.MaxSize
+}
+
+// rotate makes sure that the current file is open and has room for n bytes
+func (s *Sender) rotate(n int64) error {
+	t := now()
+	name := strftime(s.Path, t)
+	if s.f != nil {
+		switch {
+		case name != s.name:
+			s.closeFile(true)
+		case s.maxSize() > 0 && s.size > 0 && s.size+n > s.maxSize(),
+			s.RotateInterval > 0 && t.Sub(s.opened) >= time.Duration(s.RotateInterval)*time.Millisecond:
+			s.closeFile(false)
+		}
+	}
+	if s.f != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return errors.Wrap(err, "creating directory")
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening file")
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "opening file")
+	}
+	s.f, s.name, s.size, s.opened = f, name, stat.Size(), t
+	return nil
+}
+
+// nextFree returns name.N with N following the numbers of rotated files
+func nextFree(name string) string {
+	last := 0
+	rotated, _ := filepath.Glob(globPattern(name) + ".*")
+	for _, r := range rotated {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(r, name+"."), ".gz")
+		if n, err := strconv.Atoi(suffix); err == nil && n > last {
+			last = n
+		}
+	}
+	return fmt.Sprintf("%s.%d", name, last+1)
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// closeFile closes the current file. The file keeps its name if keepName
+// is set, otherwise it is renamed to the next free name.N. Compression and
+// removal of old files run in background.
+func (s *Sender) closeFile(keepName bool) {
+	if s.dirty && s.SyncInterval >= 0 {
+		s.f.Sync()
+	}
+	if err := s.f.Close(); err != nil {
+		log.Printf("file: closing %s: %v", s.name, err)
+	}
+	path := s.name
+	if !keepName || (s.Compress && exists(path+".gz")) {
+		path = nextFree(s.name)
+		if err := os.Rename(s.name, path); err != nil {
+			log.Printf("file: rotating %s: %v", s.name, err)
+			path = s.name
+		}
+	}
+	s.f, s.dirty = nil, false
+	active := s.name
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.cleanMu.Lock()
+		defer s.cleanMu.Unlock()
+		if s.Compress {
+			if err := compress(path); err != nil {
+				log.Printf("file: compressing %s: %v", path, err)
+			}
+		}
+		s.cleanup(active)
+	}()
+}
+
+// compress replaces file with its gzipped copy
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// cleanup removes the oldest closed files exceeding MaxFiles, active file
+// is never removed
+func (s *Sender) cleanup(active string) {
+	if s.MaxFiles <= 0 {
+		return
+	}
+	names, err := filepath.Glob(globPattern(s.Path) + "*")
+	if err != nil {
+		log.Printf("file: %v", err)
+		return
+	}
+	type file struct {
+		name    string
+		modTime time.Time
+	}
+	var files []file
+	for _, name := range names {
+		if name == active || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+		stat, err := os.Stat(name)
+		if err != nil || stat.IsDir() {
+			continue
+		}
+		files = append(files, file{name, stat.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].modTime.Equal(files[j].modTime) {
+			return files[i].name < files[j].name
+		}
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for len(files) > s.MaxFiles {
+		if err := os.Remove(files[0].name); err != nil {
+			log.Printf("file: %v", err)
+		}
+		files = files[1:]
+	}
+}
+
+// syncLoop flushes written data to disk periodically
+func (s *Sender) syncLoop(stop chan struct{}) {
+	defer s.wg.Done()
+	interval := s.SyncInterval
+	if interval == 0 {
+		interval = DefaultSyncInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if s.f != nil && s.dirty {
+			if err := s.f.Sync(); err != nil {
+				log.Printf("file: syncing %s: %v", s.name, err)
+			}
+			s.dirty = false
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Close flushes and closes the current file, waiting for compression of
+// rotated files
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	var err error
+	if s.f != nil {
+		if s.SyncInterval >= 0 {
+			err = s.f.Sync()
+		}
+		if cerr := s.f.Close(); err == nil {
+			err = cerr
+		}
+		s.f = nil
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Wrap(err, "closing file")
+}
@@ -0,0 +1,125 @@
+package file
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	if res := strftime("app-%Y%m%d-%H%M%S-%y-%j-%%-%q.log", ts); res != "app-20190304-050607-19-063-%-%q.log" {
+		t.Errorf("unexpected result %s", res)
+	}
+	if res := globPattern("/var/log/app[1]-%Y%m%d-%%.log"); res != `/var/log/app\[1]-*-%.log` {
+		t.Errorf("unexpected glob %s", res)
+	}
+}
+
+func listDir(t *testing.T, dir string) (res []string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		res = append(res, f.Name())
+	}
+	sort.Strings(res)
+	return
+}
+
+func readFile(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !strings.HasSuffix(name, ".gz") {
+		data, _ := ioutil.ReadAll(f)
+		return string(data)
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSender_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grayproxy-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.Local)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+	s := &Sender{Path: filepath.Join(dir, "logs", "app-%Y%m%d.ndjson"), MaxSize: 30, Compress: true}
+	for _, msg := range []string{"{\n  \"a\": 1\n}", `{"b":2}`, `{"c":3}`, `{"d":4}`} {
+		if err := s.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Send([]byte("not json")); err == nil || !err.(permanentError).Permanent() {
+		t.Errorf("permanent error expected: %v", err)
+	}
+	ts = ts.Add(24 * time.Hour)
+	if err := s.Send([]byte(`{"e":5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logs := filepath.Join(dir, "logs")
+	expected := []string{"app-20190304.ndjson.1.gz", "app-20190304.ndjson.gz", "app-20190305.ndjson"}
+	if files := listDir(t, logs); strings.Join(files, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected files %v", files)
+	}
+	for name, content := range map[string]string{
+		"app-20190304.ndjson.1.gz": "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n",
+		"app-20190304.ndjson.gz":   "{\"d\":4}\n",
+		"app-20190305.ndjson":      "{\"e\":5}\n",
+	} {
+		if res := readFile(t, filepath.Join(logs, name)); res != content {
+			t.Errorf("unexpected content of %s: %q", name, res)
+		}
+	}
+}
+
+func TestSender_Retention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grayproxy-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ts := time.Date(2019, 3, 4, 5, 6, 7, 0, time.Local)
+	now = func() time.Time { return ts }
+	defer func() { now = time.Now }()
+	s := &Sender{Path: filepath.Join(dir, "app-%H.log"), RotateInterval: 60000, MaxFiles: 2, SyncInterval: -1}
+	for i := 0; i < 5; i++ {
+		if err := s.Send([]byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+		ts = ts.Add(time.Minute)
+		// wait for removal of old files, so that modification times
+		// differ
+		s.wg.Wait()
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"app-05.log", "app-05.log.3", "app-05.log.4"}
+	if files := listDir(t, dir); strings.Join(files, " ") != strings.Join(expected, " ") {
+		t.Fatalf("unexpected files %v", files)
+	}
+}
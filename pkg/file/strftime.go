@@ -0,0 +1,71 @@
+package file
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// strftime formats time according to pattern with strftime conversions %Y,
+// %y, %m, %d, %j, %H, %M, %S, %s and %%. Other conversions are kept as is.
+func strftime(pattern string, t time.Time) string {
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i == len(pattern)-1 {
+			buf.WriteByte(c)
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			buf.WriteString(t.Format("2006"))
+		case 'y':
+			buf.WriteString(t.Format("06"))
+		case 'm':
+			buf.WriteString(t.Format("01"))
+		case 'd':
+			buf.WriteString(t.Format("02"))
+		case 'j':
+			buf.WriteString(t.Format("002"))
+		case 'H':
+			buf.WriteString(t.Format("15"))
+		case 'M':
+			buf.WriteString(t.Format("04"))
+		case 'S':
+			buf.WriteString(t.Format("05"))
+		case 's':
+			buf.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(pattern[i])
+		}
+	}
+	return buf.String()
+}
+
+// globPattern converts strftime pattern to glob matching files created with
+// it
+func globPattern(pattern string) string {
+	var buf strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '%' && i < len(pattern)-1 && pattern[i+1] == '%':
+			buf.WriteByte('%')
+			i++
+		case c == '%' && i < len(pattern)-1:
+			if !strings.HasSuffix(buf.String(), "*") {
+				buf.WriteByte('*')
+			}
+			i++
+		case strings.IndexByte(`*?[\`, c) >= 0:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
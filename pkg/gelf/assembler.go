@@ -3,6 +3,8 @@ package gelf
 import (
 	"bytes"
 	"time"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
 )
 
 // Assembler provides GELF message de-chunking
@@ -39,18 +41,26 @@ func (a *Assembler) Update(chunk Chunk) bool {
 	if a.fullMsg == nil {
 		a.fullMsg = make([][]byte, count)
 	}
-	if count != len(a.fullMsg) || num >= count {
+	if count != len(a.fullMsg) || num >= count || a.fullMsg[num] != nil {
+		metrics.GELFChunks.WithLabelValues("dropped").Inc()
 		return false
 	}
 	body := chunk.Body()
-
-	if a.fullMsg[num] == nil {
-		a.totalBytes += len(body)
-		if a.maxMessageSize > 0 && a.totalBytes > a.maxMessageSize {
-			return false
-		}
-		a.fullMsg[num] = body
-		a.processed++
+	a.totalBytes += len(body)
+	if a.maxMessageSize > 0 && a.totalBytes > a.maxMessageSize {
+		metrics.GELFChunks.WithLabelValues("dropped").Inc()
+		return false
 	}
-	return a.processed == len(a.fullMsg)
+	a.fullMsg[num] = body
+	a.processed++
+	if a.processed < len(a.fullMsg) {
+		return false
+	}
+	metrics.GELFChunks.WithLabelValues("assembled").Add(float64(a.processed))
+	return true
+}
+
+// Pending returns the number of chunks received for incomplete message
+func (a *Assembler) Pending() int {
+	return a.processed
 }
@@ -0,0 +1,99 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxChunks is the maximum number of chunks in a GELF message
+	MaxChunks = 128
+	// DefaultChunkSize fits a chunk into a datagram on most networks
+	DefaultChunkSize = 1420
+
+	chunkHeaderSize = 12
+)
+
+// Compression methods of outgoing messages
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+	CompressZlib = "zlib"
+)
+
+// ChunkLimitError is returned for messages that need more than MaxChunks
+// chunks. Resending such message does not help.
+type ChunkLimitError struct {
+	Chunks int
+}
+
+func (e *ChunkLimitError) Error() string {
+	return fmt.Sprintf("message needs %d chunks, at most %d are allowed", e.Chunks, MaxChunks)
+}
+
+// Permanent returns true, as message size does not change between attempts
+func (e *ChunkLimitError) Permanent() bool {
+	return true
+}
+
+// Compress compresses data with method, empty method means no compression
+func Compress(data []byte, method string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch method {
+	case "", CompressNone:
+		return data, nil
+	case CompressGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressZlib:
+		w = zlib.NewWriter(&buf)
+	default:
+		return nil, errors.Errorf("unknown compression %q", method)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, errors.Wrap(err, "compressing message")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "compressing message")
+	}
+	return buf.Bytes(), nil
+}
+
+// Split splits message into chunks of at most chunkSize bytes, including
+// header. Message that fits into a single chunk is returned as is.
+func Split(data []byte, chunkSize int) ([]Chunk, error) {
+	if len(data) <= chunkSize {
+		return []Chunk{data}, nil
+	}
+	bodySize := chunkSize - chunkHeaderSize
+	if bodySize <= 0 {
+		return nil, errors.Errorf("chunk size %d is too small", chunkSize)
+	}
+	count := (len(data) + bodySize - 1) / bodySize
+	if count > MaxChunks {
+		return nil, &ChunkLimitError{Chunks: count}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, errors.Wrap(err, "generating message ID")
+	}
+	res := make([]Chunk, 0, count)
+	for i := 0; i < count; i++ {
+		body := data[i*bodySize:]
+		if len(body) > bodySize {
+			body = body[:bodySize]
+		}
+		chunk := make(Chunk, 0, chunkHeaderSize+len(body))
+		chunk = append(chunk, gelfMagic...)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		res = append(res, append(chunk, body...))
+	}
+	return res, nil
+}
@@ -0,0 +1,57 @@
+package gelf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSplit_Roundtrip(t *testing.T) {
+	msg := bytes.Repeat([]byte(`{"short_message":"0123456789"}`), 100)
+	for _, method := range []string{CompressNone, CompressGzip, CompressZlib} {
+		data, err := Compress(msg, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := Split(data, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method == CompressNone && len(res) != 35 {
+			t.Errorf("unexpected number of chunks %d", len(res))
+		}
+		chunks := make(chan Chunk, len(res))
+		// chunks may arrive in any order
+		for i := len(res) - 1; i >= 0; i-- {
+			if len(res[i]) > 100 {
+				t.Errorf("chunk %d is too large: %d", i, len(res[i]))
+			}
+			chunks <- res[i]
+		}
+		close(chunks)
+		var decoded [][]byte
+		for msg := range Extract(Assemble(chunks, 0, time.Second), 1<<20) {
+			decoded = append(decoded, msg)
+		}
+		if len(decoded) != 1 || !bytes.Equal(decoded[0], msg) {
+			t.Errorf("%s: message is not restored: %q", method, decoded)
+		}
+	}
+}
+
+func TestSplit_Small(t *testing.T) {
+	res, err := Split([]byte("{}"), 10)
+	if err != nil || len(res) != 1 || string(res[0]) != "{}" {
+		t.Errorf("small message should be sent as is: %q %v", res, err)
+	}
+}
+
+func TestSplit_Limit(t *testing.T) {
+	_, err := Split(make([]byte, 88*MaxChunks+1), 100)
+	if e, ok := err.(*ChunkLimitError); !ok || !e.Permanent() || e.Chunks != MaxChunks+1 {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := Split(make([]byte, 88*MaxChunks), 100); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,8 @@ package gelf
 
 import (
 	"time"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
 )
 
 const periodicCleanup = 5 * time.Second
@@ -13,6 +15,13 @@ func Assemble(chunks <-chan Chunk, maxMessageSize int, assembleTimeout time.Dura
 	go func() {
 		defer close(encodedMsgs)
 		assemblers := make(map[string]*Assembler)
+		// incomplete messages are removed soon after they expire
+		period := periodicCleanup
+		if assembleTimeout > 0 && assembleTimeout < period {
+			period = assembleTimeout
+		}
+		cleanup := time.NewTicker(period)
+		defer cleanup.Stop()
 		for {
 			select {
 			case chunk, ok := <-chunks:
@@ -33,9 +42,10 @@ func Assemble(chunks <-chan Chunk, maxMessageSize int, assembleTimeout time.Dura
 					delete(assemblers, cid)
 				}
 				encodedMsgs <- chunk
-			case <-time.After(periodicCleanup):
+			case <-cleanup.C:
 				for k, v := range assemblers {
 					if v.Expired() {
+						metrics.GELFChunks.WithLabelValues("expired").Add(float64(v.Pending()))
 						delete(assemblers, k)
 					}
 				}
@@ -53,6 +63,7 @@ func Extract(encodedMsgs <-chan Chunk, decompressSizeLimit int) <-chan []byte {
 		for msg := range encodedMsgs {
 			data, err := msg.Data(decompressSizeLimit)
 			if err != nil {
+				metrics.DecompressFailures.Inc()
 				continue
 			}
 			messages <- data
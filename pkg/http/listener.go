@@ -1,26 +1,337 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
-	web "github.com/go-mixins/http"
+	"github.com/pkg/errors"
 
+	"github.com/andviro/grayproxy/pkg/auth"
 	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/limit"
 )
 
+const (
+	// DefaultMaxBodySize is used if Listener.MaxBodySize is zero
+	DefaultMaxBodySize = 1 << 20
+	// DefaultEnqueueTimeout is used if Listener.EnqueueTimeout is zero
+	DefaultEnqueueTimeout = 1000
+)
+
+// Listener accepts GELF messages posted to /gelf (or /) one per request, and
+// batches of messages posted to /gelf/batch as NDJSON or JSON array. Request
+// bodies may be compressed with gzip or deflate Content-Encoding. Accepted
+// messages are answered with 202 status.
 type Listener struct {
-	web.Server
+	Address string
+	// StopTimeout is the time in milliseconds Close waits for active
+	// requests to complete
+	StopTimeout int
+	// TLSConfig enables HTTPS
+	TLSConfig *tls.Config
+	// MaxBodySize limits decompressed request body in bytes, larger
+	// requests are rejected with 413 status. Zero means default, negative
+	// value disables the limit.
+	MaxBodySize int
+	// EnqueueTimeout is the time in milliseconds to wait for the pipeline to
+	// accept messages before responding with 503 status. Zero means default,
+	// negative value disables the timeout.
+	EnqueueTimeout int
+	// Auth rejects unauthenticated requests with 401 status and tags
+	// accepted messages with client identity
+	Auth *auth.Authenticator
+	// Filter rejects requests from denied addresses with 403 status and
+	// limits message rate of clients, dropped requests are answered with 429
+	// status
+	Filter *limit.Filter
+
+	mu      sync.Mutex
+	srv     *http.Server
+	closed  bool
+	stopped chan struct{}
 }
 
 func (l *Listener) Listen(dest chan<- gelf.Chunk) (err error) {
-	err = l.Serve(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer r.Body.Close()
-		data, err := ioutil.ReadAll(r.Body)
+	lis, err := net.Listen("tcp", l.Address)
+	if err != nil {
+		return errors.Wrap(err, "setting up HTTP listener")
+	}
+	if l.TLSConfig != nil {
+		lis = tls.NewListener(lis, l.TLSConfig)
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return lis.Close()
+	}
+	l.stopped = make(chan struct{})
+	srv := &http.Server{Handler: &handler{l: l, dest: dest, stopped: l.stopped}}
+	l.srv = srv
+	l.mu.Unlock()
+	if err = srv.Serve(lis); err == http.ErrServerClosed {
+		<-l.stopped
+		return nil
+	}
+	return errors.Wrap(err, "serving HTTP")
+}
+
+// Close stops the listener waiting up to StopTimeout for active requests
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	if l.srv == nil {
+		return nil
+	}
+	defer close(l.stopped)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(l.StopTimeout)*time.Millisecond)
+	defer cancel()
+	return l.srv.Shutdown(ctx)
+}
+
+type handler struct {
+	l    *Listener
+	dest chan<- gelf.Chunk
+	// stopped is closed when messages are no longer read from dest
+	stopped <-chan struct{}
+}
+
+// statusError is an error reported to client with HTTP status
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+func newStatusError(status int, format string, args ...interface{}) error {
+	return &statusError{status: status, msg: fmt.Sprintf(format, args...)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var batch bool
+	switch r.URL.Path {
+	case "/", "/gelf":
+	case "/gelf/batch":
+		batch = true
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.l.Filter != nil && !h.l.Filter.Allowed(remoteAddr(r.RemoteAddr)) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	data, identity, err := h.readBody(w, r)
+	var msgs [][]byte
+	switch {
+	case err != nil:
+	case batch:
+		msgs, err = splitBatch(data)
+	case !json.Valid(data):
+		err = newStatusError(http.StatusBadRequest, "message is not valid JSON")
+	default:
+		msgs = [][]byte{data}
+	}
+	if err == nil && h.l.Auth != nil {
+		msgs, err = tag(msgs, func(msg []byte) ([]byte, error) { return auth.Tag(msg, identity) })
+	}
+	if err == nil && h.l.Filter != nil {
+		err = h.limit(r, msgs)
+	}
+	if err == nil {
+		err = h.enqueue(msgs)
+	}
+	if se, ok := err.(*statusError); ok {
+		switch se.status {
+		case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+			w.Header().Set("Retry-After", "1")
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="grayproxy"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="grayproxy"`)
+		}
+		http.Error(w, se.msg, se.status)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (l *Listener) maxBodySize() int {
+	if l.MaxBodySize == 0 {
+		return DefaultMaxBodySize
+	}
+	return l.MaxBodySize
+}
+
+// readBody reads request body, authenticates the request and decompresses
+// the body
+func (h *handler) readBody(w http.ResponseWriter, r *http.Request) (data []byte, identity string, err error) {
+	limit := h.l.maxBodySize()
+	var body io.Reader = r.Body
+	if limit > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", readError(err)
+	}
+	if h.l.Auth != nil {
+		if identity, err = h.l.Auth.HTTP(r, raw); err != nil {
+			return nil, "", newStatusError(http.StatusUnauthorized, "%v", err)
+		}
+	}
+	body = bytes.NewReader(raw)
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, "", readError(err)
+		}
+		defer zr.Close()
+		body = zr
+	case "deflate":
+		// deflate is zlib format, but some clients send raw deflate data
+		br := bufio.NewReader(body)
+		if header, err := br.Peek(2); err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, "", readError(err)
+			}
+			defer zr.Close()
+			body = zr
+		} else {
+			fr := flate.NewReader(br)
+			defer fr.Close()
+			body = fr
+		}
+	default:
+		return nil, "", newStatusError(http.StatusUnsupportedMediaType, "unsupported content encoding %q", enc)
+	}
+	if limit > 0 {
+		body = io.LimitReader(body, int64(limit)+1)
+	}
+	if data, err = ioutil.ReadAll(body); err != nil {
+		return nil, "", readError(err)
+	}
+	if limit > 0 && len(data) > limit {
+		return nil, "", newStatusError(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", limit)
+	}
+	return bytes.TrimSpace(data), identity, nil
+}
+
+func readError(err error) error {
+	if mbe, ok := err.(*http.MaxBytesError); ok {
+		return newStatusError(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", mbe.Limit)
+	}
+	return newStatusError(http.StatusBadRequest, "reading request: %v", err)
+}
+
+// splitBatch splits JSON array or newline delimited JSON into messages
+func splitBatch(data []byte) (res [][]byte, err error) {
+	if len(data) > 0 && data[0] == '[' {
+		var msgs []json.RawMessage
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return nil, newStatusError(http.StatusBadRequest, "invalid JSON array: %v", err)
+		}
+		for _, msg := range msgs {
+			res = append(res, msg)
+		}
+	} else {
+		for i, line := range bytes.Split(data, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) == 0 {
+				continue
+			}
+			if !json.Valid(line) {
+				return nil, newStatusError(http.StatusBadRequest, "line %d is not valid JSON", i+1)
+			}
+			res = append(res, line)
+		}
+	}
+	if len(res) == 0 {
+		return nil, newStatusError(http.StatusBadRequest, "empty batch")
+	}
+	return res, nil
+}
+
+// remoteAddr is the client address of HTTP request
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// limit applies rate limit to messages of the request, tagging them if
+// needed
+func (h *handler) limit(r *http.Request, msgs [][]byte) error {
+	tagged, ok := h.l.Filter.Limit(remoteAddr(r.RemoteAddr), len(msgs))
+	if !ok {
+		return newStatusError(http.StatusTooManyRequests, "rate limit exceeded")
+	}
+	if tagged {
+		_, err := tag(msgs, limit.Tag)
+		return err
+	}
+	return nil
+}
+
+// tag applies fn to each message
+func tag(msgs [][]byte, fn func([]byte) ([]byte, error)) ([][]byte, error) {
+	for i, msg := range msgs {
+		tagged, err := fn(msg)
 		if err != nil {
-			http.Error(w, err.Error(), 400)
+			return nil, newStatusError(http.StatusBadRequest, "message %d: %v", i+1, err)
+		}
+		msgs[i] = tagged
+	}
+	return msgs, nil
+}
+
+// enqueue passes messages to the pipeline. If the pipeline does not accept
+// them in EnqueueTimeout, the rest of messages is rejected.
+func (h *handler) enqueue(msgs [][]byte) error {
+	var timeout <-chan time.Time
+	t := h.l.EnqueueTimeout
+	if t == 0 {
+		t = DefaultEnqueueTimeout
+	}
+	if t > 0 {
+		timer := time.NewTimer(time.Duration(t) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for i, msg := range msgs {
+		select {
+		case h.dest <- msg:
+		case <-timeout:
+			return newStatusError(http.StatusServiceUnavailable, "pipeline is saturated, %d of %d message(s) accepted", i, len(msgs))
+		case <-h.stopped:
+			return newStatusError(http.StatusServiceUnavailable, "input is stopping, %d of %d message(s) accepted", i, len(msgs))
 		}
-		dest <- data
-	}))
-	return
+	}
+	return nil
 }
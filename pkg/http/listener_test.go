@@ -0,0 +1,223 @@
+package http_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/auth"
+	"github.com/andviro/grayproxy/pkg/gelf"
+	grayhttp "github.com/andviro/grayproxy/pkg/http"
+	"github.com/andviro/grayproxy/pkg/limit"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func post(t *testing.T, url, encoding string, body []byte) *http.Response {
+	return postWith(t, url, body, func(req *http.Request) {
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+	})
+}
+
+func postWith(t *testing.T, url string, body []byte, prepare func(*http.Request)) *http.Response {
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prepare(req)
+		if resp, err = http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			return resp
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("could not post to %s", url)
+	return nil
+}
+
+func gzipped(data string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func zlibbed(data string) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(data))
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestListener_Requests(t *testing.T) {
+	l := &grayhttp.Listener{Address: freeAddress(t), MaxBodySize: 64}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+	defer l.Close()
+	base := "http://" + l.Address
+	for _, tc := range []struct {
+		path, encoding string
+		body           []byte
+		status         int
+		msgs           []string
+	}{
+		{"/gelf", "", []byte(` {"a":1} `), http.StatusAccepted, []string{`{"a":1}`}},
+		{"/", "gzip", gzipped(`{"b":2}`), http.StatusAccepted, []string{`{"b":2}`}},
+		{"/gelf", "deflate", zlibbed(`{"c":3}`), http.StatusAccepted, []string{`{"c":3}`}},
+		{"/gelf", "br", []byte(`{}`), http.StatusUnsupportedMediaType, nil},
+		{"/gelf", "", []byte(`{"a":`), http.StatusBadRequest, nil},
+		{"/gelf", "", []byte(`{"a":"` + strings.Repeat("x", 64) + `"}`), http.StatusRequestEntityTooLarge, nil},
+		{"/gelf", "gzip", gzipped(`{"a":"` + strings.Repeat("x", 64) + `"}`), http.StatusRequestEntityTooLarge, nil},
+		{"/gelf/batch", "", []byte("{\"a\":1}\n\n{\"b\":2}\n"), http.StatusAccepted, []string{`{"a":1}`, `{"b":2}`}},
+		{"/gelf/batch", "", []byte(`[{"a":1}, {"b":2}]`), http.StatusAccepted, []string{`{"a":1}`, `{"b":2}`}},
+		{"/gelf/batch", "", []byte("{\"a\":1}\nnot json\n"), http.StatusBadRequest, nil},
+		{"/other", "", []byte(`{}`), http.StatusNotFound, nil},
+	} {
+		resp := post(t, base+tc.path, tc.encoding, tc.body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s %s: unexpected status %d", tc.path, tc.body, resp.StatusCode)
+		}
+		for _, expected := range tc.msgs {
+			select {
+			case msg := <-dest:
+				if string(msg) != expected {
+					t.Errorf("%s: unexpected message %s", tc.path, msg)
+				}
+			default:
+				t.Errorf("%s: message %s was not received", tc.path, expected)
+			}
+		}
+		if len(dest) > 0 {
+			t.Errorf("%s %s: unexpected message %s", tc.path, tc.body, <-dest)
+		}
+	}
+	resp, err := http.Get(base + "/gelf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
+
+func TestListener_Saturated(t *testing.T) {
+	l := &grayhttp.Listener{Address: freeAddress(t), EnqueueTimeout: 50}
+	dest := make(chan gelf.Chunk, 1)
+	go l.Listen(dest)
+	defer l.Close()
+	resp := post(t, "http://"+l.Address+"/gelf/batch", "", []byte(`[{"a":1},{"b":2}]`))
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if msg := <-dest; string(msg) != `{"a":1}` {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
+
+func TestListener_Auth(t *testing.T) {
+	l := &grayhttp.Listener{Address: freeAddress(t), Auth: &auth.Authenticator{
+		Tokens:   map[string]string{"s3cr3t": "app"},
+		Users:    map[string]string{"alice": "pass"},
+		HMACKeys: map[string]string{"key1": "secret"},
+	}}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+	defer l.Close()
+	body := gzipped(`{"a":1,"_source_token":"forged"}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, tc := range []struct {
+		name     string
+		prepare  func(*http.Request)
+		status   int
+		identity string
+	}{
+		{"none", func(*http.Request) {}, http.StatusUnauthorized, ""},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cr3t") }, http.StatusAccepted, "app"},
+		{"bad bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized, ""},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "pass") }, http.StatusAccepted, "alice"},
+		{"bad basic", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized, ""},
+		{"hmac", func(r *http.Request) {
+			r.Header.Set(auth.KeyIDHeader, "key1")
+			r.Header.Set(auth.TimestampHeader, ts)
+			r.Header.Set(auth.SignatureHeader, hex.EncodeToString(auth.Sign("secret", ts, body)))
+		}, http.StatusAccepted, "key1"},
+		{"bad hmac", func(r *http.Request) {
+			r.Header.Set(auth.KeyIDHeader, "key1")
+			r.Header.Set(auth.TimestampHeader, ts)
+			r.Header.Set(auth.SignatureHeader, hex.EncodeToString(auth.Sign("wrong", ts, body)))
+		}, http.StatusUnauthorized, ""},
+	} {
+		resp := postWith(t, "http://"+l.Address+"/gelf", body, func(r *http.Request) {
+			r.Header.Set("Content-Encoding", "gzip")
+			tc.prepare(r)
+		})
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: unexpected status %d", tc.name, resp.StatusCode)
+		}
+		if tc.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: WWW-Authenticate header is missing", tc.name)
+		}
+		if tc.identity == "" {
+			if len(dest) > 0 {
+				t.Errorf("%s: unexpected message %s", tc.name, <-dest)
+			}
+			continue
+		}
+		if msg, expected := string(<-dest), `{"_source_token":"`+tc.identity+`","a":1}`; msg != expected {
+			t.Errorf("%s: unexpected message %s", tc.name, msg)
+		}
+	}
+}
+
+func TestListener_Filter(t *testing.T) {
+	l := &grayhttp.Listener{Address: freeAddress(t), Filter: &limit.Filter{Rate: 1, Burst: 2}}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+	defer l.Close()
+	if resp := post(t, "http://"+l.Address+"/gelf/batch", "", []byte(`[{"a":1},{"b":2}]`)); resp.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	resp := post(t, "http://"+l.Address+"/gelf", "", []byte(`{"c":3}`))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	if len(dest) != 2 {
+		t.Errorf("unexpected number of messages %d", len(dest))
+	}
+	l.Filter.Action = limit.ActionTag
+	post(t, "http://"+l.Address+"/gelf", "", []byte(`{"c":3}`))
+	<-dest
+	<-dest
+	if msg := <-dest; string(msg) != `{"_rate_limited":true,"c":3}` {
+		t.Errorf("unexpected message %s", msg)
+	}
+
+	allow, _ := limit.ParseNetworks([]string{"10.0.0.0/8"})
+	denied := &grayhttp.Listener{Address: freeAddress(t), Filter: &limit.Filter{Allow: allow}}
+	go denied.Listen(dest)
+	defer denied.Close()
+	if resp := post(t, "http://"+denied.Address+"/gelf", "", []byte(`{}`)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
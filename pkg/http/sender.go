@@ -2,6 +2,7 @@ package http
 
 import (
 	"bytes"
+	"crypto/tls"
 	"net/http"
 	"time"
 
@@ -11,6 +12,24 @@ import (
 type Sender struct {
 	Address     string
 	SendTimeout int
+	// TLSConfig is used for HTTPS connections instead of the default one
+	TLSConfig *tls.Config
+
+	client *http.Client
+}
+
+func (s *Sender) httpClient() *http.Client {
+	if s.client == nil {
+		s.client = &http.Client{
+			Timeout: time.Duration(s.SendTimeout) * time.Millisecond,
+		}
+		if s.TLSConfig != nil {
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.TLSClientConfig = s.TLSConfig
+			s.client.Transport = tr
+		}
+	}
+	return s.client
 }
 
 func (s *Sender) Send(data []byte) (err error) {
@@ -19,10 +38,7 @@ func (s *Sender) Send(data []byte) (err error) {
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{
-		Timeout: time.Duration(s.SendTimeout) * time.Millisecond,
-	}
-	resp, err := client.Do(req)
+	resp, err := s.httpClient().Do(req)
 	if err != nil {
 		return
 	}
@@ -32,3 +48,11 @@ func (s *Sender) Send(data []byte) (err error) {
 	}
 	return
 }
+
+// Close closes idle connections of the sender, if it has its own transport
+func (s *Sender) Close() error {
+	if s.client != nil && s.client.Transport != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// maxResponseSize protects against reading garbage as response length
+const maxResponseSize = 100 << 20
+
+// broker is a connection to a single broker
+type broker struct {
+	addr    string
+	conn    net.Conn
+	timeout time.Duration
+	client  string
+	corr    int32
+}
+
+// dial connects to broker and authenticates with SASL/PLAIN if username is
+// set
+func (s *Sender) dial(addr string) (*broker, error) {
+	timeout := time.Duration(s.SendTimeout) * time.Millisecond
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if s.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to %s", addr)
+	}
+	b := &broker{addr: addr, conn: conn, timeout: timeout, client: s.clientID()}
+	if s.Username != "" {
+		if err := b.authenticate(s.Username, s.Password); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "authenticating at %s", addr)
+		}
+	}
+	return b, nil
+}
+
+// request sends request and returns the response body following its
+// header. No response is read if wait is false.
+func (b *broker) request(apiKey, version int16, body []byte, wait bool) ([]byte, error) {
+	b.corr++
+	var req encoder
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(b.corr)
+	req.string(b.client)
+	req.Write(body)
+	data := req.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	if b.timeout > 0 {
+		b.conn.SetDeadline(time.Now().Add(b.timeout))
+	}
+	if _, err := b.conn.Write(data); err != nil {
+		return nil, errors.Wrapf(err, "writing to %s", b.addr)
+	}
+	if !wait {
+		return nil, nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(b.conn, size[:]); err != nil {
+		return nil, errors.Wrapf(err, "reading from %s", b.addr)
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseSize {
+		return nil, errors.Errorf("invalid response size %d from %s", n, b.addr)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(b.conn, resp); err != nil {
+		return nil, errors.Wrapf(err, "reading from %s", b.addr)
+	}
+	if corr := int32(binary.BigEndian.Uint32(resp)); corr != b.corr {
+		return nil, errors.Errorf("unexpected correlation id %d from %s, expected %d", corr, b.addr, b.corr)
+	}
+	return resp[4:], nil
+}
+
+// authenticate performs SASL/PLAIN authentication
+func (b *broker) authenticate(username, password string) error {
+	var req encoder
+	req.string("PLAIN")
+	resp, err := b.request(apiSaslHandshake, saslHandshakeVersion, req.Bytes(), true)
+	if err != nil {
+		return err
+	}
+	d := &decoder{data: resp}
+	code := d.int16()
+	var mechanisms []string
+	for i := d.arrayLen(); i > 0; i-- {
+		mechanisms = append(mechanisms, d.string())
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if code != errNone {
+		return errors.Wrapf(kafkaError(code), "PLAIN mechanism is not enabled, broker supports %v", mechanisms)
+	}
+	req.Reset()
+	req.bytes([]byte("\x00" + username + "\x00" + password))
+	if resp, err = b.request(apiSaslAuthenticate, saslAuthenticateVersion, req.Bytes(), true); err != nil {
+		return err
+	}
+	d = &decoder{data: resp}
+	code = d.int16()
+	msg := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if code != errNone {
+		return errors.Wrap(kafkaError(code), msg)
+	}
+	return nil
+}
+
+func (b *broker) Close() error {
+	return b.conn.Close()
+}
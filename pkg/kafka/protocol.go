@@ -0,0 +1,232 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// API keys and versions of requests used by the producer
+const (
+	apiProduce          = 0
+	apiMetadata         = 3
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+
+	produceVersion          = 3
+	metadataVersion         = 1
+	saslHandshakeVersion    = 1
+	saslAuthenticateVersion = 0
+)
+
+// Error codes of Kafka protocol
+const (
+	errNone                         = 0
+	errUnknownTopicOrPartition      = 3
+	errLeaderNotAvailable           = 5
+	errNotLeaderForPartition        = 6
+	errRequestTimedOut              = 7
+	errMessageTooLarge              = 10
+	errNetworkException             = 13
+	errNotEnoughReplicas            = 19
+	errNotEnoughReplicasAfterAppend = 20
+	errSaslAuthenticationFailed     = 58
+	errKafkaStorageError            = 56
+)
+
+var errorNames = map[int16]string{
+	1:                               "OFFSET_OUT_OF_RANGE",
+	2:                               "CORRUPT_MESSAGE",
+	errUnknownTopicOrPartition:      "UNKNOWN_TOPIC_OR_PARTITION",
+	4:                               "INVALID_FETCH_SIZE",
+	errLeaderNotAvailable:           "LEADER_NOT_AVAILABLE",
+	errNotLeaderForPartition:        "NOT_LEADER_OR_FOLLOWER",
+	errRequestTimedOut:              "REQUEST_TIMED_OUT",
+	errMessageTooLarge:              "MESSAGE_TOO_LARGE",
+	errNetworkException:             "NETWORK_EXCEPTION",
+	17:                              "INVALID_TOPIC_EXCEPTION",
+	18:                              "RECORD_LIST_TOO_LARGE",
+	errNotEnoughReplicas:            "NOT_ENOUGH_REPLICAS",
+	errNotEnoughReplicasAfterAppend: "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	21:                              "INVALID_REQUIRED_ACKS",
+	29:                              "TOPIC_AUTHORIZATION_FAILED",
+	33:                              "UNSUPPORTED_SASL_MECHANISM",
+	34:                              "ILLEGAL_SASL_STATE",
+	35:                              "UNSUPPORTED_VERSION",
+	errKafkaStorageError:            "KAFKA_STORAGE_ERROR",
+	errSaslAuthenticationFailed:     "SASL_AUTHENTICATION_FAILED",
+	76:                              "UNSUPPORTED_COMPRESSION_TYPE",
+	87:                              "INVALID_RECORD",
+}
+
+// kafkaError is an error code returned by broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	if name, ok := errorNames[int16(e)]; ok {
+		return fmt.Sprintf("kafka error %d (%s)", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// retriable returns true if the request may succeed after metadata refresh
+func (e kafkaError) retriable() bool {
+	switch e {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderForPartition, errRequestTimedOut,
+		errNetworkException, errNotEnoughReplicas, errNotEnoughReplicasAfterAppend, errKafkaStorageError:
+		return true
+	}
+	return false
+}
+
+// encoder writes primitive types of Kafka protocol in big endian order
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int8(v int8) {
+	e.WriteByte(byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	e.Write(b[:])
+}
+
+func (e *encoder) int32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	e.Write(b[:])
+}
+
+func (e *encoder) int64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+// varint writes zigzag encoded variable length integer used in records
+func (e *encoder) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+// bytes writes byte array with int32 length, nil is written as null
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) arrayLen(n int) {
+	e.int32(int32(n))
+}
+
+var errShortBuffer = errors.New("kafka: malformed response")
+
+// decoder reads primitive types of Kafka protocol. The first error stops
+// decoding, the following reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errShortBuffer
+		return nil
+	}
+	res := d.data[:n]
+	d.data = d.data[n:]
+	return res
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errShortBuffer
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// string reads string or nullable string, null is returned as empty string
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// arrayLen reads array length, null array has zero length
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.data) {
+		// every element takes at least one byte
+		d.err = errShortBuffer
+		return 0
+	}
+	return int(n)
+}
@@ -0,0 +1,147 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Compression methods of record batches
+const (
+	CompressNone = "none"
+	CompressGzip = "gzip"
+)
+
+// compression codes in record batch attributes
+const (
+	codecNone = 0
+	codecGzip = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a single message of the batch
+type record struct {
+	key, value []byte
+	ts         time.Time
+}
+
+func (r record) size() int {
+	return len(r.key) + len(r.value)
+}
+
+func millis(ts time.Time) int64 {
+	return ts.UnixNano() / int64(time.Millisecond)
+}
+
+// encodeBatch encodes records in the record batch format of message format
+// version 2
+func encodeBatch(records []record, compression string) ([]byte, error) {
+	first, max := records[0].ts, records[0].ts
+	for _, r := range records {
+		if r.ts.Before(first) {
+			first = r.ts
+		}
+		if r.ts.After(max) {
+			max = r.ts
+		}
+	}
+	var body encoder
+	for i, r := range records {
+		var rec encoder
+		rec.int8(0) // attributes
+		rec.varint(millis(r.ts) - millis(first))
+		rec.varint(int64(i))
+		if r.key == nil {
+			rec.varint(-1)
+		} else {
+			rec.varint(int64(len(r.key)))
+			rec.Write(r.key)
+		}
+		rec.varint(int64(len(r.value)))
+		rec.Write(r.value)
+		rec.varint(0) // headers
+		body.varint(int64(rec.Len()))
+		body.Write(rec.Bytes())
+	}
+	var attributes int16
+	data := body.Bytes()
+	switch compression {
+	case "", CompressNone:
+	case CompressGzip:
+		attributes = codecGzip
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, errors.Wrap(err, "compressing records")
+		}
+		if err := zw.Close(); err != nil {
+			return nil, errors.Wrap(err, "compressing records")
+		}
+		data = buf.Bytes()
+	default:
+		return nil, errors.Errorf("unknown compression %q", compression)
+	}
+
+	// the part of batch covered by CRC
+	var crcPart encoder
+	crcPart.int16(attributes)
+	crcPart.int32(int32(len(records) - 1)) // last offset delta
+	crcPart.int64(millis(first))
+	crcPart.int64(millis(max))
+	crcPart.int64(-1) // producer id
+	crcPart.int16(-1) // producer epoch
+	crcPart.int32(-1) // base sequence
+	crcPart.int32(int32(len(records)))
+	crcPart.Write(data)
+
+	var batch encoder
+	batch.int64(0)                                // base offset
+	batch.int32(int32(4 + 1 + 4 + crcPart.Len())) // batch length
+	batch.int32(-1)                               // partition leader epoch
+	batch.int8(2)                                 // magic
+	batch.int32(int32(crc32.Checksum(crcPart.Bytes(), castagnoli)))
+	batch.Write(crcPart.Bytes())
+	return batch.Bytes(), nil
+}
+
+// murmur2 is the hash of the default partitioner of Kafka Java client, so
+// that messages with the same key land in the same partition regardless of
+// the producer
+func murmur2(data []byte) int32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	i := 0
+	for ; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	switch length - i {
+	case 3:
+		h ^= uint32(data[i+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[i+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[i])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
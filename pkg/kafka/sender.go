@@ -0,0 +1,505 @@
+// Package kafka produces GELF messages to a Kafka topic. It implements the
+// subset of Kafka protocol needed by a producer: Metadata, Produce with
+// record batches and SASL/PLAIN authentication.
+package kafka
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Acknowledgement levels of produce requests
+const (
+	// AcksAll waits for all in-sync replicas
+	AcksAll = "all"
+	// AcksLeader waits for the partition leader only
+	AcksLeader = "leader"
+	// AcksNone does not wait for response
+	AcksNone = "none"
+)
+
+const (
+	defaultRetries  = 3
+	defaultClientID = "grayproxy"
+	// maxBatchBytes limits the size of records sent to a partition in one
+	// request to stay below default message.max.bytes of broker
+	maxBatchBytes = 900000
+	// recordOverhead is the approximate size of record headers
+	recordOverhead = 32
+)
+
+var (
+	// MinBackoff is the initial delay before resending failed messages
+	MinBackoff = 250 * time.Millisecond
+	// MaxBackoff limits the delay between resending attempts
+	MaxBackoff = 2 * time.Second
+)
+
+// Sender produces messages to a topic. Each message becomes the value of a
+// record, the record timestamp is the message timestamp.
+type Sender struct {
+	// Brokers are the bootstrap brokers in form host:port
+	Brokers     []string
+	Topic       string
+	SendTimeout int
+	// Key is the message field whose value becomes record key, messages
+	// with the same key are sent to the same partition. Messages without
+	// the key are spread between partitions batch by batch.
+	Key string
+	// Acks is AcksAll (default), AcksLeader or AcksNone
+	Acks string
+	// Compression is CompressNone (default) or CompressGzip
+	Compression string
+	// Username and Password enable SASL/PLAIN authentication
+	Username, Password string
+	TLSConfig          *tls.Config
+	ClientID           string
+	// Retries limits resending of messages after leader changes and other
+	// transient errors, zero means default, negative value disables retries
+	Retries int
+
+	mu    sync.Mutex
+	meta  *metadata
+	conns map[string]*broker
+	next  int
+}
+
+// PartialError is returned if some messages of the batch were not produced,
+// resending them may succeed
+type PartialError struct {
+	failed []int
+	err    error
+}
+
+func (e *PartialError) Error() string {
+	return fmt.Sprintf("%d message(s) not produced: %v", len(e.failed), e.err)
+}
+
+// Failed returns positions of messages that should be resent
+func (e *PartialError) Failed() []int {
+	return e.failed
+}
+
+// permanentError is returned if none of messages can be produced
+type permanentError struct {
+	error
+}
+
+func (permanentError) Permanent() bool {
+	return true
+}
+
+type partition struct {
+	id, leader int32
+}
+
+// metadata describes partitions of the topic and their leaders
+type metadata struct {
+	brokers    map[int32]string
+	partitions []partition
+}
+
+func (s *Sender) clientID() string {
+	if s.ClientID == "" {
+		return defaultClientID
+	}
+	return s.ClientID
+}
+
+func (s *Sender) requiredAcks() (int16, error) {
+	switch s.Acks {
+	case "", AcksAll:
+		return -1, nil
+	case AcksLeader:
+		return 1, nil
+	case AcksNone:
+		return 0, nil
+	}
+	return 0, errors.Errorf("unknown acks %q", s.Acks)
+}
+
+// conn returns connection to broker, connecting if necessary
+func (s *Sender) conn(addr string) (*broker, error) {
+	if b, ok := s.conns[addr]; ok {
+		return b, nil
+	}
+	b, err := s.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.conns == nil {
+		s.conns = make(map[string]*broker)
+	}
+	s.conns[addr] = b
+	return b, nil
+}
+
+// drop closes broken connection
+func (s *Sender) drop(addr string) {
+	if b, ok := s.conns[addr]; ok {
+		b.Close()
+		delete(s.conns, addr)
+	}
+}
+
+// refresh requests topic metadata from the first available broker
+func (s *Sender) refresh() error {
+	if len(s.Brokers) == 0 {
+		return errors.New("kafka: no brokers")
+	}
+	var req encoder
+	req.arrayLen(1)
+	req.string(s.Topic)
+	var err error
+	for _, addr := range s.Brokers {
+		var b *broker
+		if b, err = s.conn(addr); err != nil {
+			continue
+		}
+		var resp []byte
+		if resp, err = b.request(apiMetadata, metadataVersion, req.Bytes(), true); err != nil {
+			s.drop(addr)
+			continue
+		}
+		var meta *metadata
+		if meta, err = s.parseMetadata(resp); err != nil {
+			continue
+		}
+		s.meta = meta
+		return nil
+	}
+	return errors.Wrap(err, "kafka: fetching metadata")
+}
+
+func (s *Sender) parseMetadata(resp []byte) (*metadata, error) {
+	d := &decoder{data: resp}
+	meta := &metadata{brokers: make(map[int32]string)}
+	for i := d.arrayLen(); i > 0; i-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		meta.brokers[id] = host + ":" + strconv.Itoa(int(port))
+	}
+	d.int32() // controller id
+	var topicErr int16
+	found := false
+	for i := d.arrayLen(); i > 0; i-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // is internal
+		for j := d.arrayLen(); j > 0; j-- {
+			var p partition
+			d.int16() // partition error, leader is -1 if it is unavailable
+			p.id = d.int32()
+			p.leader = d.int32()
+			for k := d.arrayLen(); k > 0; k-- {
+				d.int32() // replicas
+			}
+			for k := d.arrayLen(); k > 0; k-- {
+				d.int32() // in-sync replicas
+			}
+			if name == s.Topic {
+				meta.partitions = append(meta.partitions, p)
+			}
+		}
+		if name == s.Topic {
+			found, topicErr = true, code
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	if topicErr != errNone {
+		return nil, errors.Wrapf(kafkaError(topicErr), "topic %s", s.Topic)
+	}
+	if !found || len(meta.partitions) == 0 {
+		return nil, errors.Errorf("topic %s has no partitions", s.Topic)
+	}
+	sort.Slice(meta.partitions, func(i, j int) bool {
+		return meta.partitions[i].id < meta.partitions[j].id
+	})
+	return meta, nil
+}
+
+// newRecord converts message to record. Messages that are not valid JSON
+// are sent as is without the key.
+func (s *Sender) newRecord(data []byte) record {
+	r := record{value: data, ts: time.Now()}
+	var msg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&msg); err != nil {
+		return r
+	}
+	if n, ok := msg["timestamp"].(json.Number); ok {
+		if sec, err := n.Float64(); err == nil && sec > 0 {
+			// record timestamps have millisecond precision
+			r.ts = time.Unix(0, int64(math.Round(sec*1000))*int64(time.Millisecond))
+		}
+	}
+	if s.Key == "" {
+		return r
+	}
+	v, ok := msg[s.Key]
+	if !ok {
+		v = msg["_"+s.Key]
+	}
+	switch v := v.(type) {
+	case string:
+		r.key = []byte(v)
+	case json.Number:
+		r.key = []byte(v.String())
+	case nil:
+	default:
+		r.key, _ = json.Marshal(v)
+	}
+	return r
+}
+
+// chunk is a part of the batch sent to one partition
+type chunk struct {
+	partition int32
+	records   []record
+	positions []int
+}
+
+// split distributes records between partitions, records of a partition are
+// split in chunks of at most maxBatchBytes
+func (s *Sender) split(records []record, positions []int) (res [][]*chunk) {
+	parts := s.meta.partitions
+	// messages without key stick to one partition with a leader
+	sticky := parts[s.next%len(parts)].id
+	for i := range parts {
+		if p := parts[(s.next+i)%len(parts)]; p.leader >= 0 {
+			sticky = p.id
+			break
+		}
+	}
+	s.next++
+	index := make(map[int32][]*chunk)
+	var order []int32
+	for i, r := range records {
+		p := sticky
+		if r.key != nil {
+			p = parts[int(murmur2(r.key)&0x7fffffff)%len(parts)].id
+		}
+		chunks, ok := index[p]
+		if !ok {
+			order = append(order, p)
+		}
+		if len(chunks) == 0 || chunks[len(chunks)-1].size()+r.size() > maxBatchBytes {
+			chunks = append(chunks, &chunk{partition: p})
+		}
+		c := chunks[len(chunks)-1]
+		c.records = append(c.records, r)
+		c.positions = append(c.positions, positions[i])
+		index[p] = chunks
+	}
+	for _, p := range order {
+		res = append(res, index[p])
+	}
+	return
+}
+
+func (c *chunk) size() (res int) {
+	for _, r := range c.records {
+		res += r.size() + recordOverhead
+	}
+	return
+}
+
+func (s *Sender) leader(p int32) (string, bool) {
+	for _, part := range s.meta.partitions {
+		if part.id == p {
+			addr, ok := s.meta.brokers[part.leader]
+			return addr, ok
+		}
+	}
+	return "", false
+}
+
+// produce sends chunks to partition leaders. It returns positions of
+// messages that failed with transient errors, messages rejected by broker
+// are logged and dropped.
+func (s *Sender) produce(records []record, positions []int) (failed []int, dropped int, err error) {
+	if s.meta == nil {
+		if err := s.refresh(); err != nil {
+			return positions, 0, err
+		}
+	}
+	fail := func(c *chunk, e error) {
+		failed = append(failed, c.positions...)
+		err = e
+	}
+	partitions := s.split(records, positions)
+	for round, more := 0, true; more; round++ {
+		more = false
+		byLeader := make(map[string][]*chunk)
+		var leaders []string
+		for _, chunks := range partitions {
+			if round >= len(chunks) {
+				continue
+			}
+			more = true
+			c := chunks[round]
+			addr, ok := s.leader(c.partition)
+			if !ok {
+				fail(c, errors.Wrapf(kafkaError(errLeaderNotAvailable), "partition %d", c.partition))
+				continue
+			}
+			if _, ok := byLeader[addr]; !ok {
+				leaders = append(leaders, addr)
+			}
+			byLeader[addr] = append(byLeader[addr], c)
+		}
+		for _, addr := range leaders {
+			chunks := byLeader[addr]
+			codes, e := s.request(addr, chunks)
+			if e != nil {
+				for _, c := range chunks {
+					fail(c, e)
+				}
+				continue
+			}
+			for _, c := range chunks {
+				code, ok := codes[c.partition]
+				switch ke := kafkaError(code); {
+				case !ok && codes != nil:
+					fail(c, errors.Errorf("no response for partition %d", c.partition))
+				case code == errNone:
+				case ke.retriable():
+					fail(c, errors.Wrapf(ke, "partition %d", c.partition))
+				default:
+					log.Printf("kafka: %d message(s) rejected by partition %d: %v", len(c.records), c.partition, ke)
+					dropped += len(c.records)
+				}
+			}
+		}
+	}
+	if len(failed) > 0 {
+		// leaders may have changed
+		s.meta = nil
+	}
+	return
+}
+
+// request sends produce request to broker and returns error codes of
+// partitions, codes are nil if acks are not requested
+func (s *Sender) request(addr string, chunks []*chunk) (map[int32]int16, error) {
+	acks, err := s.requiredAcks()
+	if err != nil {
+		return nil, err
+	}
+	var req encoder
+	req.nullString() // transactional id
+	req.int16(acks)
+	req.int32(int32(s.SendTimeout))
+	req.arrayLen(1)
+	req.string(s.Topic)
+	req.arrayLen(len(chunks))
+	for _, c := range chunks {
+		batch, err := encodeBatch(c.records, s.Compression)
+		if err != nil {
+			return nil, err
+		}
+		req.int32(c.partition)
+		req.bytes(batch)
+	}
+	b, err := s.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.request(apiProduce, produceVersion, req.Bytes(), acks != 0)
+	if err != nil {
+		s.drop(addr)
+		return nil, err
+	}
+	if acks == 0 {
+		return nil, nil
+	}
+	d := &decoder{data: resp}
+	codes := make(map[int32]int16)
+	for i := d.arrayLen(); i > 0; i-- {
+		d.string() // topic
+		for j := d.arrayLen(); j > 0; j-- {
+			p := d.int32()
+			codes[p] = d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+		}
+	}
+	if d.err != nil {
+		s.drop(addr)
+		return nil, d.err
+	}
+	return codes, nil
+}
+
+// Send produces a single message
+func (s *Sender) Send(data []byte) error {
+	return s.SendBatch([][]byte{data})
+}
+
+// SendBatch produces messages, each partition receives one record batch.
+// Messages failed with transient errors are resent after metadata refresh.
+func (s *Sender) SendBatch(batch [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]record, len(batch))
+	positions := make([]int, len(batch))
+	for i, data := range batch {
+		all[i] = s.newRecord(data)
+		positions[i] = i
+	}
+	records := all
+	retries := s.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	delay := MinBackoff
+	dropped := 0
+	for attempt := 0; ; attempt++ {
+		failed, n, err := s.produce(records, positions)
+		dropped += n
+		switch {
+		case len(failed) == 0 && dropped == len(batch):
+			return permanentError{errors.New("kafka: all messages rejected")}
+		case len(failed) == 0:
+			return nil
+		case attempt >= retries && len(failed) == len(batch):
+			return err
+		case attempt >= retries:
+			return &PartialError{failed: failed, err: err}
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > MaxBackoff {
+			delay = MaxBackoff
+		}
+		retry := make([]record, len(failed))
+		for i, pos := range failed {
+			retry[i] = all[pos]
+		}
+		records, positions = retry, failed
+	}
+}
+
+// Close closes broker connections
+func (s *Sender) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr := range s.conns {
+		s.drop(addr)
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker is a single-node cluster serving one topic
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	topic      string
+	partitions int32
+	username   string
+	password   string
+
+	mu       sync.Mutex
+	authed   bool
+	metadata int
+	// errors are returned for produce requests to partitions, in order
+	errors  map[int32][]int16
+	records map[int32][]record
+}
+
+func newFakeBroker(t *testing.T, partitions int32) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, topic: "logs", partitions: partitions, errors: make(map[int32][]int16), records: make(map[int32][]record)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) Close() {
+	b.ln.Close()
+}
+
+func (b *fakeBroker) addr() string {
+	return b.ln.Addr().String()
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := &decoder{data: req}
+		apiKey, version, corr := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+		var resp encoder
+		resp.int32(0)
+		resp.int32(corr)
+		b.mu.Lock()
+		wait := b.handle(apiKey, version, d, &resp)
+		b.mu.Unlock()
+		if d.err != nil {
+			b.t.Errorf("malformed request %d: %v", apiKey, d.err)
+			return
+		}
+		if !wait {
+			continue
+		}
+		data := resp.Bytes()
+		binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// handle decodes request and writes response, it returns false if no
+// response is expected
+func (b *fakeBroker) handle(apiKey, version int16, d *decoder, resp *encoder) bool {
+	if b.username != "" && !b.authed && apiKey != apiSaslHandshake && apiKey != apiSaslAuthenticate {
+		b.t.Errorf("request %d before authentication", apiKey)
+	}
+	switch apiKey {
+	case apiSaslHandshake:
+		if mechanism := d.string(); mechanism != "PLAIN" {
+			b.t.Errorf("unexpected mechanism %s", mechanism)
+		}
+		resp.int16(errNone)
+		resp.arrayLen(1)
+		resp.string("PLAIN")
+	case apiSaslAuthenticate:
+		code := int16(errSaslAuthenticationFailed)
+		if string(d.bytes()) == "\x00"+b.username+"\x00"+b.password {
+			code, b.authed = errNone, true
+		}
+		resp.int16(code)
+		resp.nullString()
+		resp.bytes([]byte{})
+	case apiMetadata:
+		b.metadata++
+		for i := d.arrayLen(); i > 0; i-- {
+			if topic := d.string(); topic != b.topic {
+				b.t.Errorf("unexpected topic %s", topic)
+			}
+		}
+		host, port, _ := net.SplitHostPort(b.addr())
+		p, _ := strconv.Atoi(port)
+		resp.arrayLen(1)
+		resp.int32(1)
+		resp.string(host)
+		resp.int32(int32(p))
+		resp.nullString()
+		resp.int32(1) // controller
+		resp.arrayLen(1)
+		resp.int16(errNone)
+		resp.string(b.topic)
+		resp.int8(0)
+		resp.arrayLen(int(b.partitions))
+		for i := int32(0); i < b.partitions; i++ {
+			resp.int16(errNone)
+			resp.int32(i)
+			resp.int32(1)
+			resp.arrayLen(1)
+			resp.int32(1)
+			resp.arrayLen(1)
+			resp.int32(1)
+		}
+	case apiProduce:
+		d.string() // transactional id
+		acks := d.int16()
+		d.int32() // timeout
+		resp.arrayLen(d.arrayLen())
+		topic := d.string()
+		resp.string(topic)
+		n := d.arrayLen()
+		resp.arrayLen(n)
+		for ; n > 0; n-- {
+			p := d.int32()
+			code := int16(errNone)
+			if errs := b.errors[p]; len(errs) > 0 {
+				code, b.errors[p] = errs[0], errs[1:]
+			}
+			records := b.decodeBatch(d.bytes())
+			if code == errNone {
+				b.records[p] = append(b.records[p], records...)
+			}
+			resp.int32(p)
+			resp.int16(code)
+			resp.int64(0)
+			resp.int64(-1)
+		}
+		resp.int32(0) // throttle time
+		return acks != 0
+	default:
+		b.t.Errorf("unexpected request %d v%d", apiKey, version)
+	}
+	return true
+}
+
+func (b *fakeBroker) decodeBatch(data []byte) (res []record) {
+	d := &decoder{data: data}
+	d.int64() // base offset
+	if n := d.int32(); int(n) != len(d.data) {
+		b.t.Errorf("batch length %d, %d expected", n, len(d.data))
+	}
+	d.int32() // leader epoch
+	if magic := d.int8(); magic != 2 {
+		b.t.Errorf("unexpected magic %d", magic)
+	}
+	crc := uint32(d.int32())
+	if crc != crc32.Checksum(d.data, castagnoli) {
+		b.t.Error("CRC mismatch")
+	}
+	attributes := d.int16()
+	d.int32() // last offset delta
+	first := d.int64()
+	d.int64() // max timestamp
+	d.int64() // producer id
+	d.int16() // producer epoch
+	d.int32() // base sequence
+	count := d.int32()
+	if attributes&7 == codecGzip {
+		zr, err := gzip.NewReader(bytes.NewReader(d.data))
+		if err != nil {
+			b.t.Fatal(err)
+		}
+		if d.data, err = ioutil.ReadAll(zr); err != nil {
+			b.t.Fatal(err)
+		}
+	}
+	for i := int32(0); i < count; i++ {
+		length := d.varint()
+		rd := &decoder{data: d.next(int(length))}
+		rd.int8()
+		ts := first + rd.varint()
+		if delta := rd.varint(); delta != int64(i) {
+			b.t.Errorf("unexpected offset delta %d", delta)
+		}
+		var r record
+		if n := rd.varint(); n >= 0 {
+			r.key = rd.next(int(n))
+		}
+		r.value = rd.next(int(rd.varint()))
+		r.ts = time.Unix(0, ts*int64(time.Millisecond))
+		rd.varint() // headers
+		if rd.err != nil || len(rd.data) != 0 {
+			b.t.Errorf("malformed record %d", i)
+		}
+		res = append(res, r)
+	}
+	if d.err != nil {
+		b.t.Error(d.err)
+	}
+	return
+}
+
+func TestSender_SendBatch(t *testing.T) {
+	b := newFakeBroker(t, 3)
+	b.username, b.password = "user", "secret"
+	defer b.Close()
+	s := &Sender{
+		Brokers:     []string{"127.0.0.1:1", b.addr()},
+		Topic:       "logs",
+		Key:         "host",
+		Compression: CompressGzip,
+		Username:    "user",
+		Password:    "secret",
+		SendTimeout: 1000,
+	}
+	defer s.Close()
+	batch := [][]byte{
+		[]byte(`{"host":"a","short_message":"1","timestamp":1385053862.307}`),
+		[]byte(`{"host":"b","short_message":"2"}`),
+		[]byte(`{"_host":"a","short_message":"3"}`),
+		[]byte(`not json`),
+	}
+	if err := s.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	pa := murmur2([]byte("a")) & 0x7fffffff % 3
+	pb := murmur2([]byte("b")) & 0x7fffffff % 3
+	if ra := b.records[pa]; len(ra) < 2 || string(ra[0].value) != string(batch[0]) || string(ra[1].value) != string(batch[2]) {
+		t.Fatalf("messages with key a should be in partition %d: %v", pa, b.records)
+	}
+	if ts := b.records[pa][0].ts; !ts.Equal(time.Unix(1385053862, 307000000)) {
+		t.Errorf("unexpected timestamp %v", ts)
+	}
+	found := false
+	for _, r := range b.records[pb] {
+		found = found || string(r.key) == "b" && string(r.value) == string(batch[1])
+	}
+	if !found {
+		t.Errorf("message with key b should be in partition %d: %v", pb, b.records)
+	}
+	total := 0
+	for _, records := range b.records {
+		total += len(records)
+	}
+	if total != len(batch) {
+		t.Errorf("%d records produced, %d expected", total, len(batch))
+	}
+}
+
+func TestSender_Retry(t *testing.T) {
+	MinBackoff = time.Millisecond
+	defer func() { MinBackoff = 250 * time.Millisecond }()
+	b := newFakeBroker(t, 2)
+	defer b.Close()
+	b.errors[0] = []int16{errNotLeaderForPartition}
+	b.errors[1] = []int16{errMessageTooLarge}
+	s := &Sender{Brokers: []string{b.addr()}, Topic: "logs", Key: "n", Acks: AcksLeader}
+	defer s.Close()
+	var batch [][]byte
+	for i := 0; i < 10; i++ {
+		batch = append(batch, []byte(`{"n":`+strconv.Itoa(i)+`}`))
+	}
+	if err := s.SendBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	if b.metadata != 2 {
+		t.Errorf("metadata should be refreshed after error: %d requests", b.metadata)
+	}
+	if len(b.records[1]) != 0 {
+		t.Errorf("rejected messages should be dropped: %v", b.records[1])
+	}
+	dropped := 10 - len(b.records[0])
+	b.errors[0] = []int16{errMessageTooLarge}
+	b.errors[1] = []int16{errMessageTooLarge}
+	err := s.SendBatch(batch)
+	if pe, ok := err.(interface{ Permanent() bool }); !ok || !pe.Permanent() {
+		t.Errorf("permanent error expected: %v", err)
+	}
+	if dropped == 0 || dropped == 10 {
+		t.Errorf("keys should be spread between partitions")
+	}
+}
+
+func TestSender_NoAcks(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	defer b.Close()
+	s := &Sender{Brokers: []string{b.addr()}, Topic: "logs", Acks: AcksNone}
+	defer s.Close()
+	for _, msg := range []string{`{"short_message":"1"}`, `{"short_message":"2"}`} {
+		if err := s.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the following request is answered only after produce requests
+	// are processed
+	s.mu.Lock()
+	err := s.refresh()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.records[0]) != 2 {
+		t.Errorf("unexpected records %v", b.records)
+	}
+}
+
+func TestSender_Auth(t *testing.T) {
+	b := newFakeBroker(t, 1)
+	b.username, b.password = "user", "secret"
+	defer b.Close()
+	s := &Sender{Brokers: []string{b.addr()}, Topic: "logs", Username: "user", Password: "wrong", Retries: -1}
+	defer s.Close()
+	if err := s.Send([]byte(`{}`)); err == nil {
+		t.Error("authentication should fail")
+	}
+}
+
+func TestMurmur2(t *testing.T) {
+	// test vectors of Kafka Java client
+	for key, expected := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if h := murmur2([]byte(key)); h != expected {
+			t.Errorf("murmur2(%q) = %d, expected %d", key, h, expected)
+		}
+	}
+}
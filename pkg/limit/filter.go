@@ -0,0 +1,227 @@
+// Package limit restricts clients of inputs by address and message rate
+package limit
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+// Actions on messages exceeding the rate limit
+const (
+	// ActionDrop discards messages
+	ActionDrop = "drop"
+	// ActionDelay waits until the client is within the limit again
+	ActionDelay = "delay"
+	// ActionTag passes messages with Field set
+	ActionTag = "tag"
+)
+
+// Field is set to true in messages tagged by ActionTag
+const Field = "_rate_limited"
+
+// sweepInterval is the period of removing buckets of idle clients
+const sweepInterval = time.Minute
+
+// now is overridden in tests
+var now = time.Now
+
+// Filter checks client addresses against allow and deny lists and limits
+// message rate of each client address with a token bucket
+type Filter struct {
+	// Input names the input in logs and metrics
+	Input string
+	// Allow lists accepted networks, all addresses are accepted if it is
+	// empty
+	Allow []*net.IPNet
+	// Deny lists rejected networks, it takes precedence over Allow
+	Deny []*net.IPNet
+	// Rate limits messages per second of each client IP address, zero
+	// disables the limit
+	Rate float64
+	// Burst is the number of messages a client may send at once, defaults
+	// to Rate
+	Burst int
+	// Action is ActionDrop (default), ActionDelay or ActionTag
+	Action string
+
+	mu      sync.Mutex
+	clients map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// limited is set while the client exceeds the limit, so that it is
+	// logged once
+	limited bool
+}
+
+// ParseNetworks parses IP addresses and CIDR networks
+func ParseNetworks(values []string) (res []*net.IPNet, err error) {
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", v)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// host returns IP address of the client
+func host(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	h, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		h = addr.String()
+	}
+	return net.ParseIP(h)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the client is accepted by allow and deny lists,
+// rejected clients are counted
+func (f *Filter) Allowed(addr net.Addr) bool {
+	if len(f.Allow) == 0 && len(f.Deny) == 0 {
+		return true
+	}
+	ip := host(addr)
+	if ip != nil && !contains(f.Deny, ip) && (len(f.Allow) == 0 || contains(f.Allow, ip)) {
+		return true
+	}
+	metrics.InputDenied.WithLabelValues(f.Input).Inc()
+	return false
+}
+
+func (f *Filter) burst() float64 {
+	if f.Burst > 0 {
+		return float64(f.Burst)
+	}
+	return math.Max(1, math.Ceil(f.Rate))
+}
+
+// Limit takes n messages of the client from its token bucket. It returns
+// false if messages exceed the limit and should be dropped, and sets tag if
+// they should be tagged. With ActionDelay it sleeps until the client is
+// within the limit.
+func (f *Filter) Limit(addr net.Addr, n int) (tag, ok bool) {
+	if f.Rate <= 0 {
+		return false, true
+	}
+	wait, over := f.take(addr, n)
+	if !over {
+		return false, true
+	}
+	action := f.Action
+	if action == "" {
+		action = ActionDrop
+	}
+	metrics.InputRateLimited.WithLabelValues(f.Input, action).Add(float64(n))
+	switch action {
+	case ActionDelay:
+		time.Sleep(wait)
+		return false, true
+	case ActionTag:
+		return true, true
+	}
+	return false, false
+}
+
+// take refills the bucket of the client and takes n tokens from it. Tokens
+// are borrowed with ActionDelay, the returned wait is the time to pay them
+// back.
+func (f *Filter) take(addr net.Addr, n int) (wait time.Duration, over bool) {
+	key := addr.String()
+	if ip := host(addr); ip != nil {
+		key = ip.String()
+	}
+	t := now()
+	burst := f.burst()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweep(t, burst)
+	b, found := f.clients[key]
+	if !found {
+		b = &bucket{tokens: burst, updated: t}
+		f.clients[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+t.Sub(b.updated).Seconds()*f.Rate)
+	b.updated = t
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		b.limited = false
+		return 0, false
+	}
+	if !b.limited {
+		log.Printf("%s: client %s exceeds rate limit of %g messages per second", f.Input, key, f.Rate)
+		b.limited = true
+	}
+	if f.Action != ActionDelay {
+		return 0, true
+	}
+	b.tokens -= float64(n)
+	return time.Duration(-b.tokens / f.Rate * float64(time.Second)), true
+}
+
+// sweep removes buckets of clients that were idle long enough to refill
+// them completely
+func (f *Filter) sweep(t time.Time, burst float64) {
+	if f.clients == nil {
+		f.clients = make(map[string]*bucket)
+		f.swept = t
+	}
+	if t.Sub(f.swept) < sweepInterval {
+		return
+	}
+	f.swept = t
+	for k, b := range f.clients {
+		if b.tokens+t.Sub(b.updated).Seconds()*f.Rate >= burst {
+			delete(f.clients, k)
+		}
+	}
+}
+
+// Tag sets Field of the message
+func Tag(msg []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return nil, errors.Wrap(err, "message is not a JSON object")
+	}
+	fields[Field] = json.RawMessage("true")
+	return json.Marshal(fields)
+}
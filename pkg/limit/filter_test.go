@@ -0,0 +1,102 @@
+package limit
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func addr(s string) net.Addr {
+	a, _ := net.ResolveTCPAddr("tcp", s)
+	return a
+}
+
+func TestFilter_Allowed(t *testing.T) {
+	allow, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := ParseNetworks([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Filter{Allow: allow, Deny: deny}
+	for a, expected := range map[string]bool{
+		"10.2.3.4:1000":      true,
+		"10.1.3.4:1000":      false,
+		"192.168.1.1:1000":   true,
+		"192.168.1.2:1000":   false,
+		"[2001:db8::1]:1000": true,
+		"[2001:db9::1]:1000": false,
+	} {
+		if f.Allowed(addr(a)) != expected {
+			t.Errorf("%s: expected %v", a, expected)
+		}
+	}
+	if _, err := ParseNetworks([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("error expected for invalid network")
+	}
+}
+
+func TestFilter_Limit(t *testing.T) {
+	defer func() { now = time.Now }()
+	t0 := time.Unix(1000, 0)
+	now = func() time.Time { return t0 }
+	client, other := addr("10.0.0.1:1000"), addr("10.0.0.2:1000")
+	for _, tc := range []struct {
+		action string
+		tag    bool
+		ok     bool
+	}{
+		{ActionDrop, false, false},
+		{ActionTag, true, true},
+	} {
+		f := &Filter{Rate: 2, Action: tc.action}
+		for i := 0; i < 2; i++ {
+			if tag, ok := f.Limit(client, 1); tag || !ok {
+				t.Fatalf("%s: message %d should pass", tc.action, i)
+			}
+		}
+		if tag, ok := f.Limit(client, 1); tag != tc.tag || ok != tc.ok {
+			t.Errorf("%s: unexpected result %v, %v", tc.action, tag, ok)
+		}
+		if tag, ok := f.Limit(other, 2); tag || !ok {
+			t.Errorf("%s: clients should be limited separately", tc.action)
+		}
+		now = func() time.Time { return t0.Add(500 * time.Millisecond) }
+		if tag, ok := f.Limit(client, 1); tag || !ok {
+			t.Errorf("%s: bucket was not refilled", tc.action)
+		}
+		now = func() time.Time { return t0.Add(2 * sweepInterval) }
+		f.Limit(client, 1)
+		if len(f.clients) != 1 {
+			t.Errorf("%s: idle clients were not removed: %v", tc.action, f.clients)
+		}
+		now = func() time.Time { return t0 }
+	}
+}
+
+func TestFilter_Delay(t *testing.T) {
+	defer func() { now = time.Now }()
+	t0 := time.Unix(1000, 0)
+	now = func() time.Time { return t0 }
+	f := &Filter{Rate: 10, Burst: 1, Action: ActionDelay}
+	client := addr("10.0.0.1:1000")
+	f.Limit(client, 1)
+	if wait, over := f.take(client, 2); !over || wait != 200*time.Millisecond {
+		t.Errorf("unexpected wait %v", wait)
+	}
+	if wait, over := f.take(client, 1); !over || wait != 300*time.Millisecond {
+		t.Errorf("debt was not accumulated: %v", wait)
+	}
+}
+
+func TestTag(t *testing.T) {
+	msg, err := Tag([]byte(`{"a":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != `{"_rate_limited":true,"a":1}` {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
@@ -1,81 +1,413 @@
+// Package loki pushes GELF messages to Loki
 package loki
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/buger/jsonparser"
-	"github.com/grafana/loki/pkg/promtail/client"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/pkg/logproto"
 	"github.com/pkg/errors"
-	"github.com/prometheus/common/model"
 )
 
-type Handler interface {
-	Handle(ls model.LabelSet, t time.Time, s string) error
-}
+// Encodings of push requests
+const (
+	EncodingProtobuf = "protobuf"
+	EncodingJSON     = "json"
+)
+
+// Formats of message fields that are not promoted to labels
+const (
+	LineFormatJSON   = "json"
+	LineFormatLogfmt = "logfmt"
+)
+
+const defaultRetries = 3
 
+var (
+	// MinBackoff is the initial delay before resending rejected request
+	MinBackoff = 250 * time.Millisecond
+	// MaxBackoff limits the delay between resending attempts
+	MaxBackoff = 2 * time.Second
+)
+
+// Sender pushes messages to Loki push API, either /loki/api/v1/push or
+// legacy /api/prom/push, which accepts only protobuf encoding
 type Sender struct {
-	Job     string
-	Handler Handler
+	URL         string
+	SendTimeout int
+	// Encoding is EncodingProtobuf (default) or EncodingJSON
+	Encoding string
+	// TenantID is passed in X-Scope-OrgID header
+	TenantID string
+	// Username and Password enable basic authentication, BearerToken is
+	// used instead of them if set
+	Username, Password string
+	BearerToken        string
+	TLSConfig          *tls.Config
+	// Retries limits resending of requests rejected with 429 or 5xx
+	// status, zero means default, negative value disables retries
+	Retries int
+	// Job is the value of job label, defaults to grayproxy
+	Job string
+
+	// Labels lists message fields that become stream labels, all fields
+	// are used if it is empty. Field names are given without leading
+	// underscore.
+	Labels []string
+	// DropLabels lists fields that never become labels
+	DropLabels []string
+	// RenameLabels maps field names to label names
+	RenameLabels map[string]string
+	// StaticLabels are added to every stream
+	StaticLabels map[string]string
+	// LineFormat is LineFormatJSON or LineFormatLogfmt to keep fields that
+	// are not labels in the log line, they are dropped otherwise
+	LineFormat string
+
+	once         sync.Once
+	labels, drop map[string]bool
+	client       *http.Client
 }
 
-type zeroLog struct{}
+// permanentError is returned for requests that Loki will never accept
+type permanentError struct {
+	error
+}
 
-func (zeroLog) Log(keyvals ...interface{}) error {
-	log.Println(keyvals...)
-	return nil
+func (permanentError) Permanent() bool {
+	return true
 }
 
-func New(addr string) (*Sender, error) {
-	var cfg client.Config
-	if err := cfg.URL.Set(addr); err != nil {
-		return nil, errors.Wrap(err, "set client URL")
+// Send pushes a single message
+func (s *Sender) Send(data []byte) error {
+	return s.SendBatch([][]byte{data})
+}
+
+// SendBatch pushes messages grouped into streams by their labels
+func (s *Sender) SendBatch(batch [][]byte) error {
+	streams := s.streams(batch)
+	if len(streams) == 0 {
+		return permanentError{errors.New("no valid messages in batch")}
 	}
-	c, err := client.New(cfg, zeroLog{})
+	body, contentType, err := encode(streams, s.Encoding)
 	if err != nil {
-		return nil, errors.Wrap(err, "create client")
+		return err
+	}
+	retries := s.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+	delay := MinBackoff
+	for attempt := 0; ; attempt++ {
+		wait, err := s.push(body, contentType)
+		if err == nil || wait < 0 || attempt >= retries {
+			return err
+		}
+		if wait == 0 {
+			wait = delay
+		}
+		time.Sleep(wait)
+		if delay *= 2; delay > MaxBackoff {
+			delay = MaxBackoff
+		}
+	}
+}
+
+func (s *Sender) httpClient() *http.Client {
+	if s.client == nil {
+		s.client = &http.Client{Timeout: time.Duration(s.SendTimeout) * time.Millisecond}
+		if s.TLSConfig != nil {
+			tr := http.DefaultTransport.(*http.Transport).Clone()
+			tr.TLSClientConfig = s.TLSConfig
+			s.client.Transport = tr
+		}
 	}
-	return &Sender{Handler: c}, nil
+	return s.client
 }
 
-func (s *Sender) job() model.LabelValue {
+// push sends request once. It returns negative wait if the request should
+// not be retried, zero for the default backoff or the delay requested by
+// server.
+func (s *Sender) push(body []byte, contentType string) (wait time.Duration, err error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, errors.Wrap(err, "creating request")
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.TenantID)
+	}
+	if s.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.BearerToken)
+	} else if s.Username != "" || s.Password != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "pushing to loki")
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	io.Copy(ioutil.Discard, resp.Body)
+	switch code := resp.StatusCode; {
+	case code < 300:
+		return 0, nil
+	case code == http.StatusTooManyRequests:
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			if wait = time.Duration(sec) * time.Second; wait > MaxBackoff {
+				wait = MaxBackoff
+			}
+		}
+		return wait, errors.Errorf("loki: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	case code >= 500:
+		return 0, errors.Errorf("loki: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return -1, permanentError{errors.Errorf("loki rejected messages: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+}
+
+// Close closes idle connections of the sender, if it has its own transport
+func (s *Sender) Close() error {
+	if s.client != nil && s.client.Transport != nil {
+		s.client.CloseIdleConnections()
+	}
+	return nil
+}
+
+type entry struct {
+	ts   time.Time
+	line string
+}
+
+type stream struct {
+	labels  map[string]string
+	key     string
+	entries []entry
+}
+
+func (s *Sender) job() string {
 	if s.Job == "" {
 		return "grayproxy"
 	}
-	return model.LabelValue(s.Job)
+	return s.Job
 }
 
-func (s *Sender) labelSet() model.LabelSet {
-	res := make(model.LabelSet)
-	res["job"] = s.job()
+// streams converts messages to entries grouped by label set, invalid
+// messages are skipped
+func (s *Sender) streams(batch [][]byte) (res []*stream) {
+	index := make(map[string]*stream)
+	for _, data := range batch {
+		labels, e, err := s.parse(data)
+		if err != nil {
+			log.Printf("loki: skipping message: %v", err)
+			continue
+		}
+		key := labelString(labels)
+		st, ok := index[key]
+		if !ok {
+			st = &stream{labels: labels, key: key}
+			index[key] = st
+			res = append(res, st)
+		}
+		st.entries = append(st.entries, e)
+	}
+	// Loki rejects out of order entries within a stream
+	for _, st := range res {
+		sort.SliceStable(st.entries, func(i, j int) bool {
+			return st.entries[i].ts.Before(st.entries[j].ts)
+		})
+	}
+	return
+}
+
+func toSet(names []string) map[string]bool {
+	res := make(map[string]bool)
+	for _, name := range names {
+		res[name] = true
+	}
 	return res
 }
 
-func (s *Sender) Send(data []byte) (err error) {
-	var msg string
-	ls := s.labelSet()
-	ts := time.Now()
-	jsonparser.ObjectEach(data, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
-		switch k := strings.TrimPrefix(string(key), "_"); k {
-		case "timestamp":
-			ms, _ := jsonparser.ParseFloat(value)
-			ts = time.Unix(0, int64(ms*float64(time.Second)))
-		case "short_message":
-			if msg == "" {
-				msg = string(value)
+// isLabel returns true if field should become a label
+func (s *Sender) isLabel(field string) bool {
+	s.once.Do(func() {
+		s.labels, s.drop = toSet(s.Labels), toSet(s.DropLabels)
+	})
+	return (len(s.labels) == 0 || s.labels[field]) && !s.drop[field]
+}
+
+// parse converts GELF message to Loki entry. The message becomes the line,
+// selected fields become labels.
+func (s *Sender) parse(data []byte) (labels map[string]string, e entry, err error) {
+	var msg map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&msg); err != nil {
+		return nil, e, errors.Wrap(err, "decoding GELF")
+	}
+	labels = map[string]string{"job": s.job()}
+	e.ts = time.Now()
+	var short, full string
+	rest := make(map[string]interface{})
+	for k, v := range msg {
+		value := stringValue(v)
+		switch k = strings.TrimPrefix(k, "_"); {
+		case k == "timestamp":
+			if sec, err := strconv.ParseFloat(value, 64); err == nil && sec > 0 {
+				e.ts = time.Unix(0, int64(sec*float64(time.Second)))
 			}
-		case "full_message":
-			if string(value) != "" {
-				msg = string(value)
+		case k == "short_message":
+			short = value
+		case k == "full_message":
+			full = value
+		case s.isLabel(k):
+			if name, ok := s.RenameLabels[k]; ok {
+				k = name
 			}
+			labels[labelName(k)] = value
 		default:
-			ls[model.LabelName(k)] = model.LabelValue(string(value))
+			rest[k] = v
 		}
-		return nil
-	})
-	if ts.IsZero() {
-		ts = time.Now()
 	}
-	return errors.Wrap(s.Handler.Handle(ls, ts, msg), "handle log entry")
+	for k, v := range s.StaticLabels {
+		labels[labelName(k)] = v
+	}
+	e.line = short
+	if full != "" {
+		e.line = full
+	}
+	if len(rest) > 0 {
+		e.line, err = formatLine(e.line, rest, s.LineFormat)
+	}
+	return labels, e, err
+}
+
+// formatLine adds fields to the log line in the specified format, fields
+// are dropped if format is empty
+func formatLine(line string, fields map[string]interface{}, format string) (string, error) {
+	switch format {
+	case "":
+		return line, nil
+	case LineFormatJSON:
+		fields["message"] = line
+		data, err := json.Marshal(fields)
+		return string(data), errors.Wrap(err, "formatting line")
+	case LineFormatLogfmt:
+		names := make([]string, 0, len(fields))
+		for k := range fields {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		var buf strings.Builder
+		buf.WriteString("message=")
+		buf.WriteString(logfmtValue(line))
+		for _, k := range names {
+			fmt.Fprintf(&buf, " %s=%s", k, logfmtValue(stringValue(fields[k])))
+		}
+		return buf.String(), nil
+	}
+	return "", errors.Errorf("unknown line format %q", format)
+}
+
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\r\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// labelName replaces characters not allowed in label names with underscores
+func labelName(k string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, k)
+}
+
+// labelString formats labels in Prometheus notation, e.g. {host="a", job="b"}
+func labelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		fmt.Fprintf(&buf, "%s=%q", k, labels[k])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// encode returns push request body and its content type
+func encode(streams []*stream, encoding string) ([]byte, string, error) {
+	switch encoding {
+	case "", EncodingProtobuf:
+		req := &logproto.PushRequest{Streams: make([]*logproto.Stream, 0, len(streams))}
+		for _, st := range streams {
+			ps := &logproto.Stream{Labels: st.key, Entries: make([]logproto.Entry, 0, len(st.entries))}
+			for _, e := range st.entries {
+				ps.Entries = append(ps.Entries, logproto.Entry{Timestamp: e.ts, Line: e.line})
+			}
+			req.Streams = append(req.Streams, ps)
+		}
+		data, err := req.Marshal()
+		if err != nil {
+			return nil, "", errors.Wrap(err, "encoding push request")
+		}
+		return snappy.Encode(nil, data), "application/x-protobuf", nil
+	case EncodingJSON:
+		type jsonStream struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		}
+		req := struct {
+			Streams []jsonStream `json:"streams"`
+		}{Streams: make([]jsonStream, 0, len(streams))}
+		for _, st := range streams {
+			js := jsonStream{Stream: st.labels, Values: make([][2]string, 0, len(st.entries))}
+			for _, e := range st.entries {
+				js.Values = append(js.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+			}
+			req.Streams = append(req.Streams, js)
+		}
+		data, err := json.Marshal(req)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "encoding push request")
+		}
+		return data, "application/json", nil
+	}
+	return nil, "", errors.Errorf("unknown encoding %q", encoding)
 }
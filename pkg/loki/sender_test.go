@@ -4,42 +4,211 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/andviro/goldie"
+	"github.com/golang/snappy"
+	"github.com/grafana/loki/pkg/logproto"
+
 	"github.com/andviro/grayproxy/pkg/loki"
-	"github.com/prometheus/common/model"
 )
 
-type testHandler bytes.Buffer
+const testMessage = `{
+  "version": "1.1",
+  "host": "example.org",
+  "short_message": "A short message that helps you identify what is going on",
+  "full_message": "Backtrace here\n\nmore stuff",
+  "timestamp": 1385053862.3072,
+  "level": 1,
+  "_user_id": 9001,
+  "_some_info": "foo",
+  "_some_env_var": "bar"
+}`
+
+// testServer records push requests, responding with statuses in order
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	// retryAfter is sent with 429 status, 0 by default
+	retryAfter string
+	requests   []*http.Request
+	bodies     [][]byte
+}
+
+func newTestServer(statuses ...int) *testServer {
+	ts := &testServer{statuses: statuses}
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		ts.requests = append(ts.requests, r)
+		ts.bodies = append(ts.bodies, body)
+		status := http.StatusNoContent
+		if len(ts.statuses) > 0 {
+			status, ts.statuses = ts.statuses[0], ts.statuses[1:]
+		}
+		if status == http.StatusTooManyRequests {
+			retryAfter := ts.retryAfter
+			if retryAfter == "" {
+				retryAfter = "0"
+			}
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	return ts
+}
 
-func (t *testHandler) Handle(ls model.LabelSet, ts time.Time, s string) error {
-	buf := (*bytes.Buffer)(t)
-	jd, _ := json.Marshal(ts)
-	fmt.Fprintf(buf, "%s\n", jd)
-	jd, _ = json.MarshalIndent(ls, "", "\t")
-	fmt.Fprintf(buf, "%s\n", jd)
-	fmt.Fprintf(buf, "%s\n", s)
-	return nil
+func decodeProtobuf(t *testing.T, body []byte) *logproto.PushRequest {
+	data, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(logproto.PushRequest)
+	if err := req.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	return req
 }
 
 func TestSender_Send(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	s := &loki.Sender{URL: ts.URL + "/loki/api/v1/push", Job: "test", TenantID: "tenant", Username: "user", Password: "secret"}
+	if err := s.Send([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	r := ts.requests[0]
+	if user, pass, _ := r.BasicAuth(); user != "user" || pass != "secret" || r.Header.Get("X-Scope-OrgID") != "tenant" {
+		t.Errorf("unexpected headers %v", r.Header)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		t.Errorf("unexpected content type %q", ct)
+	}
 	buf := new(bytes.Buffer)
-	s := loki.Sender{Handler: (*testHandler)(buf), Job: "test"}
-	err := s.Send([]byte(`{
-	  "version": "1.1",
-	  "host": "example.org",
-	  "short_message": "A short message that helps you identify what is going on",
-	  "full_message": "Backtrace here\n\nmore stuff",
-	  "timestamp": 1385053862.3072,
-	  "level": 1,
-	  "_user_id": 9001,
-	  "_some_info": "foo",
-	  "_some_env_var": "bar"
-	}`))
+	for _, st := range decodeProtobuf(t, ts.bodies[0]).Streams {
+		fmt.Fprintf(buf, "%s\n", st.Labels)
+		for _, e := range st.Entries {
+			fmt.Fprintf(buf, "%s %s\n", e.Timestamp.UTC().Format(time.RFC3339Nano), e.Line)
+		}
+	}
+	goldie.Assert(t, "sender-send", buf.Bytes())
+}
+
+func TestSender_SendBatch(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	s := &loki.Sender{URL: ts.URL, Encoding: loki.EncodingJSON, BearerToken: "token"}
+	err := s.SendBatch([][]byte{
+		[]byte(`{"host":"a","short_message":"2","timestamp":2}`),
+		[]byte(`{"host":"b","short_message":"3","timestamp":3}`),
+		[]byte(`not a message`),
+		[]byte(`{"host":"a","short_message":"1","timestamp":1}`),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	goldie.Assert(t, "sender-send", buf.Bytes())
+	if auth := ts.requests[0].Header.Get("Authorization"); auth != "Bearer token" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(ts.bodies[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"streams":[` +
+		`{"stream":{"host":"a","job":"grayproxy"},"values":[["1000000000","1"],["2000000000","2"]]},` +
+		`{"stream":{"host":"b","job":"grayproxy"},"values":[["3000000000","3"]]}]}`
+	if got, _ := json.Marshal(req); string(got) != expected {
+		t.Errorf("unexpected request %s", got)
+	}
+}
+
+func TestSender_Retry(t *testing.T) {
+	loki.MinBackoff = time.Millisecond
+	defer func() { loki.MinBackoff = 250 * time.Millisecond }()
+	ts := newTestServer(http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusNoContent, http.StatusBadRequest)
+	defer ts.Close()
+	s := &loki.Sender{URL: ts.URL}
+	if err := s.Send([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.requests) != 3 {
+		t.Errorf("request should be retried: %d", len(ts.requests))
+	}
+	err := s.Send([]byte(testMessage))
+	if pe, ok := err.(interface{ Permanent() bool }); !ok || !pe.Permanent() {
+		t.Errorf("permanent error expected: %v", err)
+	}
+	if len(ts.requests) != 4 {
+		t.Errorf("rejected request should not be retried: %d", len(ts.requests))
+	}
+}
+
+func TestSender_RetryAfter(t *testing.T) {
+	loki.MinBackoff = time.Millisecond
+	loki.MaxBackoff = 50 * time.Millisecond
+	defer func() { loki.MinBackoff, loki.MaxBackoff = 250*time.Millisecond, 2*time.Second }()
+	ts := newTestServer(http.StatusTooManyRequests, http.StatusNoContent)
+	ts.retryAfter = "1"
+	defer ts.Close()
+	s := &loki.Sender{URL: ts.URL}
+	start := time.Now()
+	if err := s.Send([]byte(testMessage)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ts.requests) != 2 {
+		t.Errorf("request should be retried: %d", len(ts.requests))
+	}
+	if elapsed := time.Since(start); elapsed < loki.MaxBackoff {
+		t.Errorf("Retry-After is not honored, resent after %v", elapsed)
+	}
+}
+
+func TestSender_Labels(t *testing.T) {
+	ts := newTestServer()
+	defer ts.Close()
+	for _, tc := range []struct {
+		s             *loki.Sender
+		labels, lines string
+	}{
+		{
+			s: &loki.Sender{
+				Labels:       []string{"host", "level", "some_info"},
+				DropLabels:   []string{"some_info"},
+				RenameLabels: map[string]string{"host": "instance"},
+				StaticLabels: map[string]string{"env": "prod", "level": "static"},
+				LineFormat:   loki.LineFormatLogfmt,
+			},
+			labels: `{env="prod", instance="example.org", job="grayproxy", level="static"}`,
+			lines:  `message="Backtrace here\n\nmore stuff" some_env_var=bar some_info=foo user_id=9001 version=1.1`,
+		},
+		{
+			s:      &loki.Sender{DropLabels: []string{"user_id", "version"}, LineFormat: loki.LineFormatJSON},
+			labels: `{host="example.org", job="grayproxy", level="1", some_env_var="bar", some_info="foo"}`,
+			lines:  `{"message":"Backtrace here\n\nmore stuff","user_id":9001,"version":"1.1"}`,
+		},
+		{
+			s:      &loki.Sender{Labels: []string{"host"}},
+			labels: `{host="example.org", job="grayproxy"}`,
+			lines:  "Backtrace here\n\nmore stuff",
+		},
+	} {
+		tc.s.URL = ts.URL
+		if err := tc.s.Send([]byte(testMessage)); err != nil {
+			t.Fatal(err)
+		}
+		st := decodeProtobuf(t, ts.bodies[len(ts.bodies)-1]).Streams[0]
+		if st.Labels != tc.labels {
+			t.Errorf("expected labels %s, got %s", tc.labels, st.Labels)
+		}
+		if line := st.Entries[0].Line; line != tc.lines {
+			t.Errorf("expected line %s, got %s", tc.lines, line)
+		}
+	}
 }
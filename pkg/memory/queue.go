@@ -0,0 +1,265 @@
+// Package memory implements bounded in-memory queue with overflow policies
+package memory
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+// Overflow policies
+const (
+	// OverflowBlock makes Put wait until there is room in the queue
+	OverflowBlock = "block"
+	// OverflowDropNewest discards messages that do not fit into the queue
+	OverflowDropNewest = "dropNewest"
+	// OverflowDropOldest discards the oldest messages to make room for new
+	// ones
+	OverflowDropOldest = "dropOldest"
+	// OverflowSpill puts messages that do not fit into the spill queue
+	OverflowSpill = "spill"
+)
+
+const (
+	// DefaultMaxMessages is used if Options.MaxMessages is zero
+	DefaultMaxMessages = 100000
+	// DefaultMaxBytes is used if Options.MaxBytes is zero
+	DefaultMaxBytes = 100 << 20
+)
+
+// ErrClosed is returned by Put after the queue is closed
+var ErrClosed = errors.New("queue is closed")
+
+// Spill takes messages that do not fit into memory, usually it is a disk
+// queue
+type Spill interface {
+	Put(data []byte) error
+	ReadChan() <-chan []byte
+	Close() error
+}
+
+// acker is implemented by spill queues that remove messages after they are
+// acknowledged
+type acker interface {
+	Ack(n int) error
+}
+
+// Options of the queue
+type Options struct {
+	// Name labels metrics of the queue
+	Name string
+	// MaxMessages and MaxBytes bound the queue, zero means default, negative
+	// value disables the limit. A message larger than MaxBytes is accepted
+	// into empty queue.
+	MaxMessages, MaxBytes int
+	// Overflow is OverflowBlock (default), OverflowDropNewest,
+	// OverflowDropOldest or OverflowSpill
+	Overflow string
+	// Spill is required by OverflowSpill, messages found in it are read
+	// with any policy. It is closed with the queue.
+	Spill Spill
+}
+
+// Queue passes messages in the order they were put. Messages left in the
+// queue on Close are still read, then the read channel is closed.
+type Queue struct {
+	opts    Options
+	mu      sync.Mutex
+	notFull *sync.Cond
+	msgs    [][]byte
+	head    int
+	size    int
+	closed  bool
+	// wake is signaled when a message is put or the queue is closed
+	wake chan struct{}
+	out  chan []byte
+	// spilled counts messages put to spill by this process
+	spilled int
+
+	depth, bytes prometheus.Gauge
+}
+
+// New creates the queue and starts passing messages to the read channel
+func New(opts Options) *Queue {
+	if opts.MaxMessages == 0 {
+		opts.MaxMessages = DefaultMaxMessages
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = DefaultMaxBytes
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowBlock
+	}
+	q := &Queue{
+		opts:  opts,
+		wake:  make(chan struct{}, 1),
+		out:   make(chan []byte),
+		depth: metrics.QueueDepth.WithLabelValues(opts.Name),
+		bytes: metrics.QueueBytes.WithLabelValues(opts.Name),
+	}
+	q.notFull = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// fits returns true if the message fits into the queue, q.mu is held
+func (q *Queue) fits(data []byte) bool {
+	n := len(q.msgs) - q.head
+	if n == 0 {
+		return true
+	}
+	return (q.opts.MaxMessages < 0 || n < q.opts.MaxMessages) &&
+		(q.opts.MaxBytes < 0 || q.size+len(data) <= q.opts.MaxBytes)
+}
+
+func (q *Queue) updateMetrics() {
+	q.depth.Set(float64(len(q.msgs) - q.head))
+	q.bytes.Set(float64(q.size))
+}
+
+func (q *Queue) dropped(policy string) {
+	metrics.QueueDropped.WithLabelValues(q.opts.Name, policy).Inc()
+}
+
+// Put adds message to the queue applying overflow policy if the queue is
+// full
+func (q *Queue) Put(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// once spilling started messages go to spill until it is drained, so
+	// that they keep order
+	spill := q.spilled > 0
+	for !spill && !q.fits(data) && !q.closed {
+		switch q.opts.Overflow {
+		case OverflowDropNewest:
+			q.dropped(OverflowDropNewest)
+			return nil
+		case OverflowDropOldest:
+			q.size -= len(q.msgs[q.head])
+			q.msgs[q.head] = nil
+			q.head++
+			q.dropped(OverflowDropOldest)
+		case OverflowSpill:
+			spill = true
+		default:
+			q.notFull.Wait()
+		}
+	}
+	if q.closed {
+		return ErrClosed
+	}
+	if spill {
+		if err := q.opts.Spill.Put(data); err != nil {
+			q.dropped(OverflowSpill)
+			return errors.Wrap(err, "spilling message")
+		}
+		q.spilled++
+		metrics.QueueSpilled.WithLabelValues(q.opts.Name).Inc()
+		return nil
+	}
+	q.msgs = append(q.msgs, data)
+	q.size += len(data)
+	q.updateMetrics()
+	q.signal()
+	return nil
+}
+
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes the oldest message from memory, ok is false if memory is
+// empty. done is true if the queue is closed and drained.
+func (q *Queue) pop() (data []byte, ok, done bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == len(q.msgs) {
+		return nil, false, q.closed
+	}
+	data = q.msgs[q.head]
+	q.msgs[q.head] = nil
+	q.head++
+	q.size -= len(data)
+	// reclaim space of read messages
+	if q.head == len(q.msgs) {
+		q.msgs, q.head = q.msgs[:0], 0
+	} else if q.head > 1024 && q.head > len(q.msgs)/2 {
+		q.msgs, q.head = append(q.msgs[:0], q.msgs[q.head:]...), 0
+	}
+	q.updateMetrics()
+	q.notFull.Broadcast()
+	return data, true, false
+}
+
+// unspilled is called when a message is read from spill
+func (q *Queue) unspilled() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// messages left in spill by previous run are not counted
+	if q.spilled > 0 {
+		q.spilled--
+	}
+}
+
+func (q *Queue) run() {
+	defer close(q.out)
+	var spilled <-chan []byte
+	if q.opts.Spill != nil {
+		spilled = q.opts.Spill.ReadChan()
+	}
+	for {
+		data, ok, done := q.pop()
+		if done {
+			return
+		}
+		if ok {
+			q.out <- data
+			continue
+		}
+		select {
+		case <-q.wake:
+		case data, ok := <-spilled:
+			if !ok {
+				spilled = nil
+				continue
+			}
+			q.unspilled()
+			q.out <- data
+			if a, ok := q.opts.Spill.(acker); ok {
+				if err := a.Ack(1); err != nil {
+					log.Printf("queue %s: %v", q.opts.Name, err)
+				}
+			}
+		}
+	}
+}
+
+// ReadChan returns channel of queued messages
+func (q *Queue) ReadChan() <-chan []byte {
+	return q.out
+}
+
+// Close stops accepting messages and closes the spill queue. Messages left
+// in memory are still passed to the read channel.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	closed := q.closed
+	q.closed = true
+	q.notFull.Broadcast()
+	q.mu.Unlock()
+	if closed {
+		return nil
+	}
+	q.signal()
+	if q.opts.Spill != nil {
+		return errors.Wrap(q.opts.Spill.Close(), "closing spill queue")
+	}
+	return nil
+}
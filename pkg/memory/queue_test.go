@@ -0,0 +1,128 @@
+package memory_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/memory"
+)
+
+func putAll(t *testing.T, q *memory.Queue, msgs ...string) {
+	for _, msg := range msgs {
+		if err := q.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(q *memory.Queue) (res []string) {
+	q.Close()
+	for msg := range q.ReadChan() {
+		res = append(res, string(msg))
+	}
+	return
+}
+
+func TestQueue_Overflow(t *testing.T) {
+	for _, tc := range []struct {
+		opts     memory.Options
+		expected []string
+	}{
+		{memory.Options{MaxMessages: 2, Overflow: memory.OverflowDropNewest}, []string{"1", "2"}},
+		{memory.Options{MaxMessages: 2, Overflow: memory.OverflowDropOldest}, []string{"3", "4"}},
+		{memory.Options{MaxBytes: 3, Overflow: memory.OverflowDropOldest}, []string{"2", "3", "4"}},
+		{memory.Options{MaxMessages: -1, MaxBytes: -1}, []string{"1", "2", "3", "4"}},
+	} {
+		q := memory.New(tc.opts)
+		// the first message is taken by the reader
+		putAll(t, q, "0")
+		time.Sleep(10 * time.Millisecond)
+		putAll(t, q, "1", "2", "3", "4")
+		res := readAll(q)
+		if len(res) != len(tc.expected)+1 {
+			t.Errorf("%+v: unexpected messages %v", tc.opts, res)
+			continue
+		}
+		for i, msg := range tc.expected {
+			if res[i+1] != msg {
+				t.Errorf("%+v: unexpected messages %v", tc.opts, res)
+			}
+		}
+	}
+}
+
+func TestQueue_Block(t *testing.T) {
+	q := memory.New(memory.Options{MaxMessages: 1})
+	putAll(t, q, "0", "1")
+	put := make(chan error)
+	go func() { put <- q.Put([]byte("2")) }()
+	select {
+	case <-put:
+		t.Fatal("put should block while the queue is full")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if msg := <-q.ReadChan(); string(msg) != "0" {
+		t.Errorf("unexpected message %s", msg)
+	}
+	if err := <-put; err != nil {
+		t.Fatal(err)
+	}
+	go func() { put <- q.Put([]byte("3")) }()
+	time.Sleep(10 * time.Millisecond)
+	q.Close()
+	if err := <-put; err != memory.ErrClosed {
+		t.Errorf("unexpected error %v", err)
+	}
+	var res []string
+	for msg := range q.ReadChan() {
+		res = append(res, string(msg))
+	}
+	if len(res) != 2 || res[0] != "1" || res[1] != "2" {
+		t.Errorf("messages were not drained: %v", res)
+	}
+}
+
+func TestQueue_Spill(t *testing.T) {
+	spill := memory.New(memory.Options{Name: "spill"})
+	q := memory.New(memory.Options{MaxMessages: 2, Overflow: memory.OverflowSpill, Spill: spill})
+	putAll(t, q, "0", "1", "2", "3", "4")
+	var res []string
+	for i := 0; i < 5; i++ {
+		res = append(res, string(<-q.ReadChan()))
+	}
+	for i, msg := range []string{"0", "1", "2", "3", "4"} {
+		if res[i] != msg {
+			t.Fatalf("unexpected messages %v", res)
+		}
+	}
+	// spill is drained, so new messages go to memory
+	putAll(t, q, "5")
+	if msg := <-q.ReadChan(); string(msg) != "5" {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
+
+func TestQueue_SpillOrder(t *testing.T) {
+	spill := memory.New(memory.Options{Name: "spill"})
+	q := memory.New(memory.Options{MaxMessages: 2, Overflow: memory.OverflowSpill, Spill: spill})
+	putAll(t, q, "0", "1", "2", "3", "4", "5")
+	var res []string
+	for i := 0; i < 4; i++ {
+		res = append(res, string(<-q.ReadChan()))
+	}
+	time.Sleep(10 * time.Millisecond)
+	// messages put while spill is not drained go after spilled ones
+	putAll(t, q, "6")
+	for i := 0; i < 3; i++ {
+		res = append(res, string(<-q.ReadChan()))
+	}
+	expected := []string{"0", "1", "2", "3", "4", "5", "6"}
+	if len(res) != len(expected) {
+		t.Fatalf("unexpected messages %v", res)
+	}
+	for i, msg := range expected {
+		if res[i] != msg {
+			t.Fatalf("unexpected messages %v", res)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package metrics defines Prometheus metrics of the proxy pipeline
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "grayproxy"
+
+var (
+	// InputMessages counts messages received by each input
+	InputMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_messages_total",
+		Help:      "Number of messages received by input.",
+	}, []string{"input"})
+
+	// InputAuthFailures counts rejected authentication attempts of each
+	// input
+	InputAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_auth_failures_total",
+		Help:      "Number of rejected authentication attempts by input.",
+	}, []string{"input"})
+
+	// InputDenied counts messages and connections rejected by address
+	// filters of each input
+	InputDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_denied_total",
+		Help:      "Number of messages and connections rejected by address filter of input.",
+	}, []string{"input"})
+
+	// InputRateLimited counts messages exceeding rate limits of each input
+	// by the action taken
+	InputRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "input_rate_limited_total",
+		Help:      "Number of messages exceeding rate limit of input by action.",
+	}, []string{"input", "action"})
+
+	// GELFChunks counts GELF chunks by the result of assembly: assembled,
+	// expired or dropped
+	GELFChunks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gelf_chunks_total",
+		Help:      "Number of GELF chunks by the result of message assembly.",
+	}, []string{"result"})
+
+	// DecompressFailures counts messages that could not be decompressed
+	DecompressFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gelf_decompress_failures_total",
+		Help:      "Number of messages that failed to decompress.",
+	})
+
+	// SyslogParseFailures counts syslog messages that could not be parsed
+	SyslogParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "syslog_parse_failures_total",
+		Help:      "Number of syslog messages that failed to parse.",
+	})
+
+	// OutputSends counts send attempts of each output
+	OutputSends = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_sends_total",
+		Help:      "Number of send attempts by output.",
+	}, []string{"output"})
+
+	// OutputFailures counts failed send attempts of each output
+	OutputFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_failures_total",
+		Help:      "Number of failed send attempts by output.",
+	}, []string{"output"})
+
+	// OutputLatency observes send duration of each output
+	OutputLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "output_send_duration_seconds",
+		Help:      "Duration of send attempts by output.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"output"})
+
+	// QueueDepth holds the number of messages waiting in a memory queue, or
+	// not acknowledged in a disk queue
+	QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_messages",
+		Help:      "Number of messages waiting in queue.",
+	}, []string{"queue"})
+
+	// QueueBytes holds the number of bytes stored in a memory queue, or the
+	// size of segment files of a disk queue
+	QueueBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_bytes",
+		Help:      "Number of bytes stored in queue.",
+	}, []string{"queue"})
+
+	// QueueSegments holds the number of segment files of a disk queue
+	QueueSegments = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_segments",
+		Help:      "Number of segment files of disk queue.",
+	}, []string{"queue"})
+
+	// QueueOldest holds the time the oldest message was put into a disk
+	// queue, it is absent while the queue is empty
+	QueueOldest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "queue_oldest_message_timestamp_seconds",
+		Help:      "Unix time of the oldest message in disk queue.",
+	}, []string{"queue"})
+
+	// QueueDropped counts messages discarded by overflow policy of memory
+	// queues, lost because spilling them failed, or rejected and expired by
+	// maxSize and maxAge limits of disk queues
+	QueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_dropped_total",
+		Help:      "Number of messages dropped by queue overflow policy or limits.",
+	}, []string{"queue", "policy"})
+
+	// QueueSpilled counts messages that did not fit into memory queue and
+	// were put to disk
+	QueueSpilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_spilled_total",
+		Help:      "Number of messages spilled from memory queue to disk.",
+	}, []string{"queue"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		InputMessages,
+		InputAuthFailures,
+		InputDenied,
+		InputRateLimited,
+		GELFChunks,
+		DecompressFailures,
+		SyslogParseFailures,
+		OutputSends,
+		OutputFailures,
+		OutputLatency,
+		QueueDepth,
+		QueueBytes,
+		QueueSegments,
+		QueueOldest,
+		QueueDropped,
+		QueueSpilled,
+	)
+}
+
+// Serve exposes registered metrics at /metrics on the specified address in
+// background
+func Serve(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "setting up metrics listener")
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go http.Serve(l, mux)
+	return nil
+}
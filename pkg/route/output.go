@@ -0,0 +1,412 @@
+package route
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/metrics"
+)
+
+// Queue buffers messages waiting for delivery to a single output
+type Queue interface {
+	Put(data []byte) error
+	ReadChan() <-chan []byte
+	Close() error
+}
+
+// AckQueue is a Queue that removes messages only after they are
+// acknowledged, so that messages being delivered survive crash of the process
+type AckQueue interface {
+	Queue
+	// Ack removes n oldest messages that were read from the queue
+	Ack(n int) error
+	// Nack returns messages that were read and not acknowledged to the queue
+	Nack() error
+}
+
+var (
+	// RetryInterval is the time between probes of a failed output, other
+	// messages of the group go to healthy outputs meanwhile
+	RetryInterval = 5 * time.Second
+	// MinBackoff is the initial delay before resending a failed message
+	MinBackoff = 100 * time.Millisecond
+	// MaxBackoff limits the delay between resending attempts
+	MaxBackoff = 30 * time.Second
+	// PartialRetries limits resending of messages that failed in a partially
+	// sent batch by outputs that do not retry
+	PartialRetries = 3
+)
+
+// permanentError is implemented by errors that resending can not fix,
+// messages failed with them are dropped without affecting output health
+type permanentError interface {
+	Permanent() bool
+}
+
+func isPermanent(err error) bool {
+	pe, ok := errors.Cause(err).(permanentError)
+	return ok && pe.Permanent()
+}
+
+// partialError is implemented by errors of BatchSender that failed only some
+// messages of the batch, only they are resent. Outputs that do not retry
+// resend them at most PartialRetries times.
+type partialError interface {
+	Failed() []int
+}
+
+// Output delivers messages from its own Queue to Sender and tracks its
+// health
+type Output struct {
+	// pending counts messages put by this process and not processed yet,
+	// it goes first to keep 64-bit alignment
+	pending int64
+
+	Name   string
+	Sender Sender
+	Queue  Queue
+	// Weight is used by the Weighted strategy, non-positive weight is
+	// treated as 1
+	Weight int
+	// Retry makes the output resend failed messages with exponential
+	// backoff instead of dropping them
+	Retry bool
+	// BatchSize limits the number of messages passed to BatchSender at
+	// once, BatchWait limits the time the first message of a batch waits
+	// for others. Both are used only if Sender implements BatchSender.
+	BatchSize int
+	BatchWait time.Duration
+
+	mu       sync.Mutex
+	err      error
+	failedAt time.Time
+	// probing is set while a message is routed to the failed output to
+	// check if it is alive again
+	probing bool
+	// handoff passes messages the output failed to send to another output
+	// of the group, it is set by Group.Bind
+	handoff func(from *Output, msgs [][]byte) bool
+	stop    chan struct{}
+	done    chan struct{}
+	// abandoned is set by the delivery worker when sending fails after
+	// stop
+	abandoned bool
+}
+
+func (o *Output) weight() int {
+	if o.Weight <= 0 {
+		return 1
+	}
+	return o.Weight
+}
+
+// Healthy returns false if the last send attempt has failed. The output is
+// healthy again only after it sends a message.
+func (o *Output) Healthy() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err == nil
+}
+
+// probe reports whether a message should be routed to the failed output to
+// check it, at most once in RetryInterval
+func (o *Output) probe() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err == nil || o.probing || time.Since(o.failedAt) < RetryInterval {
+		return false
+	}
+	o.probing = true
+	return true
+}
+
+// skipping reports whether the output failed and is not being probed, so
+// its messages are better sent by other outputs
+func (o *Output) skipping() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.err != nil && !o.probing
+}
+
+// Send passes data to the underlying Sender and updates output health
+func (o *Output) Send(data []byte) error {
+	return o.track(func() error { return o.Sender.Send(data) })
+}
+
+// SendBatch passes batch to the underlying BatchSender and updates output
+// health
+func (o *Output) SendBatch(batch [][]byte) error {
+	return o.track(func() error { return o.Sender.(BatchSender).SendBatch(batch) })
+}
+
+// track calls send, recording its result in metrics and output health
+func (o *Output) track(send func() error) (err error) {
+	start := time.Now()
+	err = send()
+	metrics.OutputSends.WithLabelValues(o.Name).Inc()
+	metrics.OutputLatency.WithLabelValues(o.Name).Observe(time.Since(start).Seconds())
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.probing = false
+	if err != nil {
+		metrics.OutputFailures.WithLabelValues(o.Name).Inc()
+		if isPermanent(err) {
+			log.Printf("out %s: dropping message: %v", o.Name, err)
+			return
+		}
+		if o.err == nil {
+			log.Printf("out %s: %v", o.Name, err)
+		}
+		o.err = err
+		o.failedAt = time.Now()
+		return
+	}
+	if o.err != nil {
+		log.Printf("out %s is now alive", o.Name)
+		o.err = nil
+	}
+	return
+}
+
+// Put adds data to the output queue
+func (o *Output) Put(data []byte) error {
+	if err := o.Queue.Put(data); err != nil {
+		return errors.Wrapf(err, "out %s", o.Name)
+	}
+	atomic.AddInt64(&o.pending, 1)
+	return nil
+}
+
+// Start launches the delivery worker
+func (o *Output) Start() {
+	o.stop = make(chan struct{})
+	o.done = make(chan struct{})
+	go func() {
+		defer close(o.done)
+		if _, ok := o.Sender.(BatchSender); ok && o.BatchSize > 1 {
+			o.runBatches()
+			return
+		}
+		for {
+			msg, ok := o.receive()
+			if !ok {
+				return
+			}
+			o.deliver([][]byte{msg}, func(msgs [][]byte) error { return o.Send(msgs[0]) })
+		}
+	}()
+}
+
+// quit returns the stop channel for outputs with AckQueue, which keep unsent
+// messages on close, and nil for other outputs, which drain their queues
+// until they are closed
+func (o *Output) quit() <-chan struct{} {
+	if _, ok := o.Queue.(AckQueue); ok {
+		return o.stop
+	}
+	return nil
+}
+
+// receive returns the next message of the queue, ok is false if the queue is
+// closed or the output with AckQueue is stopped
+func (o *Output) receive() (msg []byte, ok bool) {
+	quit := o.quit()
+	select {
+	case <-quit:
+		return nil, false
+	default:
+	}
+	select {
+	case msg, ok = <-o.Queue.ReadChan():
+	case <-quit:
+	}
+	return
+}
+
+// runBatches collects messages into batches until the queue is closed
+func (o *Output) runBatches() {
+	msgs, quit := o.Queue.ReadChan(), o.quit()
+	for {
+		msg, ok := o.receive()
+		if !ok {
+			return
+		}
+		batch := [][]byte{msg}
+		timer := time.NewTimer(o.BatchWait)
+	collect:
+		for len(batch) < o.BatchSize {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, msg)
+			case <-timer.C:
+				break collect
+			case <-quit:
+				break collect
+			}
+		}
+		timer.Stop()
+		o.deliver(batch, o.SendBatch)
+	}
+}
+
+// deliver calls send until it succeeds, if the output retries messages or
+// the batch was sent partially.
+// Messages that failed, or are queued while the output is failed, are handed
+// off to another output of the group if there is a healthy one. On stop
+// unsent messages are returned to the queue. Processed messages are
+// acknowledged, if the queue is AckQueue.
+func (o *Output) deliver(msgs [][]byte, send func([][]byte) error) {
+	n := len(msgs)
+	defer o.processed(n)
+	if o.abandoned {
+		if o.Retry {
+			o.requeue(msgs)
+		} else {
+			o.ack(n)
+		}
+		return
+	}
+	delay := MinBackoff
+	for attempt := 0; ; attempt++ {
+		if o.skipping() && o.handOff(msgs) {
+			o.ack(n)
+			return
+		}
+		err := send(msgs)
+		if err != nil && o.stopping() {
+			// the output failed while closing, messages drained from the
+			// queue after that are not sent, so that closing does not wait
+			// for each of them
+			o.abandoned = true
+		}
+		if err == nil || isPermanent(err) {
+			o.ack(n)
+			return
+		}
+		pe, partial := errors.Cause(err).(partialError)
+		if partial {
+			var failed [][]byte
+			for _, i := range pe.Failed() {
+				if i >= 0 && i < len(msgs) {
+					failed = append(failed, msgs[i])
+				}
+			}
+			if msgs = failed; len(msgs) == 0 {
+				o.ack(n)
+				return
+			}
+		} else if o.handOff(msgs) {
+			o.ack(n)
+			return
+		}
+		if !o.Retry && (!partial || attempt >= PartialRetries) {
+			if partial {
+				log.Printf("out %s: dropping %d message(s) after %d attempts", o.Name, len(msgs), attempt+1)
+			}
+			o.ack(n)
+			return
+		}
+		select {
+		case <-o.stop:
+			if o.Retry {
+				o.requeue(msgs)
+			}
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > MaxBackoff {
+			delay = MaxBackoff
+		}
+	}
+}
+
+// handOff passes msgs to another output of the group, unless the output is
+// stopping
+func (o *Output) handOff(msgs [][]byte) bool {
+	o.mu.Lock()
+	handoff := o.handoff
+	o.mu.Unlock()
+	return handoff != nil && !o.stopping() && handoff(o, msgs)
+}
+
+func (o *Output) stopping() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// ack acknowledges n processed messages
+func (o *Output) ack(n int) {
+	if aq, ok := o.Queue.(AckQueue); ok {
+		if err := aq.Ack(n); err != nil {
+			log.Printf("out %s: %v", o.Name, err)
+		}
+	}
+}
+
+// requeue returns unsent messages to the queue. Messages of AckQueue are
+// returned with Nack, which includes messages of the batch that were sent,
+// so they are delivered at least once.
+func (o *Output) requeue(msgs [][]byte) {
+	if aq, ok := o.Queue.(AckQueue); ok {
+		if err := aq.Nack(); err != nil {
+			log.Printf("out %s: %v", o.Name, err)
+		}
+		return
+	}
+	for _, msg := range msgs {
+		if err := o.Queue.Put(msg); err != nil {
+			log.Printf("out %s: %v", o.Name, err)
+		}
+	}
+}
+
+func (o *Output) processed(n int) {
+	if atomic.AddInt64(&o.pending, -int64(n)) < 0 {
+		// messages were left in the queue by previous run
+		atomic.StoreInt64(&o.pending, 0)
+	}
+}
+
+// Shutdown waits until messages put into the queue are processed or the
+// deadline passes, then closes the output
+func (o *Output) Shutdown(deadline time.Time) error {
+	for atomic.LoadInt64(&o.pending) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return o.Close()
+}
+
+// Close stops the delivery worker and closes the queue and the sender, if
+// it implements io.Closer. Messages that could not be sent are left in the
+// queue if the output retries them. AckQueue is closed after the worker
+// stops, so that messages it delivered are acknowledged, other queues are
+// closed first to let the worker drain them.
+func (o *Output) Close() error {
+	close(o.stop)
+	var err error
+	if _, ok := o.Queue.(AckQueue); ok {
+		<-o.done
+		err = o.Queue.Close()
+	} else {
+		err = o.Queue.Close()
+		<-o.done
+	}
+	if c, ok := o.Sender.(io.Closer); ok {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return errors.Wrapf(err, "closing out %s", o.Name)
+}
@@ -0,0 +1,192 @@
+// Package route distributes messages between groups of outputs
+package route
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sender is implemented by proxy outputs
+type Sender interface {
+	Send(data []byte) (err error)
+}
+
+// BatchSender is implemented by outputs that send several messages at once.
+// Output collects batches for them.
+type BatchSender interface {
+	Sender
+	SendBatch(batch [][]byte) (err error)
+}
+
+// Strategy selects how a Group distributes messages between its outputs
+type Strategy string
+
+const (
+	// Failover sends each message to the first healthy output
+	Failover Strategy = "failover"
+	// Broadcast sends each message to all outputs
+	Broadcast Strategy = "broadcast"
+	// RoundRobin rotates outputs on every message
+	RoundRobin Strategy = "roundrobin"
+	// Weighted picks outputs randomly with probability proportional to
+	// their weight
+	Weighted Strategy = "weighted"
+)
+
+// ParseStrategy converts strategy name to Strategy, empty name means Failover
+func ParseStrategy(name string) (Strategy, error) {
+	switch s := Strategy(name); s {
+	case "":
+		return Failover, nil
+	case Failover, Broadcast, RoundRobin, Weighted:
+		return s, nil
+	}
+	return "", errors.Errorf("unknown strategy %q", name)
+}
+
+// Group distributes messages between its outputs using Strategy
+type Group struct {
+	Name     string
+	Strategy Strategy
+	Outputs  []*Output
+
+	mu   sync.Mutex
+	next int
+	rnd  *rand.Rand
+}
+
+// order returns outputs in the order the strategy prefers them for the next
+// message
+func (g *Group) order() []*Output {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := len(g.Outputs)
+	res := make([]*Output, 0, n)
+	switch g.Strategy {
+	case RoundRobin:
+		for i := 0; i < n; i++ {
+			res = append(res, g.Outputs[(g.next+i)%n])
+		}
+		if n > 0 {
+			g.next = (g.next + 1) % n
+		}
+	case Weighted:
+		if g.rnd == nil {
+			g.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		rest := append([]*Output(nil), g.Outputs...)
+		for len(rest) > 0 {
+			total := 0
+			for _, o := range rest {
+				total += o.weight()
+			}
+			pick := g.rnd.Intn(total)
+			for i, o := range rest {
+				if pick -= o.weight(); pick < 0 {
+					res = append(res, o)
+					rest = append(rest[:i], rest[i+1:]...)
+					break
+				}
+			}
+		}
+	default:
+		res = append(res, g.Outputs...)
+	}
+	return res
+}
+
+// pick returns the first output in the strategy order that is healthy or due
+// for a probe, or the first one if all of them failed
+func (g *Group) pick() *Output {
+	res := g.order()
+	for _, o := range res {
+		if o.Healthy() || o.probe() {
+			return o
+		}
+	}
+	return res[0]
+}
+
+// handoff puts messages that failed at output from to the next healthy
+// output of the group
+func (g *Group) handoff(from *Output, msgs [][]byte) bool {
+	start := 0
+	for i, o := range g.Outputs {
+		if o == from {
+			start = i
+		}
+	}
+	for i := 1; i < len(g.Outputs); i++ {
+		o := g.Outputs[(start+i)%len(g.Outputs)]
+		if !o.Healthy() {
+			continue
+		}
+		for _, msg := range msgs {
+			if err := o.Put(msg); err != nil {
+				log.Printf("group %s: %v", g.Name, err)
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Send puts data into the queues of outputs selected by the group strategy.
+// Messages that the selected output fails to send are handed off to the next
+// healthy output. Broadcast skips failed outputs that do not retry, except
+// for probes, so that a dead output does not hold the other ones back.
+func (g *Group) Send(data []byte) (err error) {
+	if len(g.Outputs) == 0 {
+		return errors.Errorf("group %q has no outputs", g.Name)
+	}
+	if g.Strategy != Broadcast {
+		return g.pick().Put(data)
+	}
+	for _, o := range g.Outputs {
+		if !o.Retry && !o.Healthy() && !o.probe() {
+			continue
+		}
+		if e := o.Put(data); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Bind makes outputs hand off failed messages to other outputs of the
+// group, unless the strategy is Broadcast. Running outputs can be bound to a
+// new group.
+func (g *Group) Bind() {
+	var handoff func(from *Output, msgs [][]byte) bool
+	if g.Strategy != Broadcast && len(g.Outputs) > 1 {
+		handoff = g.handoff
+	}
+	for _, o := range g.Outputs {
+		o.mu.Lock()
+		o.handoff = handoff
+		o.mu.Unlock()
+	}
+}
+
+// Start binds outputs to the group and launches their delivery workers
+func (g *Group) Start() {
+	g.Bind()
+	for _, o := range g.Outputs {
+		o.Start()
+	}
+}
+
+// Close stops all outputs of the group
+func (g *Group) Close() (err error) {
+	for _, o := range g.Outputs {
+		if e := o.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
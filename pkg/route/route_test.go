@@ -0,0 +1,390 @@
+package route_test
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/memory"
+	"github.com/andviro/grayproxy/pkg/route"
+)
+
+type testSender struct {
+	mu   sync.Mutex
+	fail int
+	got  []string
+}
+
+func (s *testSender) setFail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = n
+}
+
+func (s *testSender) Send(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != 0 {
+		s.fail--
+		return errors.New("down")
+	}
+	s.got = append(s.got, string(data))
+	return nil
+}
+
+func newGroup(strategy route.Strategy, senders ...*testSender) *route.Group {
+	g := &route.Group{Name: "test", Strategy: strategy}
+	for i, s := range senders {
+		g.Outputs = append(g.Outputs, &route.Output{
+			Name:   string(rune('a' + i)),
+			Sender: s,
+			Queue:  memory.New(memory.Options{}),
+			Weight: i + 1,
+		})
+	}
+	g.Start()
+	return g
+}
+
+func send(t *testing.T, g *route.Group, msgs ...string) {
+	for _, msg := range msgs {
+		if err := g.Send([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGroup_Failover(t *testing.T) {
+	a, b := &testSender{fail: -1}, new(testSender)
+	g := newGroup(route.Failover, a, b)
+	send(t, g, "1")
+	time.Sleep(10 * time.Millisecond)
+	if g.Outputs[0].Healthy() {
+		t.Error("first output should be marked as failed")
+	}
+	send(t, g, "2")
+	g.Close()
+	if len(a.got) != 0 || !reflect.DeepEqual(b.got, []string{"1", "2"}) {
+		t.Fatalf("unexpected distribution: %v %v", a.got, b.got)
+	}
+}
+
+func TestGroup_Probe(t *testing.T) {
+	route.RetryInterval = 20 * time.Millisecond
+	defer func() { route.RetryInterval = 5 * time.Second }()
+	a, b := &testSender{fail: 1}, new(testSender)
+	g := newGroup(route.Failover, a, b)
+	send(t, g, "1")
+	time.Sleep(30 * time.Millisecond)
+	if g.Outputs[0].Healthy() {
+		t.Error("failed output should stay unhealthy until it sends a message")
+	}
+	send(t, g, "2")
+	time.Sleep(10 * time.Millisecond)
+	send(t, g, "3")
+	g.Close()
+	if !reflect.DeepEqual(a.got, []string{"2", "3"}) || !reflect.DeepEqual(b.got, []string{"1"}) {
+		t.Fatalf("recovered output should be used after probe: %v %v", a.got, b.got)
+	}
+}
+
+func TestGroup_Broadcast(t *testing.T) {
+	a, b, c := new(testSender), new(testSender), &testSender{fail: -1}
+	g := newGroup(route.Broadcast, a, b, c)
+	send(t, g, "1", "2")
+	g.Close()
+	if len(a.got) != 2 || len(b.got) != 2 {
+		t.Fatalf("messages should reach all outputs: %v %v", a.got, b.got)
+	}
+}
+
+func TestGroup_RoundRobin(t *testing.T) {
+	a, b, c := new(testSender), new(testSender), new(testSender)
+	g := newGroup(route.RoundRobin, a, b, c)
+	send(t, g, "1", "2", "3", "4", "5", "6")
+	g.Close()
+	if len(a.got) != 2 || len(b.got) != 2 || len(c.got) != 2 {
+		t.Fatalf("unexpected distribution: %v %v %v", a.got, b.got, c.got)
+	}
+}
+
+func TestGroup_Weighted(t *testing.T) {
+	a, b := new(testSender), new(testSender)
+	g := newGroup(route.Weighted, a, b)
+	for i := 0; i < 3000; i++ {
+		send(t, g, "x")
+	}
+	g.Close()
+	if len(b.got) < len(a.got) || len(a.got)+len(b.got) != 3000 {
+		t.Fatalf("heavier output should receive more messages: %d %d", len(a.got), len(b.got))
+	}
+}
+
+func TestOutput_Retry(t *testing.T) {
+	route.MinBackoff = time.Millisecond
+	defer func() { route.MinBackoff = 100 * time.Millisecond }()
+	a := &testSender{fail: 3}
+	o := &route.Output{Name: "a", Sender: a, Queue: memory.New(memory.Options{}), Retry: true}
+	o.Start()
+	for _, msg := range []string{"1", "2", "3"} {
+		if err := o.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	o.Close()
+	if !reflect.DeepEqual(a.got, []string{"1", "2", "3"}) {
+		t.Fatalf("messages should be retried in order: %v", a.got)
+	}
+}
+
+type tooLarge struct{}
+
+func (tooLarge) Error() string   { return "too large" }
+func (tooLarge) Permanent() bool { return true }
+
+type permanentSender struct{ testSender }
+
+func (s *permanentSender) Send(data []byte) error {
+	if string(data) == "large" {
+		return tooLarge{}
+	}
+	return s.testSender.Send(data)
+}
+
+func TestOutput_Permanent(t *testing.T) {
+	a := new(permanentSender)
+	o := &route.Output{Name: "a", Sender: a, Queue: memory.New(memory.Options{}), Retry: true}
+	o.Start()
+	for _, msg := range []string{"1", "large", "2"} {
+		if err := o.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if !o.Healthy() {
+		t.Error("permanent error should not affect output health")
+	}
+	o.Close()
+	if !reflect.DeepEqual(a.got, []string{"1", "2"}) {
+		t.Fatalf("message should be dropped without retrying: %v", a.got)
+	}
+}
+
+type batchSender struct {
+	testSender
+	batches [][]string
+}
+
+func (s *batchSender) SendBatch(batch [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != 0 {
+		s.fail--
+		return errors.New("down")
+	}
+	var res []string
+	for _, msg := range batch {
+		res = append(res, string(msg))
+	}
+	s.batches = append(s.batches, res)
+	return nil
+}
+
+func TestOutput_Batch(t *testing.T) {
+	route.MinBackoff = time.Millisecond
+	defer func() { route.MinBackoff = 100 * time.Millisecond }()
+	a := &batchSender{testSender: testSender{fail: 1}}
+	o := &route.Output{Name: "a", Sender: a, Queue: memory.New(memory.Options{}), Retry: true, BatchSize: 3, BatchWait: 20 * time.Millisecond}
+	o.Start()
+	for _, msg := range []string{"1", "2", "3", "4", "5"} {
+		if err := o.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.Shutdown(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"1", "2", "3"}, {"4", "5"}}
+	if !reflect.DeepEqual(a.batches, expected) {
+		t.Fatalf("unexpected batches: %v", a.batches)
+	}
+}
+
+type partialError []int
+
+func (e partialError) Error() string { return "partial" }
+
+func (e partialError) Failed() []int { return e }
+
+// partialSender fails the middle message of the first batch
+type partialSender struct {
+	batchSender
+}
+
+func (s *partialSender) SendBatch(batch [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []string
+	for _, msg := range batch {
+		res = append(res, string(msg))
+	}
+	s.batches = append(s.batches, res)
+	if len(s.batches) == 1 {
+		return partialError{1}
+	}
+	return nil
+}
+
+func TestOutput_Partial(t *testing.T) {
+	route.MinBackoff = time.Millisecond
+	defer func() { route.MinBackoff = 100 * time.Millisecond }()
+	// failed messages are resent even if the output does not retry
+	for _, retry := range []bool{true, false} {
+		a := new(partialSender)
+		o := &route.Output{Name: "a", Sender: a, Queue: memory.New(memory.Options{}), Retry: retry, BatchSize: 3, BatchWait: 20 * time.Millisecond}
+		o.Start()
+		for _, msg := range []string{"1", "2", "3"} {
+			if err := o.Put([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := o.Shutdown(time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		expected := [][]string{{"1", "2", "3"}, {"2"}}
+		if !reflect.DeepEqual(a.batches, expected) {
+			t.Fatalf("retry %v: only failed messages should be resent: %v", retry, a.batches)
+		}
+	}
+}
+
+// blockingSender fails each message after release is closed
+type blockingSender struct {
+	release chan struct{}
+	sent    int32
+}
+
+func (s *blockingSender) Send(data []byte) error {
+	atomic.AddInt32(&s.sent, 1)
+	<-s.release
+	return errors.New("down")
+}
+
+func TestOutput_CloseFailing(t *testing.T) {
+	a := &blockingSender{release: make(chan struct{})}
+	o := &route.Output{Name: "a", Sender: a, Queue: memory.New(memory.Options{})}
+	o.Start()
+	for i := 0; i < 100; i++ {
+		if err := o.Put([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		o.Close()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(a.release)
+	<-closed
+	if n := atomic.LoadInt32(&a.sent); n != 1 {
+		t.Errorf("messages should not be sent after failure on close, %d attempts", n)
+	}
+}
+
+// ackQueue counts acknowledgements of messages
+type ackQueue struct {
+	*memory.Queue
+	acked, nacked, closed int32
+}
+
+func (q *ackQueue) Ack(n int) error {
+	if atomic.LoadInt32(&q.closed) != 0 {
+		return errors.New("queue is closed")
+	}
+	atomic.AddInt32(&q.acked, int32(n))
+	return nil
+}
+
+func (q *ackQueue) Close() error {
+	atomic.StoreInt32(&q.closed, 1)
+	return q.Queue.Close()
+}
+
+func (q *ackQueue) Nack() error {
+	atomic.AddInt32(&q.nacked, 1)
+	return nil
+}
+
+func TestOutput_Ack(t *testing.T) {
+	route.MinBackoff = time.Millisecond
+	defer func() { route.MinBackoff = 100 * time.Millisecond }()
+	a := &testSender{fail: 1}
+	q := &ackQueue{Queue: memory.New(memory.Options{})}
+	o := &route.Output{Name: "a", Sender: a, Queue: q, Retry: true}
+	o.Start()
+	send := func(msgs ...string) {
+		for _, msg := range msgs {
+			if err := o.Put([]byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send("1", "2")
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&q.acked); n != 2 {
+		t.Errorf("delivered messages should be acknowledged, %d acked", n)
+	}
+	a.setFail(-1)
+	send("3")
+	time.Sleep(10 * time.Millisecond)
+	o.Close()
+	if atomic.LoadInt32(&q.acked) != 2 || atomic.LoadInt32(&q.nacked) == 0 {
+		t.Errorf("unsent message should be returned with Nack: %d %d", q.acked, q.nacked)
+	}
+}
+
+// slowSender sends messages after release is closed
+type slowSender struct {
+	release chan struct{}
+}
+
+func (s *slowSender) Send(data []byte) error {
+	<-s.release
+	return nil
+}
+
+func TestOutput_CloseAck(t *testing.T) {
+	q := &ackQueue{Queue: memory.New(memory.Options{})}
+	a := &slowSender{release: make(chan struct{})}
+	o := &route.Output{Name: "a", Sender: a, Queue: q, Retry: true}
+	o.Start()
+	if err := o.Put([]byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	closed := make(chan error)
+	go func() { closed <- o.Close() }()
+	time.Sleep(10 * time.Millisecond)
+	close(a.release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	// the queue is closed after the message being sent is acknowledged
+	if n := atomic.LoadInt32(&q.acked); n != 1 {
+		t.Errorf("sent message should be acknowledged, %d acked", n)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	if s, err := route.ParseStrategy(""); err != nil || s != route.Failover {
+		t.Errorf("unexpected default strategy %q: %v", s, err)
+	}
+	if _, err := route.ParseStrategy("random"); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -0,0 +1,189 @@
+package syslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/limit"
+	"github.com/andviro/grayproxy/pkg/metrics"
+	"github.com/andviro/grayproxy/pkg/tcp"
+)
+
+const maxUDPMessageSize = 65536
+
+// Listener receives syslog messages over UDP, TCP or TLS and passes them on
+// as GELF
+type Listener struct {
+	// Network is one of udp, tcp or tls
+	Network string
+	Address string
+	// TLSConfig is required for tls network
+	TLSConfig *tls.Config
+	// MaxConnections, IdleTimeout and MaxMessageSize have the same meaning
+	// as in tcp.Listener
+	MaxConnections, IdleTimeout, MaxMessageSize int
+	// Filter rejects clients from denied addresses and limits message rate
+	// of clients
+	Filter *limit.Filter
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	stream *tcp.Listener
+	closed bool
+}
+
+// Convert parses syslog message and returns it as GELF. Sender address is
+// used as host if the message has no hostname.
+func Convert(data []byte, from net.Addr) ([]byte, error) {
+	m, err := Parse(data)
+	if err != nil {
+		metrics.SyslogParseFailures.Inc()
+		return nil, errors.Wrap(err, "parsing syslog message")
+	}
+	host := from.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return m.GELF(host)
+}
+
+// Split splits syslog stream into messages. Both octet-counting and
+// newline-delimited framing are supported, as described in RFC 6587.
+func Split(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := octetCount(data); i > 0 {
+		n, err := strconv.Atoi(string(data[:i]))
+		if err != nil {
+			return 0, nil, errors.Wrap(err, "invalid message length")
+		}
+		if len(data) < i+1+n {
+			if atEOF {
+				return 0, nil, errors.New("truncated message")
+			}
+			return 0, nil, nil
+		}
+		return i + 1 + n, data[i+1 : i+1+n], nil
+	}
+	if i := bytes.IndexAny(data, "\n\x00"); i >= 0 {
+		return i + 1, bytes.TrimSuffix(data[:i], []byte("\r")), nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// octetCount returns the length of message length prefix followed by space,
+// zero if the data does not start with one
+func octetCount(data []byte) int {
+	for i, c := range data {
+		switch {
+		case c == ' ' && i > 0:
+			return i
+		case c < '0' || c > '9' || i > 9 || (i == 0 && c == '0'):
+			return 0
+		}
+	}
+	return 0
+}
+
+func (l *Listener) Listen(dest chan<- gelf.Chunk) error {
+	if l.Network == "udp" {
+		return l.listenUDP(dest)
+	}
+	stream := &tcp.Listener{
+		Address:        l.Address,
+		MaxConnections: l.MaxConnections,
+		IdleTimeout:    l.IdleTimeout,
+		MaxMessageSize: l.MaxMessageSize,
+		Split:          Split,
+		Decode:         Convert,
+		Filter:         l.Filter,
+	}
+	if l.Network == "tls" {
+		if l.TLSConfig == nil {
+			return errors.New("TLS is not configured")
+		}
+		stream.TLSConfig = l.TLSConfig
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.stream = stream
+	l.mu.Unlock()
+	return stream.Listen(dest)
+}
+
+func (l *Listener) listenUDP(dest chan<- gelf.Chunk) error {
+	conn, err := net.ListenPacket("udp", l.Address)
+	if err != nil {
+		return errors.Wrap(err, "listening on UDP port")
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return conn.Close()
+	}
+	l.conn = conn
+	l.mu.Unlock()
+	size := l.MaxMessageSize
+	if size <= 0 || size > maxUDPMessageSize {
+		size = maxUDPMessageSize
+	}
+	buf := make([]byte, size)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.closed {
+				return nil
+			}
+			return errors.Wrap(err, "reading UDP packet")
+		}
+		if l.Filter != nil && !l.Filter.Allowed(from) {
+			continue
+		}
+		msg, err := Convert(buf[:n], from)
+		if err == nil && l.Filter != nil {
+			tag, ok := l.Filter.Limit(from, 1)
+			if !ok {
+				continue
+			}
+			if tag {
+				msg, err = limit.Tag(msg)
+			}
+		}
+		if err != nil {
+			log.Printf("syslog %s: message from %s: %v", l.Address, from, err)
+			continue
+		}
+		dest <- msg
+	}
+}
+
+// Close stops the listener, Listen returns after all received messages are
+// passed on
+func (l *Listener) Close() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.conn != nil {
+		err = l.conn.Close()
+	}
+	if l.stream != nil {
+		err = l.stream.Close()
+	}
+	return
+}
@@ -0,0 +1,264 @@
+// Package syslog receives RFC 5424 and RFC 3164 (BSD) syslog messages and
+// converts them to GELF
+package syslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is a parsed syslog message
+type Message struct {
+	Facility  int
+	Severity  int
+	Timestamp time.Time
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	// StructuredData maps SD-ID to its parameters
+	StructuredData map[string]map[string]string
+	Message        string
+}
+
+const (
+	nilValue        = "-"
+	defaultPriority = 13 // user.notice
+	bsdTimestamp    = "Jan _2 15:04:05"
+)
+
+var facilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// now is replaced in tests
+var now = time.Now
+
+// Parse parses RFC 5424 message, falling back to RFC 3164. Messages without
+// priority are treated as user.notice with the whole text as message.
+func Parse(data []byte) (*Message, error) {
+	data = bytes.TrimRight(data, "\r\n\x00")
+	if len(data) == 0 {
+		return nil, errors.New("empty message")
+	}
+	m := &Message{StructuredData: make(map[string]map[string]string)}
+	pri, rest, err := parsePriority(data)
+	if err != nil {
+		return nil, err
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	if bytes.HasPrefix(rest, []byte("1 ")) {
+		err = m.parse5424(string(rest[2:]))
+	} else {
+		m.parse3164(string(rest))
+	}
+	return m, err
+}
+
+func parsePriority(data []byte) (pri int, rest []byte, err error) {
+	if data[0] != '<' {
+		return defaultPriority, data, nil
+	}
+	end := bytes.IndexByte(data, '>')
+	if end < 2 || end > 4 {
+		return 0, nil, errors.New("invalid priority")
+	}
+	if pri, err = strconv.Atoi(string(data[1:end])); err != nil || pri > 191 || pri < 0 {
+		return 0, nil, errors.Errorf("invalid priority %q", data[1:end])
+	}
+	return pri, data[end+1:], nil
+}
+
+// field cuts the next space-delimited header field
+func field(s string) (value, rest string) {
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func nilable(s string) string {
+	if s == nilValue {
+		return ""
+	}
+	return s
+}
+
+func (m *Message) parse5424(s string) (err error) {
+	var ts string
+	ts, s = field(s)
+	if ts == nilValue {
+		m.Timestamp = now()
+	} else if m.Timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+		return errors.Errorf("invalid timestamp %q", ts)
+	}
+	var host, app, proc, msgID string
+	host, s = field(s)
+	app, s = field(s)
+	proc, s = field(s)
+	msgID, s = field(s)
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = nilable(host), nilable(app), nilable(proc), nilable(msgID)
+	if s == "" {
+		return errors.New("structured data is missing")
+	}
+	if strings.HasPrefix(s, nilValue) {
+		s = s[1:]
+	} else if s, err = m.parseSD(s); err != nil {
+		return err
+	}
+	s = strings.TrimPrefix(s, " ")
+	m.Message = strings.TrimPrefix(s, string(utf8BOM))
+	return nil
+}
+
+// parseSD parses structured data elements and returns the rest of the message
+func (m *Message) parseSD(s string) (string, error) {
+	for strings.HasPrefix(s, "[") {
+		end := strings.IndexAny(s, " ]")
+		if end < 0 {
+			return "", errors.New("unterminated structured data")
+		}
+		id := s[1:end]
+		if id == "" {
+			return "", errors.New("empty SD-ID")
+		}
+		params := make(map[string]string)
+		s = s[end:]
+		for strings.HasPrefix(s, " ") {
+			eq := strings.Index(s, `="`)
+			if eq < 0 {
+				return "", errors.Errorf("invalid parameter of %q", id)
+			}
+			name := s[1:eq]
+			value, rest, err := parseParamValue(s[eq+2:])
+			if err != nil {
+				return "", errors.Wrapf(err, "parameter %q of %q", name, id)
+			}
+			params[name], s = value, rest
+		}
+		if !strings.HasPrefix(s, "]") {
+			return "", errors.Errorf("unterminated element %q", id)
+		}
+		m.StructuredData[id] = params
+		s = s[1:]
+	}
+	return s, nil
+}
+
+// parseParamValue unescapes quoted parameter value
+func parseParamValue(s string) (value, rest string, err error) {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return buf.String(), s[i+1:], nil
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+				i++
+				c = s[i]
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated value")
+}
+
+// parse3164 leniently parses BSD syslog message. Timestamp, hostname and tag
+// are optional.
+func (m *Message) parse3164(s string) {
+	m.Timestamp = now()
+	if len(s) >= len(bsdTimestamp) {
+		if ts, err := time.ParseInLocation(bsdTimestamp, s[:len(bsdTimestamp)], time.Local); err == nil {
+			m.Timestamp = withYear(ts)
+			s = strings.TrimPrefix(s[len(bsdTimestamp):], " ")
+			// hostname is omitted by some senders, the next token is the
+			// tag then
+			if host, rest := field(s); rest != "" && !strings.ContainsAny(host, ":[") {
+				m.Hostname, s = host, rest
+			}
+		}
+	}
+	m.Message = s
+	tag := tagPattern.FindStringSubmatch(s)
+	if tag == nil {
+		return
+	}
+	m.AppName, m.ProcID = tag[1], tag[3]
+	m.Message = s[len(tag[0]):]
+}
+
+var tagPattern = regexp.MustCompile(`^([^\s\[\]:]{1,48})(\[([^\]\s]*)\])?: ?`)
+
+// withYear sets current year to BSD timestamp, adjusting it for messages
+// received around New Year
+func withYear(ts time.Time) time.Time {
+	t := now()
+	res := time.Date(t.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), 0, ts.Location())
+	if res.Sub(t) > 24*time.Hour {
+		res = res.AddDate(-1, 0, 0)
+	}
+	return res
+}
+
+var invalidFieldChars = regexp.MustCompile(`[^\w.\-]`)
+
+// GELF returns message in GELF format. Structured data parameters are added
+// as additional fields. Hostname defaults to host.
+func (m *Message) GELF(host string) ([]byte, error) {
+	res := map[string]interface{}{
+		"version":   "1.1",
+		"host":      host,
+		"level":     m.Severity,
+		"timestamp": float64(m.Timestamp.UnixNano()/int64(time.Millisecond)) / 1000,
+		"_facility": facilities[m.Facility],
+	}
+	if m.Hostname != "" {
+		res["host"] = m.Hostname
+	}
+	for id, params := range m.StructuredData {
+		for name, value := range params {
+			key := "_" + invalidFieldChars.ReplaceAllString(name, "_")
+			if key == "_id" {
+				key = "_" + invalidFieldChars.ReplaceAllString(id, "_") + "_id"
+			}
+			res[key] = value
+		}
+	}
+	for key, value := range map[string]string{
+		"_app_name": m.AppName,
+		"_procid":   m.ProcID,
+		"_msgid":    m.MsgID,
+	} {
+		if value != "" {
+			res[key] = value
+		}
+	}
+	msg := strings.TrimRight(m.Message, " \r\n")
+	if i := strings.IndexByte(msg, '\n'); i >= 0 {
+		res["full_message"] = msg
+		msg = msg[:i]
+	}
+	if msg == "" {
+		msg = nilValue
+	}
+	res["short_message"] = msg
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(res); err != nil {
+		return nil, errors.Wrap(err, "encoding GELF")
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
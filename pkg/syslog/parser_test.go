@@ -0,0 +1,117 @@
+package syslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	now = func() time.Time { return time.Date(2018, 1, 2, 3, 4, 5, 0, time.Local) }
+}
+
+func TestConvert(t *testing.T) {
+	from := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 514}
+	for _, tc := range []struct {
+		name, in string
+		expected map[string]interface{}
+	}{
+		{
+			name: "rfc5424",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"][examplePriority@32473 class="high \"x\]"]` + "\xef\xbb\xbfAn application event log entry...",
+			expected: map[string]interface{}{
+				"version": "1.1", "host": "mymachine.example.com", "level": 5.0, "timestamp": 1065910455.003,
+				"_facility": "local4", "_app_name": "evntslog", "_msgid": "ID47",
+				"_iut": "3", "_eventSource": "Application", "_eventID": "1011", "_class": `high "x]`,
+				"short_message": "An application event log entry...",
+			},
+		},
+		{
+			name: "rfc5424 nil values",
+			in:   "<34>1 - - su 123 - -\n",
+			expected: map[string]interface{}{
+				"version": "1.1", "host": "10.0.0.1", "level": 2.0, "timestamp": 1514862245.0,
+				"_facility": "auth", "_app_name": "su", "_procid": "123", "short_message": "-",
+			},
+		},
+		{
+			name: "rfc3164",
+			in:   "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8",
+			expected: map[string]interface{}{
+				"version": "1.1", "host": "mymachine", "level": 2.0,
+				"timestamp": float64(time.Date(2017, 10, 11, 22, 14, 15, 0, time.Local).Unix()),
+				"_facility": "auth", "_app_name": "su", "_procid": "230",
+				"short_message": "'su root' failed for lonvick on /dev/pts/8",
+			},
+		},
+		{
+			name: "rfc3164 without hostname",
+			in:   "<13>Jan  2 01:00:00 cron: job done\nsecond line",
+			expected: map[string]interface{}{
+				"version": "1.1", "host": "10.0.0.1", "level": 5.0,
+				"timestamp": float64(time.Date(2018, 1, 2, 1, 0, 0, 0, time.Local).Unix()),
+				"_facility": "user", "_app_name": "cron",
+				"short_message": "job done", "full_message": "job done\nsecond line",
+			},
+		},
+		{
+			name: "no priority",
+			in:   "plain text",
+			expected: map[string]interface{}{
+				"version": "1.1", "host": "10.0.0.1", "level": 5.0, "timestamp": 1514862245.0,
+				"_facility": "user", "short_message": "plain text",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := Convert([]byte(tc.in), from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var res map[string]interface{}
+			if err := json.Unmarshal(data, &res); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, res)
+			}
+		})
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"<999>1 - - - - - -",
+		"<abc>message",
+		"<13>1 yesterday host app - - -",
+		"<13>1 - host app - -",
+		`<13>1 - host app - - [id a="b"`,
+		`<13>1 - host app - - [id a=b]`,
+	} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Errorf("%q: error expected", in)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	stream := "11 <13>1 - - -\n<13>plain\r\n<13>nul\x0011 multi\nline!<13>last"
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	scanner.Split(Split)
+	var res []string
+	for scanner.Scan() {
+		res = append(res, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"<13>1 - - -", "", "<13>plain", "<13>nul", "multi\nline!", "<13>last"}
+	if !reflect.DeepEqual(res, expected) {
+		t.Errorf("expected %q, got %q", expected, res)
+	}
+}
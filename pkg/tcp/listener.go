@@ -3,16 +3,59 @@ package tcp
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/armon/go-proxyproto"
 	"github.com/pkg/errors"
 
+	"github.com/andviro/grayproxy/pkg/auth"
 	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/limit"
 )
 
+// handshakeTimeout bounds TLS handshake and PROXY protocol header of new
+// connections if IdleTimeout is not set, so that clients that never finish
+// them do not hold connection slots
+const handshakeTimeout = 10 * time.Second
+
+// Listener accepts null-delimited GELF messages over TCP. Each connection is
+// served in its own goroutine, so a misbehaving client only loses its own
+// connection.
 type Listener struct {
 	Address string
+	// MaxConnections limits the number of simultaneously served clients,
+	// zero means no limit
+	MaxConnections int
+	// IdleTimeout closes connections that did not send anything for the
+	// specified number of milliseconds, zero disables the timeout. It also
+	// bounds TLS handshake, which takes handshakeTimeout otherwise.
+	IdleTimeout int
+	// MaxMessageSize limits the length of a single message, messages that
+	// exceed it terminate the connection. Defaults to bufio.MaxScanTokenSize
+	MaxMessageSize int
+	// TLSConfig enables TLS on accepted connections
+	TLSConfig *tls.Config
+	// Split splits the stream into messages, null-delimited framing is used
+	// by default
+	Split bufio.SplitFunc
+	// Decode converts received messages, messages it fails on are logged
+	// and skipped
+	Decode func(msg []byte, from net.Addr) ([]byte, error)
+	// Auth requires clients to present a verified certificate or send a
+	// token as the first message, and tags messages with client identity
+	Auth *auth.Authenticator
+	// Filter rejects connections from denied addresses and limits message
+	// rate of clients
+	Filter *limit.Filter
+
+	mu     sync.Mutex
+	lis    net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
 }
 
 func tcpSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -28,24 +71,227 @@ func tcpSplit(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return
 }
 
+// idleConn extends the read deadline of the underlying connection before
+// each read
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c idleConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+func (l *Listener) serve(conn net.Conn, dest chan<- gelf.Chunk) (err error) {
+	defer conn.Close()
+	if l.Filter != nil && !l.Filter.Allowed(conn.RemoteAddr()) {
+		log.Printf("tcp %s: connection from %s is denied", l.Address, conn.RemoteAddr())
+		return nil
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return errors.Wrap(err, "TLS handshake")
+		}
+	}
+	// the deadline set on accept covers the handshake only
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	var r net.Conn = conn
+	if l.IdleTimeout > 0 {
+		r = idleConn{Conn: conn, timeout: time.Duration(l.IdleTimeout) * time.Millisecond}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(tcpSplit)
+	if l.Split != nil {
+		scanner.Split(l.Split)
+	}
+	if l.MaxMessageSize > 0 {
+		scanner.Buffer(nil, l.MaxMessageSize)
+	}
+	var identity string
+	if l.Auth != nil {
+		if identity, err = l.authenticate(conn, scanner); err == auth.ErrUnauthorized {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var msg []byte
+		if l.Decode == nil {
+			msg = make([]byte, len(scanner.Bytes()))
+			copy(msg, scanner.Bytes())
+		} else if msg, err = l.Decode(scanner.Bytes(), conn.RemoteAddr()); err != nil {
+			log.Printf("tcp %s: message from %s: %v", l.Address, conn.RemoteAddr(), err)
+			continue
+		}
+		if l.Auth != nil {
+			if msg, err = auth.Tag(msg, identity); err != nil {
+				log.Printf("tcp %s: message from %s: %v", l.Address, conn.RemoteAddr(), err)
+				continue
+			}
+		}
+		if l.Filter != nil {
+			tag, ok := l.Filter.Limit(conn.RemoteAddr(), 1)
+			if !ok {
+				continue
+			}
+			if tag {
+				if msg, err = limit.Tag(msg); err != nil {
+					log.Printf("tcp %s: message from %s: %v", l.Address, conn.RemoteAddr(), err)
+					continue
+				}
+			}
+		}
+		dest <- msg
+	}
+	return errors.Wrap(scanner.Err(), "scanning input")
+}
+
+// handshakeTimeout returns the time new connection has to complete TLS
+// handshake or send PROXY protocol header
+func (l *Listener) handshakeTimeout() time.Duration {
+	if l.IdleTimeout > 0 {
+		return time.Duration(l.IdleTimeout) * time.Millisecond
+	}
+	return handshakeTimeout
+}
+
+// authenticate returns identity of the client, the rejection is logged by
+// the authenticator
+func (l *Listener) authenticate(conn net.Conn, scanner *bufio.Scanner) (string, error) {
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		state = &cs
+	}
+	return l.Auth.Conn(conn.RemoteAddr().String(), state, func() ([]byte, bool) {
+		for scanner.Scan() {
+			if len(scanner.Bytes()) > 0 {
+				return scanner.Bytes(), true
+			}
+		}
+		return nil, false
+	})
+}
+
+// track registers active connection, it returns false if the listener is
+// closed
+func (l *Listener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return false
+	}
+	if l.conns == nil {
+		l.conns = make(map[net.Conn]struct{})
+	}
+	l.conns[conn] = struct{}{}
+	return true
+}
+
+func (l *Listener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, conn)
+}
+
 func (l *Listener) Listen(dest chan<- gelf.Chunk) (err error) {
 	lis, err := net.Listen("tcp", l.Address)
 	if err != nil {
 		return errors.Wrap(err, "setting up TCP listener")
 	}
 	lis = &proxyproto.Listener{Listener: lis}
+	if l.TLSConfig != nil {
+		lis = tls.NewListener(lis, l.TLSConfig)
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return lis.Close()
+	}
+	l.lis = lis
+	l.mu.Unlock()
+	var sem chan struct{}
+	if l.MaxConnections > 0 {
+		sem = make(chan struct{}, l.MaxConnections)
+	}
+	var wg sync.WaitGroup
+	defer wg.Wait()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("tcp %s: accepting connection: %v", l.Address, err)
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.closed {
+				return nil
+			}
 			return errors.Wrap(err, "accepting connection")
 		}
-		scanner := bufio.NewScanner(conn)
-		scanner.Split(tcpSplit)
-		for scanner.Scan() {
-			dest <- scanner.Bytes()
+		// reading PROXY protocol header or TLS handshake may block, so
+		// they are bounded by the deadline
+		conn.SetDeadline(time.Now().Add(l.handshakeTimeout()))
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			default:
+				// remote address is not logged, as reading PROXY
+				// protocol header would block the listener
+				log.Printf("tcp %s: too many connections, rejecting connection", l.Address)
+				conn.Close()
+				continue
+			}
 		}
-		if err := scanner.Err(); err != nil {
-			return errors.Wrap(err, "scanning input")
+		if !l.track(conn) {
+			conn.Close()
+			if sem != nil {
+				<-sem
+			}
+			continue
 		}
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			defer l.untrack(conn)
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			if err := l.serve(conn, dest); err != nil && l.isOpen() {
+				log.Printf("tcp %s: connection from %s: %v", l.Address, conn.RemoteAddr(), err)
+			}
+		}(conn)
+	}
+}
+
+func (l *Listener) isOpen() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.closed
+}
+
+// Close stops accepting connections and closes active ones, Listen returns
+// after all connection handlers have finished
+func (l *Listener) Close() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.lis != nil {
+		err = l.lis.Close()
+	}
+	for conn := range l.conns {
+		conn.Close()
 	}
+	return
 }
@@ -0,0 +1,162 @@
+package tcp_test
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/andviro/grayproxy/pkg/auth"
+	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/tcp"
+)
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("could not connect to %s", addr)
+	return nil
+}
+
+func receive(t *testing.T, dest <-chan gelf.Chunk) string {
+	select {
+	case msg := <-dest:
+		return string(msg)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	return ""
+}
+
+func TestListener_Concurrent(t *testing.T) {
+	l := &tcp.Listener{Address: freeAddress(t), MaxMessageSize: 16}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+
+	idle := dial(t, l.Address)
+	defer idle.Close()
+	if _, err := idle.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := dial(t, l.Address)
+	defer bad.Close()
+	if _, err := bad.Write([]byte("this message is too long for the listener\x00")); err != nil {
+		t.Fatal(err)
+	}
+
+	active := dial(t, l.Address)
+	defer active.Close()
+	if _, err := active.Write([]byte("first\x00second\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, dest); msg != "first" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+	if msg := receive(t, dest); msg != "second" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	if _, err := idle.Write([]byte(" done\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, dest); msg != "partial done" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestListener_MaxConnections(t *testing.T) {
+	l := &tcp.Listener{Address: freeAddress(t), MaxConnections: 1}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+
+	first := dial(t, l.Address)
+	defer first.Close()
+	if _, err := first.Write([]byte("one\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, dest); msg != "one" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	second := dial(t, l.Address)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatal("second connection should be closed")
+	}
+}
+
+func TestListener_IdleTimeout(t *testing.T) {
+	l := &tcp.Listener{Address: freeAddress(t), IdleTimeout: 50}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+
+	conn := dial(t, l.Address)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("idle connection should be closed")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed by the listener")
+	}
+}
+
+func TestListener_Auth(t *testing.T) {
+	l := &tcp.Listener{Address: freeAddress(t), Auth: &auth.Authenticator{Tokens: map[string]string{"s3cr3t": "app"}}}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+
+	bad := dial(t, l.Address)
+	defer bad.Close()
+	if _, err := bad.Write([]byte("wrong\x00{\"a\":1}\x00")); err != nil {
+		t.Fatal(err)
+	}
+	bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Fatal("unauthenticated connection should be closed")
+	}
+
+	good := dial(t, l.Address)
+	defer good.Close()
+	if _, err := good.Write([]byte("s3cr3t\x00{\"a\":1,\"_source_token\":\"forged\"}\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, dest); msg != `{"_source_token":"app","a":1}` {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
+
+func TestListener_HandshakeTimeout(t *testing.T) {
+	l := &tcp.Listener{Address: freeAddress(t), IdleTimeout: 50, MaxConnections: 1, TLSConfig: &tls.Config{},
+		Auth: &auth.Authenticator{Tokens: map[string]string{"s3cr3t": "app"}}}
+	dest := make(chan gelf.Chunk, 10)
+	go l.Listen(dest)
+
+	conn := dial(t, l.Address)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("connection without TLS handshake should be closed")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("connection was not closed by the listener")
+	}
+}
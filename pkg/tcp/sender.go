@@ -47,3 +47,12 @@ func (s *Sender) Send(data []byte) (err error) {
 	s.write([]byte{0})
 	return s.err
 }
+
+// Close closes the connection
+func (s *Sender) Close() (err error) {
+	if s.conn != nil {
+		err = s.conn.Close()
+		s.conn = nil
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// ClientConfig describes TLS settings of outputs
+type ClientConfig struct {
+	// CAFile replaces system root certificates for server verification
+	CAFile string
+	// CertFile and KeyFile hold client certificate for mutual
+	// authentication
+	CertFile, KeyFile string
+	// ServerName overrides the name checked in server certificate
+	ServerName string
+	// InsecureSkipVerify disables verification of server certificate
+	InsecureSkipVerify bool
+}
+
+// Load returns TLS configuration of client
+func (c ClientConfig) Load() (*tls.Config, error) {
+	res := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading CA")
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading client certificate")
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
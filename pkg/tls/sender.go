@@ -1,17 +1,20 @@
 package tls
 
 import (
-	"net"
-	"time"
 	"crypto/tls"
 	"github.com/pkg/errors"
+	"net"
+	"time"
 )
 
 type Sender struct {
 	Address     string
 	SendTimeout int
-	conn        net.Conn
-	err         error
+	// TLSConfig defaults to the system root certificates and server name
+	// taken from Address
+	TLSConfig *tls.Config
+	conn      net.Conn
+	err       error
 }
 
 func (s *Sender) write(data []byte) {
@@ -37,7 +40,12 @@ func (s *Sender) write(data []byte) {
 func (s *Sender) Send(data []byte) (err error) {
 	if s.conn == nil {
 		s.err = nil
-		if s.conn, err = tls.Dial("tcp", s.Address, &tls.Config{} ); err != nil {
+		cfg := s.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		dialer := &net.Dialer{Timeout: time.Duration(s.SendTimeout) * time.Millisecond}
+		if s.conn, err = tls.DialWithDialer(dialer, "tcp", s.Address, cfg); err != nil {
 			s.err = errors.Wrap(err, "creating TLS connection")
 			return s.err
 		}
@@ -47,3 +55,12 @@ func (s *Sender) Send(data []byte) (err error) {
 	s.write([]byte{0})
 	return s.err
 }
+
+// Close closes the connection
+func (s *Sender) Close() (err error) {
+	if s.conn != nil {
+		err = s.conn.Close()
+		s.conn = nil
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reloadInterval limits how often certificate files are checked for changes
+var reloadInterval = time.Second
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseVersion converts version string like 1.2 to TLS version, empty string
+// means TLS 1.2
+func ParseVersion(v string) (uint16, error) {
+	if v == "" {
+		return tls.VersionTLS12, nil
+	}
+	res, ok := versions[v]
+	if !ok {
+		return 0, errors.Errorf("unknown TLS version %q", v)
+	}
+	return res, nil
+}
+
+// ServerConfig describes TLS settings of inputs
+type ServerConfig struct {
+	CertFile, KeyFile string
+	// ClientCAFile enables verification of client certificates
+	ClientCAFile string
+	// MinVersion is the minimal accepted TLS version, e.g. 1.2
+	MinVersion string
+}
+
+// server holds certificates loaded from files of ServerConfig
+type server struct {
+	ServerConfig
+	minVersion uint16
+
+	mu        sync.Mutex
+	checked   time.Time
+	modTimes  []time.Time
+	tlsConfig *tls.Config
+}
+
+// Load returns TLS configuration of server. Certificate, key and client CA
+// files are reloaded on handshake if they were changed.
+func (c ServerConfig) Load() (*tls.Config, error) {
+	s := &server{ServerConfig: c}
+	var err error
+	if s.minVersion, err = ParseVersion(c.MinVersion); err != nil {
+		return nil, err
+	}
+	if err = s.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:         s.minVersion,
+		GetConfigForClient: s.configForClient,
+	}, nil
+}
+
+func (s *server) files() []string {
+	return []string{s.CertFile, s.KeyFile, s.ClientCAFile}
+}
+
+func (s *server) modified() (res []time.Time) {
+	for _, fn := range s.files() {
+		var t time.Time
+		if fn != "" {
+			if stat, err := os.Stat(fn); err == nil {
+				t = stat.ModTime()
+			}
+		}
+		res = append(res, t)
+	}
+	return
+}
+
+func (s *server) load() error {
+	modTimes := s.modified()
+	cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	if err != nil {
+		return errors.Wrap(err, "loading TLS certificate")
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   s.minVersion,
+	}
+	if s.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "reading client CA")
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(data) {
+			return errors.Errorf("no certificates found in %s", s.ClientCAFile)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	s.tlsConfig, s.modTimes = cfg, modTimes
+	return nil
+}
+
+func (s *server) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.checked) < reloadInterval {
+		return s.tlsConfig, nil
+	}
+	s.checked = time.Now()
+	modTimes := s.modified()
+	for i := range modTimes {
+		if !modTimes[i].Equal(s.modTimes[i]) {
+			// previous certificate is kept until the new one loads
+			if err := s.load(); err != nil {
+				log.Printf("reloading TLS certificate %s: %v", s.CertFile, err)
+				break
+			}
+			log.Printf("reloaded TLS certificate %s", s.CertFile)
+			break
+		}
+	}
+	return s.tlsConfig, nil
+}
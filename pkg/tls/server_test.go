@@ -0,0 +1,165 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCert creates certificate signed by parent, self-signed CA if parent is
+// nil
+func newCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	if err := ioutil.WriteFile(certFile, c.certPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, c.keyPEM(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve accepts connections completing handshakes until listener is closed
+func serve(t *testing.T, cfg *tls.Config) net.Listener {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return lis
+}
+
+func handshake(addr string, cfg *tls.Config) (*tls.Conn, error) {
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	// client certificate errors are reported after the handshake
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestServerConfig(t *testing.T) {
+	reloadInterval = 0
+	dir, err := ioutil.TempDir("", "grayproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+
+	ca := newCert(t, "ca", nil)
+	if err := ioutil.WriteFile(caFile, ca.certPEM(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newCert(t, "server1", ca).write(t, certFile, keyFile)
+	cfg, err := ServerConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: "1.2"}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := serve(t, cfg)
+	defer lis.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := newCert(t, "client", ca)
+	clientCertFile, clientKeyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	client.write(t, clientCertFile, clientKeyFile)
+	clientCfg, err := ClientConfig{CAFile: caFile, CertFile: clientCertFile, KeyFile: clientKeyFile, ServerName: "server1"}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := handshake(lis.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if _, err := handshake(lis.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "server1"}); err == nil {
+		t.Error("client without certificate should be rejected")
+	}
+	if _, err := handshake(lis.Addr().String(), &tls.Config{RootCAs: roots, ServerName: "server1", Certificates: clientCfg.Certificates, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Error("TLS 1.1 should be rejected")
+	}
+
+	// modification time resolution of some file systems is one second
+	time.Sleep(1100 * time.Millisecond)
+	newCert(t, "server2", ca).write(t, certFile, keyFile)
+	clientCfg.ServerName = "server2"
+	conn, err = handshake(lis.Addr().String(), clientCfg)
+	if err != nil {
+		t.Fatalf("certificate is not reloaded: %v", err)
+	}
+	conn.Close()
+}
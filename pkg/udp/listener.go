@@ -2,16 +2,25 @@ package udp
 
 import (
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/andviro/grayproxy/pkg/gelf"
+	"github.com/andviro/grayproxy/pkg/limit"
 )
 
 type Listener struct {
 	Address                                                            string
 	MaxChunkSize, MaxMessageSize, DecompressSizeLimit, AssembleTimeout int
+	// Filter drops datagrams from denied addresses and limits datagram rate
+	// of clients. Chunked messages are not tagged by limit.ActionTag.
+	Filter *limit.Filter
+
+	mu     sync.Mutex
+	conn   net.PacketConn
+	closed bool
 }
 
 func (l *Listener) address() string {
@@ -22,26 +31,83 @@ func (l *Listener) address() string {
 }
 
 func (in *Listener) Listen(dest chan<- gelf.Chunk) (err error) {
-	chunks := make(chan gelf.Chunk)
-	defer close(chunks)
+	l, err := net.ListenPacket("udp", in.address())
+	if err != nil {
+		return errors.Wrap(err, "listening on UDP port")
+	}
+	in.mu.Lock()
+	if in.closed {
+		in.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	in.conn = l
+	in.mu.Unlock()
 
+	chunks := make(chan gelf.Chunk)
 	decodedMsgs := gelf.Extract(gelf.Assemble(chunks, in.MaxMessageSize, time.Millisecond*time.Duration(in.AssembleTimeout)), in.DecompressSizeLimit)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for msg := range decodedMsgs {
 			dest <- msg
 		}
 	}()
+	defer func() {
+		close(chunks)
+		<-done
+	}()
 
-	l, err := net.ListenPacket("udp", in.address())
-	if err != nil {
-		return errors.Wrap(err, "listening on UDP port")
-	}
 	buf := make([]byte, in.MaxChunkSize)
 	for {
-		n, _, err := l.ReadFrom(buf)
+		n, from, err := l.ReadFrom(buf)
 		if err != nil {
+			in.mu.Lock()
+			defer in.mu.Unlock()
+			if in.closed {
+				return nil
+			}
 			return errors.Wrap(err, "reading UDP packet")
 		}
-		chunks <- buf[:n]
+		chunk := make(gelf.Chunk, n)
+		copy(chunk, buf[:n])
+		if in.Filter != nil {
+			var ok bool
+			if chunk, ok = in.filter(chunk, from); !ok {
+				continue
+			}
+		}
+		chunks <- chunk
+	}
+}
+
+// filter applies address filter and rate limit to the datagram
+func (in *Listener) filter(chunk gelf.Chunk, from net.Addr) (gelf.Chunk, bool) {
+	if !in.Filter.Allowed(from) {
+		return nil, false
+	}
+	tag, ok := in.Filter.Limit(from, 1)
+	if !tag || chunk.IsGELF() {
+		return chunk, ok
+	}
+	data, err := chunk.Data(in.DecompressSizeLimit)
+	if err != nil {
+		return chunk, true
+	}
+	if data, err = limit.Tag(data); err != nil {
+		return chunk, true
+	}
+	return data, true
+}
+
+// Close stops the listener, Listen returns after all received messages are
+// passed on
+func (in *Listener) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.closed = true
+	if in.conn == nil {
+		return nil
 	}
+	return in.conn.Close()
 }
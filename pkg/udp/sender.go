@@ -5,11 +5,20 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/gelf"
 )
 
+// Sender sends messages as GELF UDP datagrams, splitting large messages into
+// chunks
 type Sender struct {
 	Address     string
 	SendTimeout int
+	// ChunkSize limits datagram size, defaults to gelf.DefaultChunkSize
+	ChunkSize int
+	// Compression is one of gelf.CompressNone, gelf.CompressGzip or
+	// gelf.CompressZlib
+	Compression string
 	conn        net.Conn
 	err         error
 }
@@ -34,7 +43,21 @@ func (s *Sender) write(data []byte) {
 	}
 }
 
+func (s *Sender) chunkSize() int {
+	if s.ChunkSize <= 0 {
+		return gelf.DefaultChunkSize
+	}
+	return s.ChunkSize
+}
+
 func (s *Sender) Send(data []byte) (err error) {
+	if data, err = gelf.Compress(data, s.Compression); err != nil {
+		return
+	}
+	chunks, err := gelf.Split(data, s.chunkSize())
+	if err != nil {
+		return errors.Wrap(err, "splitting message")
+	}
 	if s.conn == nil {
 		s.err = nil
 		if s.conn, err = net.DialTimeout("udp", s.Address, time.Duration(s.SendTimeout)*time.Millisecond); err != nil {
@@ -43,7 +66,17 @@ func (s *Sender) Send(data []byte) (err error) {
 		}
 	}
 	s.conn.SetDeadline(time.Now().Add(time.Duration(s.SendTimeout) * time.Millisecond))
-	s.write(data)
-	s.write([]byte{0})
+	for _, chunk := range chunks {
+		s.write(chunk)
+	}
 	return s.err
 }
+
+// Close closes the connection
+func (s *Sender) Close() (err error) {
+	if s.conn != nil {
+		err = s.conn.Close()
+		s.conn = nil
+	}
+	return
+}
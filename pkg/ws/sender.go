@@ -2,6 +2,7 @@ package ws
 
 import (
 	"log"
+	"net"
 	"net/http"
 	"sync"
 
@@ -32,6 +33,7 @@ type Sender struct {
 	url     *url.URL
 	once    sync.Once
 	clients map[*wsListener]bool
+	srv     *http.Server
 }
 
 func (s *Sender) Start() error {
@@ -44,7 +46,15 @@ func (s *Sender) Start() error {
 		}
 		s.url = u
 		s.clients = make(map[*wsListener]bool)
-		go s.listenAndServe()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", s.logs)
+		s.srv = &http.Server{Addr: u.Host, Handler: mux}
+		ln, err := net.Listen("tcp", u.Host)
+		if err != nil {
+			rErr = errors.Wrap(err, "listen")
+			return
+		}
+		go s.serve(ln)
 	})
 	return rErr
 }
@@ -97,9 +107,18 @@ func (s *Sender) logs(w http.ResponseWriter, r *http.Request) {
 	log.Print("Disconnected: ", r.RemoteAddr)
 }
 
-func (s *Sender) listenAndServe() {
-	http.HandleFunc("/", s.logs)
-	log.Fatal(http.ListenAndServe(s.url.Host, nil))
+func (s *Sender) serve(ln net.Listener) {
+	if err := s.srv.Serve(ln); err != http.ErrServerClosed {
+		log.Printf("websocket server: %v", err)
+	}
+}
+
+// Close stops the WebSocket server
+func (s *Sender) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Close()
 }
 
 type msg struct {
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/andviro/grayproxy/pkg/disk"
+	"github.com/andviro/grayproxy/pkg/gelf"
+)
+
+const queueUsage = `usage: grayproxy queue <command> [options] [queue ...]
+
+Inspects and modifies disk queues of outputs in dataDir. Queues are named by
+output ids, all queues are used if none are given.
+
+Commands:
+  stats   show the number, size and age of queued messages
+  peek    show the first messages of each queue
+  dump    print queued messages as NDJSON
+  replay  send queued messages to an output
+  purge   remove queued messages
+
+stats, peek and dump only read the queues and may be used while grayproxy is
+running. replay -remove and purge require grayproxy to be stopped. Encrypted
+queues are read with keys listed in the configuration file given by -config.
+Run grayproxy queue <command> -h for options of the command.
+`
+
+// queueCmd holds options of queue subcommands
+type queueCmd struct {
+	dataDir    string
+	configFile string
+	keys       *disk.Keys
+	w          io.Writer
+
+	filter queueFilter
+	limit  int
+	meta   bool
+	out    string
+	remove bool
+	all    bool
+}
+
+// queueFilter selects messages by the time they were queued and by their
+// content
+type queueFilter struct {
+	since, until time.Time
+	grep         string
+	fields       map[string]string
+}
+
+func (f *queueFilter) empty() bool {
+	return f.since.IsZero() && f.until.IsZero() && f.grep == "" && len(f.fields) == 0
+}
+
+func (f *queueFilter) match(r disk.Record) bool {
+	if !f.since.IsZero() && r.Time.Before(f.since) || !f.until.IsZero() && !r.Time.Before(f.until) {
+		return false
+	}
+	if f.grep == "" && len(f.fields) == 0 {
+		return true
+	}
+	data := decodeMessage(r.Data)
+	if f.grep != "" && !strings.Contains(string(data), f.grep) {
+		return false
+	}
+	if len(f.fields) == 0 {
+		return true
+	}
+	var msg map[string]interface{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+	for k, v := range f.fields {
+		if value, ok := msg[k]; !ok || fmt.Sprint(value) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeMessage returns decompressed message, compressed GELF messages are
+// queued as received
+func decodeMessage(data []byte) []byte {
+	if res, err := gelf.Chunk(data).Data(0); err == nil {
+		return res
+	}
+	return data
+}
+
+// timeFlag accepts RFC 3339 time or duration before now
+type timeFlag struct{ t *time.Time }
+
+func (tf timeFlag) String() string {
+	if tf.t == nil || tf.t.IsZero() {
+		return ""
+	}
+	return tf.t.Format(time.RFC3339)
+}
+
+func (tf timeFlag) Set(v string) error {
+	if d, err := time.ParseDuration(v); err == nil {
+		*tf.t = time.Now().Add(-d)
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return errors.Errorf("invalid time %q, expected RFC 3339 time or duration", v)
+	}
+	*tf.t = t
+	return nil
+}
+
+// fieldFlag collects field=value pairs
+type fieldFlag map[string]string
+
+func (ff fieldFlag) String() string {
+	var res []string
+	for k, v := range ff {
+		res = append(res, k+"="+v)
+	}
+	return strings.Join(res, ",")
+}
+
+func (ff fieldFlag) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 {
+		return errors.Errorf("invalid field %q, expected name=value", v)
+	}
+	ff[v[:i]] = v[i+1:]
+	return nil
+}
+
+// runQueue executes queue subcommand
+func runQueue(args []string, w io.Writer) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		fmt.Fprint(w, queueUsage)
+		return nil
+	}
+	name := args[0]
+	cmd := &queueCmd{w: w, filter: queueFilter{fields: make(map[string]string)}}
+	fs := flag.NewFlagSet("grayproxy queue "+name, flag.ContinueOnError)
+	fs.SetOutput(w)
+	fs.StringVar(&cmd.dataDir, "dataDir", "", "buffer directory")
+	fs.StringVar(&cmd.configFile, "config", "", "configuration file to take dataDir and encryption keys from")
+	if name == "peek" {
+		fs.IntVar(&cmd.limit, "n", 10, "number of messages of each queue")
+	} else if name != "stats" {
+		fs.IntVar(&cmd.limit, "n", 0, "maximum number of messages of each queue (0 means all)")
+	}
+	if name == "dump" || name == "replay" || name == "purge" {
+		fs.Var(timeFlag{&cmd.filter.since}, "since", "select messages queued since RFC 3339 time or duration ago, e.g. 1h")
+		fs.Var(timeFlag{&cmd.filter.until}, "until", "select messages queued before RFC 3339 time or duration ago")
+		fs.StringVar(&cmd.filter.grep, "grep", "", "select messages containing the string")
+		fs.Var(fieldFlag(cmd.filter.fields), "field", "select messages with field equal to value, in form name=value (may be specified multiple times)")
+	}
+	var run func(name, dir string) error
+	switch name {
+	case "stats":
+		return cmd.stats(fs, args[1:])
+	case "peek":
+		run = cmd.peek
+	case "dump":
+		fs.BoolVar(&cmd.meta, "meta", false, "wrap messages into objects with queue name and time")
+		run = cmd.dump
+	case "replay":
+		fs.StringVar(&cmd.out, "out", "", "output address in form schema://address:port, as in -out option of grayproxy")
+		fs.BoolVar(&cmd.remove, "remove", false, "remove sent messages from the queue")
+		run = cmd.replay
+	case "purge":
+		fs.BoolVar(&cmd.all, "all", false, "remove all messages if no filters are given")
+		run = cmd.purge
+	default:
+		return errors.Errorf("unknown queue command %q\n\n%s", name, queueUsage)
+	}
+	queues, err := cmd.parse(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	switch {
+	case name == "replay" && cmd.out == "":
+		return errors.New("-out is required")
+	case name == "purge" && cmd.filter.empty() && cmd.limit == 0 && !cmd.all:
+		return errors.New("specify filters or -all to remove all messages")
+	}
+	for _, q := range queues {
+		if err := run(q, filepath.Join(cmd.dataDir, q)); err != nil {
+			return errors.Wrapf(err, "queue %s", q)
+		}
+	}
+	return nil
+}
+
+// parse parses options and returns names of queues to use
+func (cmd *queueCmd) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if cmd.configFile != "" {
+		app := &app{configFile: cmd.configFile}
+		cfg, err := app.loadConfig()
+		if err != nil {
+			return nil, err
+		}
+		if cmd.dataDir == "" {
+			cmd.dataDir = cfg.DataDir
+		}
+		cmd.keys = cfg.diskKeys
+	}
+	if cmd.dataDir == "" {
+		return nil, errors.New("-dataDir or -config is required")
+	}
+	if queues := fs.Args(); len(queues) > 0 {
+		for _, q := range queues {
+			if _, err := os.Stat(filepath.Join(cmd.dataDir, q)); err != nil {
+				return nil, errors.Errorf("queue %s not found in %s", q, cmd.dataDir)
+			}
+		}
+		return queues, nil
+	}
+	return listQueues(cmd.dataDir)
+}
+
+// listQueues returns subdirectories of dataDir holding disk queues
+func listQueues(dataDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading dataDir")
+	}
+	var res []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if seqs, _ := filepath.Glob(filepath.Join(dataDir, e.Name(), "*.seg")); len(seqs) > 0 {
+			res = append(res, e.Name())
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (cmd *queueCmd) stats(fs *flag.FlagSet, args []string) error {
+	queues, err := cmd.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(cmd.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "QUEUE\tMESSAGES\tBYTES\tSEGMENTS\tOLDEST\tNEWEST")
+	for _, q := range queues {
+		st, err := disk.Stat(filepath.Join(cmd.dataDir, q))
+		if err != nil {
+			return errors.Wrapf(err, "queue %s", q)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%s\n", q, st.Messages, st.Bytes, st.Segments, formatTime(st.Oldest), formatTime(st.Newest))
+	}
+	return tw.Flush()
+}
+
+// options returns options of the queue in dir
+func (cmd *queueCmd) options(dir string) disk.Options {
+	return disk.Options{Dir: dir, Keys: cmd.keys}
+}
+
+// scan calls fn for messages of the queue matching filters, up to the limit
+func (cmd *queueCmd) scan(dir string, fn func(disk.Record) error) (err error) {
+	n := 0
+	scanErr := disk.Scan(cmd.options(dir), func(r disk.Record) bool {
+		if !cmd.filter.match(r) {
+			return true
+		}
+		if err = fn(r); err != nil {
+			return false
+		}
+		n++
+		return cmd.limit <= 0 || n < cmd.limit
+	})
+	if err == nil {
+		err = scanErr
+	}
+	return err
+}
+
+func (cmd *queueCmd) peek(name, dir string) error {
+	return cmd.scan(dir, func(r disk.Record) error {
+		_, err := fmt.Fprintf(cmd.w, "%s\t%s\t%s\n", name, formatTime(r.Time), decodeMessage(r.Data))
+		return err
+	})
+}
+
+func (cmd *queueCmd) dump(name, dir string) error {
+	enc := json.NewEncoder(cmd.w)
+	return cmd.scan(dir, func(r disk.Record) error {
+		msg := json.RawMessage(decodeMessage(r.Data))
+		var v interface{} = msg
+		if !json.Valid(msg) {
+			v = string(msg)
+		}
+		if cmd.meta {
+			v = struct {
+				Queue   string      `json:"queue"`
+				Time    time.Time   `json:"time"`
+				Message interface{} `json:"message"`
+			}{name, r.Time, v}
+		}
+		return enc.Encode(v)
+	})
+}
+
+func (cmd *queueCmd) replay(name, dir string) (err error) {
+	out, err := parseOutput(cmd.out)
+	if err == nil {
+		err = out.extractParams()
+	}
+	if err != nil {
+		return err
+	}
+	out.SendTimeout = pick(out.SendTimeout, defaultConfig().SendTimeout)
+	s, err := newSender(out)
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer func() {
+			if e := c.Close(); err == nil {
+				err = e
+			}
+		}()
+	}
+	var sent int
+	defer func() {
+		fmt.Fprintf(cmd.w, "%s: replayed %d messages\n", name, sent)
+	}()
+	if !cmd.remove {
+		return cmd.scan(dir, func(r disk.Record) error {
+			if err := s.Send(r.Data); err != nil {
+				return err
+			}
+			sent++
+			return nil
+		})
+	}
+	// messages are removed as they are sent, the rest are kept after
+	// failure
+	var sendErr error
+	_, err = disk.Purge(cmd.options(dir), func(r disk.Record) bool {
+		if sendErr != nil || cmd.limit > 0 && sent >= cmd.limit || !cmd.filter.match(r) {
+			return false
+		}
+		if sendErr = s.Send(r.Data); sendErr != nil {
+			return false
+		}
+		sent++
+		return true
+	})
+	if err == nil {
+		err = sendErr
+	}
+	return err
+}
+
+func (cmd *queueCmd) purge(name, dir string) error {
+	var n int
+	removed, err := disk.Purge(cmd.options(dir), func(r disk.Record) bool {
+		if cmd.limit > 0 && n >= cmd.limit || !cmd.filter.match(r) {
+			return false
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(cmd.w, "%s: removed %d messages\n", name, removed)
+	return err
+}
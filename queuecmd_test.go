@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andviro/grayproxy/pkg/disk"
+)
+
+func TestRunQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grayproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	q, err := disk.New(disk.Options{Dir: filepath.Join(dir, "out"), Name: "out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{
+		`{"short_message":"m1","host":"a"}`,
+		`{"short_message":"m2","host":"b"}`,
+		`{"short_message":"m3","host":"a"}`,
+	} {
+		if err := q.Put([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) string {
+		var buf bytes.Buffer
+		if err := runQueue(append(args[:1], append([]string{"-dataDir", dir}, args[1:]...)...), &buf); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return buf.String()
+	}
+
+	if res := run("stats"); !strings.Contains(res, "out    3") {
+		t.Errorf("unexpected stats:\n%s", res)
+	}
+	if res := run("dump", "-field", "host=a"); res != "{\"short_message\":\"m1\",\"host\":\"a\"}\n{\"short_message\":\"m3\",\"host\":\"a\"}\n" {
+		t.Errorf("unexpected dump:\n%s", res)
+	}
+	if err := runQueue([]string{"purge", "-dataDir", dir}, ioutil.Discard); err == nil {
+		t.Error("purge without filters should require -all")
+	}
+	if res := run("purge", "-grep", "m2"); res != "out: removed 1 messages\n" {
+		t.Errorf("unexpected purge result: %q", res)
+	}
+	fn := filepath.Join(dir, "replay.ndjson")
+	if res := run("replay", "-out", "file://"+fn, "-remove", "-n", "1", "out"); res != "out: replayed 1 messages\n" {
+		t.Errorf("unexpected replay result: %q", res)
+	}
+	if data, err := ioutil.ReadFile(fn); err != nil || !strings.Contains(string(data), `"m1"`) || strings.Contains(string(data), `"m3"`) {
+		t.Errorf("unexpected replayed messages: %s %v", data, err)
+	}
+	if res := run("peek"); !strings.Contains(res, `"m3"`) || strings.Count(res, "\n") != 1 {
+		t.Errorf("only the last message should be left: %s", res)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ring "github.com/cloudflare/buffer"
+
+	"github.com/andviro/grayproxy/pkg/gelf"
+)
+
+// testInputs keep tests from listening on the default input port
+const testInputs = "inputs:\n  - url: udp://127.0.0.1:0\n"
+
+// startTestApp starts the pipeline configured by configuration file data
+func startTestApp(t *testing.T, data string) *app {
+	cfg, err := loadTestConfig(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := new(app)
+	if err := app.start(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// applyTestConfig applies configuration file data to the running app
+func applyTestConfig(t *testing.T, app *app, data string) {
+	cfg, err := loadTestConfig(t, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.apply(cfg)
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func testMessage(i int) gelf.Chunk {
+	return gelf.Chunk(fmt.Sprintf(`{"short_message":"%d"}`, i))
+}
+
+// fileLines returns lines of file fn, if it exists
+func fileLines(fn string) (res []string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		res = append(res, s.Text())
+	}
+	return
+}
+
+// readLines waits until file fn has n lines and returns them
+func readLines(t *testing.T, fn string, n int) (res []string) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if res = fileLines(fn); len(res) >= n {
+			break
+		}
+	}
+	return
+}
+
+// dial connects to the input started in background
+func dial(t *testing.T, addr string) (conn net.Conn) {
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			return
+		}
+	}
+	t.Fatal(err)
+	return
+}
+
+// checkMessages reports lines that are not messages from 0 to n-1 each
+// written once
+func checkMessages(t *testing.T, lines []string, n int) {
+	seen := make(map[string]int)
+	for _, line := range lines {
+		seen[line]++
+	}
+	for i := 0; i < n; i++ {
+		msg := string(testMessage(i))
+		if seen[msg] != 1 {
+			t.Errorf("message %s written %d times", msg, seen[msg])
+		}
+		delete(seen, msg)
+	}
+	for line := range seen {
+		t.Errorf("unexpected line %s", line)
+	}
+}
+
+func TestApply_Websocket(t *testing.T) {
+	addr := freeAddr(t)
+	app := startTestApp(t, fmt.Sprintf(testInputs+"outputs:\n  - url: ws://%s\n    id: ws\n", addr))
+	defer app.shutdown()
+	// the changed output listens on the same port
+	applyTestConfig(t, app, fmt.Sprintf(testInputs+"outputs:\n  - url: ws://%s\n    id: ws\n    group: ws\n", addr))
+	if o, ok := app.outputs["ws"]; !ok || app.groups[0].Name != "ws" || app.groups[0].Outputs[0] != o {
+		t.Fatalf("output is not replaced: %v", app.outputs)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestApply_File(t *testing.T) {
+	fn := filepath.Join(tempDir(t), "out.ndjson")
+	app := startTestApp(t, fmt.Sprintf(testInputs+"outputs:\n  - url: file://%s\n    id: file\n", fn))
+	defer app.shutdown()
+	for i := 0; i < 100; i++ {
+		app.msgs <- testMessage(i)
+	}
+	// the changed output writes to the same file
+	applyTestConfig(t, app, fmt.Sprintf(testInputs+"outputs:\n  - url: file://%s?syncInterval=-1\n    id: file\n", fn))
+	for i := 100; i < 200; i++ {
+		app.msgs <- testMessage(i)
+	}
+	lines := readLines(t, fn, 200)
+	checkMessages(t, lines, 200)
+	for i, line := range lines {
+		if !strings.HasSuffix(line, fmt.Sprintf(`"%d"}`, i)) {
+			t.Fatalf("messages are out of order at line %d: %s", i, line)
+		}
+	}
+}
+
+func TestStart_LegacyQueue(t *testing.T) {
+	// the output may be named like the legacy queue file
+	for _, id := range []string{"", "queue"} {
+		dir := tempDir(t)
+		buf, err := ring.New(filepath.Join(dir, legacyQueue), 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := buf.Insert(testMessage(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		fn := filepath.Join(dir, "out.ndjson")
+		app := startTestApp(t, fmt.Sprintf(testInputs+"dataDir: %s\noutputs:\n  - url: file://%s\n    id: %q\n", dir, fn, id))
+		checkMessages(t, readLines(t, fn, 3), 3)
+		app.shutdown()
+		if _, err := os.Stat(filepath.Join(dir, legacyQueue+".old")); !os.IsNotExist(err) {
+			t.Errorf("%q: legacy queue is not removed: %v", id, err)
+		}
+	}
+}
+
+func TestApply_Load(t *testing.T) {
+	dir := tempDir(t)
+	in, toggled := freeAddr(t), freeAddr(t)
+	file := func(name string) string { return filepath.Join(dir, name+".ndjson") }
+	output := func(id string, weight int) string {
+		return fmt.Sprintf("  - url: file://%s\n    id: %s\n    weight: %d\n", file(id), id, weight)
+	}
+	configs := []string{
+		"inputs:\n  - url: tcp://" + in + "\noutputs:\n" + output("a", 1),
+		// an output and an input are added
+		"inputs:\n  - url: tcp://" + in + "\n  - url: tcp://" + toggled + "\noutputs:\n" + output("a", 1) + output("b", 1) +
+			"routes:\n  - strategy: roundrobin\n",
+		// the output is changed, the input is changed
+		"inputs:\n  - url: tcp://" + in + "\n  - url: tcp://" + toggled + "\n    maxConnections: 5\noutputs:\n" + output("a", 2) + output("b", 1),
+		// the output and the input are removed
+		"inputs:\n  - url: tcp://" + in + "\noutputs:\n" + output("b", 1) + output("c", 1) +
+			"routes:\n  - strategy: roundrobin\n",
+	}
+	app := startTestApp(t, configs[0])
+	defer app.shutdown()
+	conn := dial(t, in)
+	defer conn.Close()
+	const n = 2000
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < n; i++ {
+			if _, err := conn.Write(append(testMessage(i), 0)); err != nil {
+				t.Error(err)
+				return
+			}
+			if i%100 == 0 {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}()
+	for i := 1; i < 20; i++ {
+		applyTestConfig(t, app, configs[i%len(configs)])
+		time.Sleep(5 * time.Millisecond)
+	}
+	<-sent
+	var lines []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		lines = nil
+		for _, id := range []string{"a", "b", "c"} {
+			lines = append(lines, fileLines(file(id))...)
+		}
+		if len(lines) >= n {
+			break
+		}
+	}
+	checkMessages(t, lines, n)
+}